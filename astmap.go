@@ -1,5 +1,7 @@
 package rivescript
 
+import "regexp"
+
 /*
 For my own sanity while programming the code, these structs mirror the data
 in the 'ast' subpackage but uses non-exported fields for the bot's own use.
@@ -42,11 +44,13 @@ type astTopic struct {
 }
 
 type astTrigger struct {
-	trigger   string
-	reply     []string
-	condition []string
-	redirect  string
-	previous  string
+	trigger    string
+	reply      []string
+	condition  []string
+	conditions []*condition   // The parsed conditions
+	regexp     *regexp.Regexp // For a raw regular expression trigger
+	redirect   string
+	previous   string
 }
 
 type astObject struct {
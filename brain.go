@@ -1,10 +1,13 @@
 package rivescript
 
 import (
+	"context"
 	"fmt"
 	re "regexp"
 	"strconv"
 	"strings"
+
+	"github.com/aichaos/rivescript-go/sessions"
 )
 
 /*
@@ -16,54 +19,155 @@ Parameters
 	message: The user's message.
 */
 func (rs *RiveScript) Reply(username, message string) (string, error) {
+	return rs.ReplyContext(context.Background(), username, message)
+}
+
+/*
+ReplyContext fetches a reply from the bot for a user's message, like Reply.
+
+An object macro that wants a reply for the same user should pass on the
+context it was called with. The reply is then part of the one that called the
+macro: it sees that reply's changes to the user's data, and its own changes
+are saved along with them, instead of separately.
+
+Parameters
+
+	ctx: The context of the reply.
+	username: The name of the user requesting a reply.
+	message: The user's message.
+*/
+func (rs *RiveScript) ReplyContext(ctx context.Context, username, message string) (string, error) {
+	info, err := rs.ReplyWithInfoContext(ctx, username, message)
+	if err != nil {
+		return "", err
+	}
+	return info.Reply, nil
+}
+
+// ReplyInfo is a reply with details about how it was found.
+type ReplyInfo struct {
+	Reply string
+
+	// Trigger is the trigger that matched the user's message, or empty if
+	// none did. Redirects don't change it.
+	Trigger string
+
+	// Stars are the trigger's stars, in order, and NamedStars are the ones
+	// with names, like *{name}.
+	Stars      []string
+	NamedStars map[string]string
+}
+
+/*
+ReplyWithInfo fetches a reply from the bot for a user's message, like Reply,
+along with the trigger it matched and its stars.
+
+Parameters
+
+	username: The name of the user requesting a reply.
+	message: The user's message.
+*/
+func (rs *RiveScript) ReplyWithInfo(username, message string) (*ReplyInfo, error) {
+	return rs.ReplyWithInfoContext(context.Background(), username, message)
+}
+
+/*
+ReplyWithInfoContext fetches a reply from the bot for a user's message, like
+ReplyWithInfo, with a context like ReplyContext.
+
+Parameters
+
+	ctx: The context of the reply.
+	username: The name of the user requesting a reply.
+	message: The user's message.
+*/
+func (rs *RiveScript) ReplyWithInfoContext(ctx context.Context, username, message string) (*ReplyInfo, error) {
 	rs.say("Asked to reply to [%s] %s", username, message)
-	var err error
 
-	// Initialize a user profile for this user?
-	rs.sessions.Init(username)
+	// Hold the user's lock for the whole reply, if enabled. A reply that's
+	// nested in another for the same user already has it.
+	if rs.locker != nil && rs.parentSession(ctx, username) == nil {
+		unlock, err := rs.locker.Lock(username)
+		if err != nil {
+			return nil, err
+		}
+		defer unlock()
+	}
 
-	// Store the current user's ID.
-	rs.inReplyContext = true
-	rs.currentUser = username
+	// Buffer the user's session for the reply. Their changes are saved when
+	// it's done, or thrown away if it fails.
+	buf := rs.beginSession(ctx, username)
+
+	info, err := rs.reply(buf, message)
+
+	if saveErr := rs.endSession(buf, err == nil); saveErr != nil && err == nil {
+		err = fmt.Errorf("couldn't save the session for %s: %s", username, saveErr)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// reply is the body of ReplyWithInfo(), run while the user's session is
+// buffered.
+func (rs *RiveScript) reply(buf *sessionBuffer, message string) (*ReplyInfo, error) {
+	// Remember which topic the message was received in, for the history.
+	topic, err := buf.get("topic")
+	if err != nil {
+		topic = "random"
+	}
 
 	// Format their message.
+	raw := rs.lowerMessage(message)
 	message = rs.formatMessage(message, false)
-	var reply string
+	var (
+		reply string
+		match *ReplyInfo // The trigger the message matched, if it got that far
+	)
 
 	// If the BEGIN block exists, consult it first.
 	if _, ok := rs.topics["__begin__"]; ok {
 		var begin string
-		begin, err = rs.getReply(username, "request", true, 0)
+		begin, _, err = rs.getReply(buf, "request", "request", true, 0)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 
 		// OK to continue?
 		if strings.Index(begin, "{ok}") > -1 {
-			reply, err = rs.getReply(username, message, false, 0)
+			reply, match, err = rs.getReply(buf, message, raw, false, 0)
 			if err != nil {
-				return "", err
+				return nil, err
 			}
 			begin = strings.NewReplacer("{ok}", reply).Replace(begin)
 		}
 
 		reply = begin
-		reply = rs.processTags(username, message, reply, []string{}, []string{}, 0)
+		reply = rs.processTags(buf, message, reply, []string{}, []string{}, nil, 0)
 	} else {
-		reply, err = rs.getReply(username, message, false, 0)
+		reply, match, err = rs.getReply(buf, message, raw, false, 0)
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 	}
 
 	// Save their message history.
-	rs.sessions.AddHistory(username, message, reply)
-
-	// Unset the current user's ID.
-	rs.currentUser = ""
-	rs.inReplyContext = false
-
-	return reply, nil
+	trigger, _ := buf.lastMatch()
+	buf.addHistory(sessions.HistoryEntry{
+		Input:   message,
+		Reply:   reply,
+		Trigger: trigger,
+		Topic:   topic,
+		Time:    rs.clock(),
+	})
+
+	info := &ReplyInfo{Stars: []string{}, NamedStars: map[string]string{}}
+	if match != nil {
+		info = match
+	}
+	info.Reply = reply
+	return info, nil
 }
 
 /*
@@ -71,37 +175,42 @@ getReply is the internal logic behind Reply().
 
 Parameters
 
-	username: The name of the user requesting a reply.
+	buf: The session buffer of the user requesting a reply.
 	message: The user's message.
+	raw: The user's message before it was stripped, for raw regexp triggers.
 	isBegin: Whether this reply is for the "BEGIN Block" context or not.
 	step: Recursion depth counter.
+
+Along with the reply, it returns the trigger that matched the message and its
+stars, without the reply.
 */
-func (rs *RiveScript) getReply(username string, message string, isBegin bool, step uint) (string, error) {
+func (rs *RiveScript) getReply(buf *sessionBuffer, message, raw string, isBegin bool, step uint) (string, *ReplyInfo, error) {
 	// Needed to sort replies?
 	if len(rs.sorted.topics) == 0 {
 		rs.warn("You forgot to call SortReplies()!")
-		return "", ErrRepliesNotSorted
+		return "", nil, ErrRepliesNotSorted
 	}
 
 	// Collect data on this user.
-	topic, err := rs.sessions.Get(username, "topic")
+	topic, err := buf.get("topic")
 	if err != nil {
 		topic = "random"
 	}
 	stars := []string{}
-	thatStars := []string{} // For %Previous
+	thatStars := []string{}           // For %Previous
+	namedStars := map[string]string{} // For <star name>
 	var reply string
 
 	// Avoid letting them fall into a missing topic.
 	if _, ok := rs.topics[topic]; !ok {
-		rs.warn("User %s was in an empty topic named '%s'", username, topic)
-		rs.sessions.Set(username, map[string]string{"topic": "random"})
+		rs.warn("User %s was in an empty topic named '%s'", buf.username, topic)
+		buf.set(map[string]string{"topic": "random"})
 		topic = "random"
 	}
 
 	// Avoid deep recursion.
 	if step > rs.Depth {
-		return "", ErrDeepRecursion
+		return "", nil, ErrDeepRecursion
 	}
 
 	// Are we in the BEGIN block?
@@ -113,7 +222,7 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 	if _, ok := rs.topics[topic]; !ok {
 		// This was handled before, which would mean topic=random and it doesn't
 		// exist. Serious issue!
-		return "", ErrNoDefaultTopic
+		return "", nil, ErrNoDefaultTopic
 	}
 
 	// Create a pointer for the matched data when we find it.
@@ -140,8 +249,8 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 				rs.say("There's a %%Previous in this topic!")
 
 				// Get the bot's last reply to the user.
-				history, _ := rs.sessions.GetHistory(username)
-				lastReply := history.Reply[0]
+				history, _ := buf.history()
+				lastReply := history.Reply(1)
 
 				// Format the bot's reply the same way as the human's.
 				lastReply = rs.formatMessage(lastReply, true)
@@ -150,7 +259,7 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 				// See if it's a match.
 				for _, trig := range rs.sorted.thats[top] {
 					pattern := trig.pointer.previous
-					botside := rs.triggerRegexp(username, pattern)
+					botside := rs.triggerRegexp(buf, pattern)
 					rs.say("Try to match lastReply (%s) to %s (%s)", lastReply, pattern, botside)
 
 					// Match?
@@ -170,29 +279,8 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 
 						// Compare the triggers to the user's message.
 						userSide := trig.pointer
-						regexp := rs.triggerRegexp(username, userSide.trigger)
-						rs.say("Try to match %s against %s (%s)", message, userSide.trigger, regexp)
-
-						// If the trigger is atomic, we don't need to deal with the regexp engine.
-						isMatch := false
-						if isAtomic(userSide.trigger) {
-							if message == regexp {
-								isMatch = true
-							}
-						} else {
-							matcher := re.MustCompile(fmt.Sprintf("^%s$", regexp))
-							match := matcher.FindStringSubmatch(message)
-							if len(match) > 0 {
-								isMatch = true
-
-								// Get the user's message stars.
-								if len(match) > 1 {
-									for i := range match[1:] {
-										stars = append(stars, match[i+1])
-									}
-								}
-							}
-						}
+						var isMatch bool
+						isMatch, stars, namedStars = rs.matchTrigger(buf, message, raw, userSide, userSide.trigger)
 
 						// Was it a match?
 						if isMatch {
@@ -213,29 +301,8 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 		rs.say("Searching their topic for a match...")
 		for _, trig := range rs.sorted.topics[topic] {
 			pattern := trig.trigger
-			regexp := rs.triggerRegexp(username, pattern)
-			rs.say("Try to match \"%s\" against %s (%s)", message, pattern, regexp)
-
-			// If the trigger is atomic, we don't need to bother with the regexp engine.
-			isMatch := false
-			if isAtomic(pattern) && message == regexp {
-				isMatch = true
-			} else {
-				// Non-atomic triggers always need the regexp.
-				matcher := re.MustCompile(fmt.Sprintf("^%s$", regexp))
-				match := matcher.FindStringSubmatch(message)
-				if len(match) > 0 {
-					// The regexp matched!
-					isMatch = true
-
-					// Collect the stars.
-					if len(match) > 1 {
-						for i := range match[1:] {
-							stars = append(stars, match[i+1])
-						}
-					}
-				}
-			}
+			var isMatch bool
+			isMatch, stars, namedStars = rs.matchTrigger(buf, message, raw, trig.pointer, pattern)
 
 			// A match somehow?
 			if isMatch {
@@ -251,7 +318,15 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 	}
 
 	// Store what trigger they matched on.
-	rs.sessions.SetLastMatch(username, matchedTrigger)
+	buf.setLastMatch(matchedTrigger)
+	var info *ReplyInfo
+	if foundMatch {
+		info = &ReplyInfo{
+			Trigger:    matchedTrigger,
+			Stars:      stars,
+			NamedStars: namedStars,
+		}
+	}
 
 	// Did we match?
 	if foundMatch {
@@ -260,75 +335,24 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 			if len(matched.redirect) > 0 {
 				rs.say("Redirecting us to %s", matched.redirect)
 				redirect := matched.redirect
-				redirect = rs.processTags(username, message, redirect, stars, thatStars, 0)
+				redirect = rs.processTags(buf, message, redirect, stars, thatStars, namedStars, 0)
 				redirect = strings.ToLower(redirect)
 				rs.say("Pretend user said: %s", redirect)
-				reply, err = rs.getReply(username, redirect, isBegin, step+1)
+				reply, _, err = rs.getReply(buf, redirect, redirect, isBegin, step+1)
 				if err != nil {
-					return "", err
+					return "", nil, err
 				}
 				break
 			}
 
 			// Check the conditionals.
-			for _, row := range matched.condition {
-				halves := strings.Split(row, "=>")
-				if len(halves) == 2 {
-					condition := reCondition.FindStringSubmatch(strings.TrimSpace(halves[0]))
-					if len(condition) > 0 {
-						left := strings.TrimSpace(condition[1])
-						eq := condition[2]
-						right := strings.TrimSpace(condition[3])
-						potreply := strings.TrimSpace(halves[1]) // Potential reply
-
-						// Process tags all around
-						left = rs.processTags(username, message, left, stars, thatStars, step)
-						right = rs.processTags(username, message, right, stars, thatStars, step)
-
-						// Defaults?
-						if len(left) == 0 {
-							left = UNDEFINED
-						}
-						if len(right) == 0 {
-							right = UNDEFINED
-						}
-
-						rs.say("Check if %s %s %s", left, eq, right)
-
-						// Validate it.
-						passed := false
-						if eq == "eq" || eq == "==" {
-							if left == right {
-								passed = true
-							}
-						} else if eq == "ne" || eq == "!=" || eq == "<>" {
-							if left != right {
-								passed = true
-							}
-						} else {
-							// Dealing with numbers here.
-							iLeft, errLeft := strconv.Atoi(left)
-							iRight, errRight := strconv.Atoi(right)
-							if errLeft == nil && errRight == nil {
-								if eq == "<" && iLeft < iRight {
-									passed = true
-								} else if eq == "<=" && iLeft <= iRight {
-									passed = true
-								} else if eq == ">" && iLeft > iRight {
-									passed = true
-								} else if eq == ">=" && iLeft >= iRight {
-									passed = true
-								}
-							} else {
-								rs.warn("Failed to evaluate numeric condition!")
-							}
-						}
-
-						if passed {
-							reply = potreply
-							break
-						}
-					}
+			resolve := func(text string) string {
+				return rs.processTags(buf, message, text, stars, thatStars, namedStars, step)
+			}
+			for _, cond := range matched.conditions {
+				if cond.expr.eval(rs, resolve) {
+					reply = cond.reply
+					break
 				}
 			}
 
@@ -366,9 +390,9 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 
 	// Still no reply?? Give up with the fallback error replies.
 	if !foundMatch {
-		return "", ErrNoTriggerMatched
+		return "", nil, ErrNoTriggerMatched
 	} else if len(reply) == 0 {
-		return "", ErrNoReplyFound
+		return "", nil, ErrNoReplyFound
 	}
 
 	rs.say("Reply: %s", reply)
@@ -387,7 +411,7 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 				break
 			}
 			name := match[1]
-			rs.sessions.Set(username, map[string]string{"topic": name})
+			buf.set(map[string]string{"topic": name})
 			reply = strings.Replace(reply, fmt.Sprintf("{topic=%s}", name), "", -1)
 			match = reTopic.FindStringSubmatch(reply)
 		}
@@ -403,13 +427,13 @@ func (rs *RiveScript) getReply(username string, message string, isBegin bool, st
 			}
 			name := match[1]
 			value := match[2]
-			rs.sessions.Set(username, map[string]string{name: value})
+			buf.set(map[string]string{name: value})
 			reply = strings.Replace(reply, fmt.Sprintf("<set %s=%s>", name, value), "", -1)
 			match = reSet.FindStringSubmatch(reply)
 		}
 	} else {
-		reply = rs.processTags(username, message, reply, stars, thatStars, 0)
+		reply = rs.processTags(buf, message, reply, stars, thatStars, namedStars, 0)
 	}
 
-	return reply, nil
+	return reply, info, nil
 }
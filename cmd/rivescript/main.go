@@ -7,12 +7,20 @@ a way to quickly demo and test a RiveScript bot.
 Usage
 
 	rivescript [options] /path/to/rive/files
+	rivescript sessions <export|import> [options]
 
 Options
 
 	--debug     Enable debug mode.
 	--utf8      Enable UTF-8 support within RiveScript.
 	--depth     Override the recursion depth limit (default 50)
+
+The `sessions` command exports and imports user variables in a portable JSON
+Lines format, e.g. to move them between Redis servers or to load them into
+your own program with `sessions.Import()`:
+
+	rivescript sessions export -redis localhost:6379 -file users.jsonl
+	rivescript sessions import -redis otherhost:6379 -file users.jsonl
 */
 package main
 
@@ -24,7 +32,9 @@ import (
 	"strings"
 
 	"github.com/aichaos/rivescript-go"
+	"github.com/aichaos/rivescript-go/lang/gotemplate"
 	"github.com/aichaos/rivescript-go/lang/javascript"
+	"github.com/aichaos/rivescript-go/lang/lua"
 )
 
 // Build is the git commit hash that the binary was built from.
@@ -61,9 +71,14 @@ func main() {
 
 	if len(args) == 0 {
 		fmt.Fprintln(os.Stderr, "Usage: rivescript [options] </path/to/documents>")
+		fmt.Fprintln(os.Stderr, "       rivescript sessions <export|import> [options]")
 		os.Exit(1)
 	}
 
+	if args[0] == "sessions" {
+		os.Exit(sessionsCommand(args[1:]))
+	}
+
 	root := args[0]
 
 	// Initialize the bot.
@@ -74,8 +89,10 @@ func main() {
 		UTF8:   utf8,
 	})
 
-	// JavaScript object macro handler.
-	bot.SetHandler("javascript", javascript.New(bot))
+	// Object macro handlers.
+	bot.SetHandlerV2("javascript", javascript.New(bot))
+	bot.SetHandlerV2("lua", lua.New(bot))
+	bot.SetHandlerV2("gotemplate", gotemplate.New(bot))
 
 	// Load the target directory.
 	err := bot.LoadDirectory(root)
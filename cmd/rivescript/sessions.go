@@ -0,0 +1,95 @@
+package main
+
+// The `rivescript sessions` subcommand for moving user data between stores.
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/aichaos/rivescript-go/sessions"
+	"github.com/aichaos/rivescript-go/sessions/redis"
+	goRedis "gopkg.in/redis.v5"
+)
+
+// sessionsCommand handles `rivescript sessions <export|import> [options]`
+// and returns the exit code for the program.
+func sessionsCommand(args []string) int {
+	flags := flag.NewFlagSet("sessions", flag.ExitOnError)
+	var (
+		redisAddr string
+		redisDB   int
+		prefix    string
+		filename  string
+	)
+	flags.StringVar(&redisAddr, "redis", "", "Redis server address, e.g. localhost:6379")
+	flags.IntVar(&redisDB, "db", 0, "Redis database number")
+	flags.StringVar(&prefix, "prefix", "rivescript/", "Redis key prefix for user data")
+	flags.StringVar(&filename, "file", "-", "File to export to or import from (- for stdout/stdin)")
+	flags.Usage = func() {
+		fmt.Fprintln(os.Stderr, "Usage: rivescript sessions <export|import> -redis <address> [options]")
+		flags.PrintDefaults()
+	}
+
+	if len(args) == 0 {
+		flags.Usage()
+		return 1
+	}
+	command := args[0]
+	flags.Parse(args[1:])
+
+	if redisAddr == "" {
+		fmt.Fprintln(os.Stderr, "A session store is required, e.g. -redis localhost:6379")
+		return 1
+	}
+	store := redis.New(&redis.Config{
+		Prefix: prefix,
+		Redis: &goRedis.Options{
+			Addr: redisAddr,
+			DB:   redisDB,
+		},
+	})
+
+	switch command {
+	case "export":
+		var w io.Writer = os.Stdout
+		if filename != "-" {
+			fh, err := os.Create(filename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Can't write to %s: %s\n", filename, err)
+				return 1
+			}
+			defer fh.Close()
+			w = fh
+		}
+
+		if err := sessions.Export(w, store); err != nil {
+			fmt.Fprintf(os.Stderr, "Export failed: %s\n", err)
+			return 1
+		}
+	case "import":
+		var r io.Reader = os.Stdin
+		if filename != "-" {
+			fh, err := os.Open(filename)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Can't read from %s: %s\n", filename, err)
+				return 1
+			}
+			defer fh.Close()
+			r = fh
+		}
+
+		count, err := sessions.Import(r, store)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Import failed after %d users: %s\n", count, err)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Imported %d users.\n", count)
+	default:
+		flags.Usage()
+		return 1
+	}
+
+	return 0
+}
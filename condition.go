@@ -0,0 +1,508 @@
+package rivescript
+
+// Parsing and evaluating *Condition lines.
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+/*
+condition is a parsed `*Condition` line, like this one (without the `*`):
+
+	<get age> >= 18 and (<get country> == us or not <get parent> == true) => ...
+
+Comparisons are combined with `and`, `or` and `not`, in that order of
+precedence from loosest to tightest, and grouped with parentheses. A value in
+double quotes is taken literally, so it can have those words in it. Values
+are read as they're written, spaces and all, and the pattern after `matches`
+is the rest of the condition unless it's in quotes.
+
+A line that isn't a valid expression but is a single comparison in the old
+style, like `<get answer> == not sure`, is read the old way, with everything
+after the operator as the value.
+*/
+type condition struct {
+	expr  condExpr
+	reply string
+}
+
+// condExpr is a node of a condition's expression.
+type condExpr interface {
+	// eval tells whether the expression is true. The resolve function
+	// processes the tags in a side of a comparison.
+	eval(rs *RiveScript, resolve func(string) string) bool
+}
+
+type condAnd struct{ left, right condExpr }
+type condOr struct{ left, right condExpr }
+type condNot struct{ expr condExpr }
+
+// condCompare compares two values, e.g. `<get age> >= 18`.
+type condCompare struct {
+	left          string
+	op            string
+	right         string
+	caseSensitive bool           // For the string operators
+	pattern       *regexp.Regexp // For `matches`, if the pattern has no tags
+}
+
+func (c condAnd) eval(rs *RiveScript, resolve func(string) string) bool {
+	return c.left.eval(rs, resolve) && c.right.eval(rs, resolve)
+}
+
+func (c condOr) eval(rs *RiveScript, resolve func(string) string) bool {
+	return c.left.eval(rs, resolve) || c.right.eval(rs, resolve)
+}
+
+func (c condNot) eval(rs *RiveScript, resolve func(string) string) bool {
+	return !c.expr.eval(rs, resolve)
+}
+
+func (c condCompare) eval(rs *RiveScript, resolve func(string) string) bool {
+	// Process tags all around
+	left := resolve(c.left)
+	right := resolve(c.right)
+
+	// Defaults?
+	if len(left) == 0 {
+		left = UNDEFINED
+	}
+	if len(right) == 0 {
+		right = UNDEFINED
+	}
+
+	rs.say("Check if %s %s %s", left, c.op, right)
+
+	switch c.op {
+	case "eq", "==":
+		return left == right
+	case "ne", "!=", "<>":
+		return left != right
+	case "contains":
+		return strings.Contains(c.fold(left), c.fold(right))
+	case "startswith":
+		return strings.HasPrefix(c.fold(left), c.fold(right))
+	case "endswith":
+		return strings.HasSuffix(c.fold(left), c.fold(right))
+	case "matches":
+		pattern := c.pattern
+		if pattern == nil {
+			var err error
+			pattern, err = compileMatches(right, c.caseSensitive)
+			if err != nil {
+				rs.warn("Invalid regular expression in condition: %s", err)
+				return false
+			}
+		}
+		return pattern.MatchString(left)
+	case "in":
+		for _, item := range rs.array[strings.TrimPrefix(c.right, "@")] {
+			if c.fold(item) == c.fold(left) {
+				return true
+			}
+		}
+		return false
+	}
+
+	// Dealing with numbers here.
+	nLeft, okLeft := parseNumber(left)
+	nRight, okRight := parseNumber(right)
+	if !okLeft || !okRight {
+		rs.warn("Failed to evaluate numeric condition!")
+		return false
+	}
+
+	cmp := nLeft.Cmp(nRight)
+	switch c.op {
+	case "<":
+		return cmp < 0
+	case "<=":
+		return cmp <= 0
+	case ">":
+		return cmp > 0
+	case ">=":
+		return cmp >= 0
+	}
+	return false
+}
+
+// fold lowercases a value for the string operators, unless they're case
+// sensitive.
+func (c condCompare) fold(value string) string {
+	if c.caseSensitive {
+		return value
+	}
+	return strings.ToLower(value)
+}
+
+// compileMatches compiles the pattern for the `matches` operator.
+func compileMatches(pattern string, caseSensitive bool) (*regexp.Regexp, error) {
+	if !caseSensitive {
+		pattern = "(?i)" + pattern
+	}
+	return regexp.Compile(pattern)
+}
+
+// condOperators are the comparison operators.
+var condOperators = map[string]bool{
+	"==": true, "eq": true,
+	"!=": true, "ne": true, "<>": true,
+	"<": true, "<=": true, ">": true, ">=": true,
+	"contains": true, "startswith": true, "endswith": true,
+	"matches": true, "in": true,
+}
+
+// reArrayName matches the right side of the `in` operator.
+var reArrayName = regexp.MustCompile(`^@[A-Za-z0-9_]+$`)
+
+/*
+parseCondition parses a `*Condition` line (without the `*`).
+
+The string operators (`contains`, `startswith`, `endswith`, `matches` and
+`in`) ignore case unless caseSensitive is true.
+*/
+func parseCondition(line string, caseSensitive bool) (*condition, error) {
+	halves := strings.Split(line, "=>")
+	if len(halves) != 2 {
+		return nil, errors.New("expected one => between the condition and the reply")
+	}
+
+	p := &condParser{
+		text:          []rune(halves[0]),
+		tokens:        tokenizeCondition(halves[0]),
+		caseSensitive: caseSensitive,
+	}
+	if len(p.tokens) == 0 {
+		return nil, errors.New("the condition is empty")
+	}
+
+	expr, err := p.parseExpr()
+	if err != nil {
+		// Brains written before compound conditions may have the keywords
+		// in their values.
+		var ok bool
+		if expr, ok = parseSimpleCondition(halves[0], caseSensitive); !ok {
+			return nil, err
+		}
+	}
+
+	return &condition{
+		expr:  expr,
+		reply: strings.TrimSpace(halves[1]),
+	}, nil
+}
+
+/*
+parseSimpleCondition reads a condition as one comparison, the way conditions
+were read before they could be combined: everything before the first operator
+is the left side, and everything after it is the right side.
+
+It's only used for conditions that don't make sense as an expression, and only
+if they look like one comparison: the left side can't have any of the keywords
+and the right side can't have another operator.
+*/
+func parseSimpleCondition(text string, caseSensitive bool) (condExpr, bool) {
+	match := reCondition.FindStringSubmatch(strings.TrimSpace(text))
+	if len(match) == 0 {
+		return nil, false
+	}
+	for _, token := range tokenizeCondition(match[1]) {
+		if token.isKeyword() {
+			return nil, false
+		}
+	}
+	for _, token := range tokenizeCondition(match[3]) {
+		if !token.quoted && condOperators[token.text] && !isWordOperator(token.text) {
+			return nil, false
+		}
+	}
+
+	return condCompare{
+		left:          strings.TrimSpace(match[1]),
+		op:            match[2],
+		right:         strings.TrimSpace(match[3]),
+		caseSensitive: caseSensitive,
+	}, true
+}
+
+// isWordOperator tells whether a word is an operator spelled with letters,
+// like `in`, rather than symbols, like `==`.
+func isWordOperator(word string) bool {
+	return condOperators[word] && word[0] >= 'a' && word[0] <= 'z'
+}
+
+// condToken is a word of a condition.
+type condToken struct {
+	text       string
+	quoted     bool // It was in double quotes, which aren't part of the text
+	start, end int  // Where it is in the condition, in runes
+}
+
+// isKeyword tells whether the word has a meaning of its own in a condition,
+// and can't be part of a value.
+func (t condToken) isKeyword() bool {
+	if t.quoted {
+		return false
+	}
+	word := t.text
+	return word == "and" || word == "or" || word == "not" || word == "(" ||
+		word == ")" || condOperators[word]
+}
+
+/*
+tokenizeCondition splits a condition into words.
+
+Tags are kept together even if they have spaces in them, so `<get first
+name>` is one word, and so is a value in double quotes. Parentheses are words
+of their own, unless they're part of an `(@array)`.
+*/
+func tokenizeCondition(text string) []condToken {
+	var (
+		tokens []condToken
+		runes  = []rune(text)
+		start  = -1 // Where the current word began, if there is one
+	)
+	finish := func(end int) {
+		if start >= 0 {
+			tokens = append(tokens, condToken{
+				text:  string(runes[start:end]),
+				start: start,
+				end:   end,
+			})
+			start = -1
+		}
+	}
+
+	for i := 0; i < len(runes); i++ {
+		char := runes[i]
+		switch {
+		case char == ' ' || char == '\t':
+			finish(i)
+		case char == '(' && i+1 < len(runes) && runes[i+1] == '@':
+			// An array; keep it whole.
+			if start < 0 {
+				start = i
+			}
+			for i < len(runes)-1 && runes[i] != ')' {
+				i++
+			}
+		case char == '(' || char == ')':
+			finish(i)
+			tokens = append(tokens, condToken{text: string(char), start: i, end: i + 1})
+		case char == '"' && start < 0 && strings.ContainsRune(string(runes[i+1:]), '"'):
+			// A literal value, up to the closing quote.
+			end := i + 1
+			for runes[end] != '"' {
+				end++
+			}
+			tokens = append(tokens, condToken{
+				text:   string(runes[i+1 : end]),
+				quoted: true,
+				start:  i,
+				end:    end + 1,
+			})
+			i = end
+		case char == '<' && start < 0 && !isOperatorAt(runes, i):
+			// A tag, which may have spaces and other tags in it.
+			start = i
+			depth := 0
+			for ; i < len(runes)-1; i++ {
+				if runes[i] == '<' {
+					depth++
+				} else if runes[i] == '>' {
+					depth--
+					if depth == 0 {
+						break
+					}
+				}
+			}
+		default:
+			if start < 0 {
+				start = i
+			}
+		}
+	}
+	finish(len(runes))
+
+	return tokens
+}
+
+// isOperatorAt tells whether the word starting at runes[i] is a comparison
+// operator, like `<=`.
+func isOperatorAt(runes []rune, i int) bool {
+	end := i
+	for end < len(runes) && runes[end] != ' ' && runes[end] != '\t' {
+		end++
+	}
+	return condOperators[string(runes[i:end])]
+}
+
+// condParser is a recursive descent parser for condition expressions.
+type condParser struct {
+	text          []rune // The condition, for reading values as they're written
+	tokens        []condToken
+	pos           int
+	caseSensitive bool
+}
+
+// parseExpr parses the whole condition.
+func (p *condParser) parseExpr() (condExpr, error) {
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	return expr, nil
+}
+
+// peek returns the next keyword, or "" at the end or if the next word is
+// part of a value.
+func (p *condParser) peek() string {
+	if p.pos < len(p.tokens) && p.tokens[p.pos].isKeyword() {
+		return p.tokens[p.pos].text
+	}
+	return ""
+}
+
+func (p *condParser) parseOr() (condExpr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "or" {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = condOr{left, right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseAnd() (condExpr, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek() == "and" {
+		p.pos++
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = condAnd{left, right}
+	}
+	return left, nil
+}
+
+func (p *condParser) parseNot() (condExpr, error) {
+	if p.peek() == "not" {
+		p.pos++
+		expr, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return condNot{expr}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *condParser) parsePrimary() (condExpr, error) {
+	if p.peek() == "(" {
+		p.pos++
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ")" {
+			return nil, errors.New("missing a closing parenthesis")
+		}
+		p.pos++
+		return expr, nil
+	}
+
+	// A comparison.
+	left, ok := p.parseValue(false)
+	if !ok {
+		if next := p.peek(); next != "" {
+			return nil, fmt.Errorf("expected a value before %q", next)
+		}
+		return nil, errors.New("expected a comparison at the end of the condition")
+	}
+
+	op := p.peek()
+	if !condOperators[op] {
+		if op == "" {
+			return nil, fmt.Errorf("expected an operator after %q", left)
+		}
+		return nil, fmt.Errorf("expected an operator after %q, not %q", left, op)
+	}
+	p.pos++
+
+	var right string
+	if op == "matches" && p.pos < len(p.tokens) && !p.tokens[p.pos].quoted {
+		// A regular expression can have anything in it, so the pattern is
+		// the rest of the condition, unless it's in quotes.
+		right = strings.TrimSpace(string(p.text[p.tokens[p.pos].start:]))
+		p.pos = len(p.tokens)
+	} else if right, ok = p.parseValue(true); !ok {
+		return nil, fmt.Errorf("expected a value after %q", op)
+	}
+
+	compare := condCompare{
+		left:          left,
+		op:            op,
+		right:         right,
+		caseSensitive: p.caseSensitive,
+	}
+
+	switch op {
+	case "in":
+		if !reArrayName.MatchString(right) {
+			return nil, fmt.Errorf("expected an @array after \"in\", not %q", right)
+		}
+	case "matches":
+		// Check the pattern now, unless it's made from tags.
+		if !strings.Contains(right, "<") {
+			pattern, err := compileMatches(right, p.caseSensitive)
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression: %s", err)
+			}
+			compare.pattern = pattern
+		}
+	}
+
+	return compare, nil
+}
+
+/*
+parseValue reads one side of a comparison, as it's written in the condition.
+It returns false if the side is missing.
+
+The operators that are words, like `in`, only end the left side, where an
+operator is expected. On the right side, they're part of the value.
+*/
+func (p *condParser) parseValue(right bool) (string, bool) {
+	first := p.pos
+	for p.pos < len(p.tokens) {
+		token := p.tokens[p.pos]
+		if token.isKeyword() && !(right && isWordOperator(token.text)) {
+			break
+		}
+		p.pos++
+	}
+
+	switch {
+	case p.pos == first:
+		return "", false
+	case p.pos == first+1 && p.tokens[first].quoted:
+		return p.tokens[first].text, true
+	}
+	return string(p.text[p.tokens[first].start:p.tokens[p.pos-1].end]), true
+}
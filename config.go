@@ -1,10 +1,13 @@
 package rivescript
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"log"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aichaos/rivescript-go/macro"
 	"github.com/aichaos/rivescript-go/sessions"
@@ -40,6 +43,56 @@ type Config struct {
 	// RiveScript. Default 50.
 	Depth uint
 
+	// HistorySize is the number of recent messages remembered for each user,
+	// which is how far back the `<input>` and `<reply>` tags can see.
+	// Default 9.
+	HistorySize int
+
+	// LockUsers makes replies for the same user run one at a time, so that
+	// each reply sees and saves a consistent view of the user's variables.
+	// Default false.
+	//
+	// If the SessionManager implements sessions.Locker (like the Redis store
+	// does) its lock is used, so replies are kept in order across every
+	// program sharing the store. Otherwise the lock only works within this
+	// program. Object macros must not call Reply() for the same user they're
+	// replying to while this is on, or they'll wait on themselves forever.
+	LockUsers bool
+
+	// ObjectError is the text that replaces a `<call>` tag when the object
+	// macro fails while running. Default "[ERR: Error when executing object]"
+	ObjectError string
+
+	// CaseSensitiveConditions makes the string operators in conditions, like
+	// `contains` and `matches`, tell upper and lowercase letters apart.
+	// Default false.
+	CaseSensitiveConditions bool
+
+	// MathDecimal lets math tags like `<add>` and `<div>` work with decimal
+	// numbers. Default false, where they only take whole numbers and use
+	// integer math, so `<div n=2>` with `n` at 11 gives 5, and `<add n=1.5>`
+	// is an error.
+	MathDecimal bool
+
+	// MathPrecision is how many decimal places the results of math tags are
+	// rounded to when MathDecimal is on. Default (nil) is 10; point it at 0
+	// for whole numbers.
+	MathPrecision *int
+
+	// MathRounding is how the results of math tags are rounded when
+	// MathDecimal is on. Default RoundHalfUp.
+	MathRounding Rounding
+
+	// Clock returns the current time for the date and time tags, like
+	// `<date>`, the timestamps in the users' history, and object macros
+	// that ask the bot for the time. Default time.Now; set it to return a
+	// fixed time in tests.
+	Clock func() time.Time
+
+	// Logger is where debug messages and warnings are written. The default
+	// is to print them to standard output.
+	Logger *log.Logger
+
 	// Random number seed, if you'd like to customize it. The default is for
 	// RiveScript to choose its own seed, `time.Now().UnixNano()`
 	Seed int64
@@ -59,12 +112,29 @@ func WithUTF8() *Config {
 /*
 SetHandler sets a custom language handler for RiveScript object macros.
 
+Handlers that implement macro.MacroInterfaceV2, like the JavaScript, Lua and
+Go template handlers, are set with SetHandlerV2 instead, so their errors are
+reported.
+
 Parameters
 
 	lang: What your programming language is called, e.g. "javascript"
 	handler: An implementation of macro.MacroInterface.
 */
 func (rs *RiveScript) SetHandler(lang string, handler macro.MacroInterface) {
+	rs.SetHandlerV2(lang, macro.Upgrade(handler))
+}
+
+/*
+SetHandlerV2 sets a custom language handler for RiveScript object macros,
+which reports errors from loading and calling its objects.
+
+Parameters
+
+	lang: What your programming language is called, e.g. "javascript"
+	handler: An implementation of macro.MacroInterfaceV2.
+*/
+func (rs *RiveScript) SetHandlerV2(lang string, handler macro.MacroInterfaceV2) {
 	rs.cLock.Lock()
 	defer rs.cLock.Unlock()
 
@@ -103,12 +173,16 @@ Parameters
 
 	name: The name of your subroutine for the `<call>` tag in RiveScript.
 	fn: A function with a prototype `func(*RiveScript, []string) string`
+
+The function gets the arguments of the `<call>` tag split on each space. Use
+SetSubroutineV2 for quoted and named arguments, the user's stars and topic,
+and to return errors.
 */
 func (rs *RiveScript) SetSubroutine(name string, fn Subroutine) {
 	rs.cLock.Lock()
 	defer rs.cLock.Unlock()
 
-	rs.subroutines[name] = fn
+	rs.subroutines[name] = upgradeSubroutine(fn)
 }
 
 /*
@@ -215,9 +289,25 @@ SetUservar sets a variable for a user.
 
 This is equivalent to `<set>` in RiveScript. Set the value to `undefined`
 to delete a substitution.
+
+If the user is in a reply, the variable is set for that reply and saved along
+with its changes; see `SetUservarContext()`.
 */
 func (rs *RiveScript) SetUservar(username, name, value string) {
-	rs.sessions.Set(username, map[string]string{
+	rs.SetUservarContext(context.Background(), username, name, value)
+}
+
+/*
+SetUservarContext sets a variable for a user, like SetUservar.
+
+An object macro, tag or extractor should pass the context of the reply it was
+called for (e.g. `CallContext.Context()`), so that the change is part of that
+reply. Without it, the change can only be put in the user's reply if they're
+in exactly one; if they're in several at once, it goes straight to the session
+manager.
+*/
+func (rs *RiveScript) SetUservarContext(ctx context.Context, username, name, value string) {
+	rs.SetUservarsContext(ctx, username, map[string]string{
 		name: value,
 	})
 }
@@ -229,7 +319,13 @@ Set multiple user variables by providing a map[string]string of key/value pairs.
 Equivalent to calling `SetUservar()` for each pair in the map.
 */
 func (rs *RiveScript) SetUservars(username string, data map[string]string) {
-	rs.sessions.Set(username, data)
+	rs.SetUservarsContext(context.Background(), username, data)
+}
+
+// SetUservarsContext sets a map of variables for a user, with the context of
+// a reply like SetUservarContext.
+func (rs *RiveScript) SetUservarsContext(ctx context.Context, username string, data map[string]string) {
+	rs.session(ctx, username).set(data)
 }
 
 /*
@@ -271,6 +367,30 @@ func (rs *RiveScript) GetVariable(name string) (string, error) {
 	return UNDEFINED, fmt.Errorf("bot variable %s not found", name)
 }
 
+// GetGlobals returns a copy of all the global variables.
+func (rs *RiveScript) GetGlobals() map[string]string {
+	rs.cLock.Lock()
+	defer rs.cLock.Unlock()
+
+	globals := map[string]string{}
+	for name, value := range rs.global {
+		globals[name] = value
+	}
+	return globals
+}
+
+// GetVariables returns a copy of all the bot variables.
+func (rs *RiveScript) GetVariables() map[string]string {
+	rs.cLock.Lock()
+	defer rs.cLock.Unlock()
+
+	vars := map[string]string{}
+	for name, value := range rs.vars {
+		vars[name] = value
+	}
+	return vars
+}
+
 /*
 GetUservar gets a user variable.
 
@@ -278,7 +398,17 @@ This is equivalent to `<get name>` in RiveScript. Returns `undefined` if the
 variable isn't defined.
 */
 func (rs *RiveScript) GetUservar(username, name string) (string, error) {
-	return rs.sessions.Get(username, name)
+	return rs.GetUservarContext(context.Background(), username, name)
+}
+
+/*
+GetUservarContext gets a user variable, like GetUservar.
+
+Given the context of a reply, like `CallContext.Context()`, it sees the
+changes made so far in that reply; see `SetUservarContext()`.
+*/
+func (rs *RiveScript) GetUservarContext(ctx context.Context, username, name string) (string, error) {
+	return rs.session(ctx, username).get(name)
 }
 
 /*
@@ -287,7 +417,13 @@ GetUservars gets all the variables for a user.
 This returns a `map[string]string` containing all the user's variables.
 */
 func (rs *RiveScript) GetUservars(username string) (*sessions.UserData, error) {
-	return rs.sessions.GetAny(username)
+	return rs.GetUservarsContext(context.Background(), username)
+}
+
+// GetUservarsContext gets all the variables for a user, with the context of a
+// reply like GetUservarContext.
+func (rs *RiveScript) GetUservarsContext(ctx context.Context, username string) (*sessions.UserData, error) {
+	return rs.session(ctx, username).userData()
 }
 
 /*
@@ -302,7 +438,10 @@ func (rs *RiveScript) GetAllUservars() map[string]*sessions.UserData {
 
 // ClearUservars deletes all the variables that belong to a user.
 func (rs *RiveScript) ClearUservars(username string) {
-	rs.sessions.Clear(username)
+	rs.flushSession(rs.session(context.Background(), username), func() error {
+		rs.sessions.Clear(username)
+		return nil
+	})
 }
 
 // ClearAllUservars deletes all variables for all users.
@@ -317,7 +456,9 @@ This will clone and preserve the user's entire variable state, so that it
 can be restored later with `ThawUservars()`.
 */
 func (rs *RiveScript) FreezeUservars(username string) error {
-	return rs.sessions.Freeze(username)
+	return rs.flushSession(rs.session(context.Background(), username), func() error {
+		return rs.sessions.Freeze(username)
+	})
 }
 
 /*
@@ -329,24 +470,57 @@ The `action` can be one of the following:
 * keep: Keep the frozen copy after restoring.
 */
 func (rs *RiveScript) ThawUservars(username string, action sessions.ThawAction) error {
-	return rs.sessions.Thaw(username, action)
+	return rs.flushSession(rs.session(context.Background(), username), func() error {
+		return rs.sessions.Thaw(username, action)
+	})
 }
 
 // LastMatch returns the user's last matched trigger.
 func (rs *RiveScript) LastMatch(username string) (string, error) {
-	return rs.sessions.GetLastMatch(username)
+	return rs.LastMatchContext(context.Background(), username)
+}
+
+// LastMatchContext returns the user's last matched trigger, with the context
+// of a reply like GetUservarContext.
+func (rs *RiveScript) LastMatchContext(ctx context.Context, username string) (string, error) {
+	return rs.session(ctx, username).lastMatch()
+}
+
+/*
+CurrentUserContext returns the ID of the user whose reply is carried by a
+context, like the one given to an object macro handler's `Call()` or from
+`CallContext.Context()`.
+
+Unlike CurrentUser, it's right even when replies for several users are
+running at once.
+*/
+func (rs *RiveScript) CurrentUserContext(ctx context.Context) (string, error) {
+	if buf, ok := ctx.Value(sessionKey{}).(*sessionBuffer); ok {
+		return buf.username, nil
+	}
+	return "", errors.New("CurrentUserContext() needs the context of a reply")
 }
 
 /*
 CurrentUser returns the current user's ID.
 
 This is only useful from within an object macro, to get the ID of the user who
-invoked the macro. This value is set at the beginning of `Reply()` and unset
-at the end, so this function will return empty outside of a reply context.
+invoked the macro. It's the user whose reply is running, so this function will
+return an error outside of a reply context.
+
+When replies for more than one user are running at once there's no telling
+which of them is current, and this function returns an error too. Object
+macros should use CurrentUserContext() instead.
 */
 func (rs *RiveScript) CurrentUser() (string, error) {
-	if rs.inReplyContext {
-		return rs.currentUser, nil
+	rs.bufferLock.Lock()
+	defer rs.bufferLock.Unlock()
+
+	if len(rs.buffers) > 1 {
+		return "", errors.New("CurrentUser() can't tell which of several users' replies is current; use CurrentUserContext()")
+	}
+	for username := range rs.buffers {
+		return username, nil
 	}
 	return "", errors.New("CurrentUser() can only be called inside a reply context")
 }
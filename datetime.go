@@ -0,0 +1,188 @@
+package rivescript
+
+// Date and time tags.
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Default formats for the <date> and <time> tags.
+const (
+	defaultDateFormat = "Monday, January 2, 2006"
+	defaultTimeFormat = "3:04 PM"
+)
+
+// strftimeLayouts are the Go time layouts for the strftime directives.
+var strftimeLayouts = map[byte]string{
+	'a': "Mon",
+	'A': "Monday",
+	'b': "Jan",
+	'B': "January",
+	'd': "02",
+	'e': "_2",
+	'H': "15",
+	'I': "03",
+	'l': "3",
+	'm': "01",
+	'M': "04",
+	'p': "PM",
+	'S': "05",
+	'y': "06",
+	'Y': "2006",
+	'Z': "MST",
+	'z': "-0700",
+}
+
+/*
+now returns the current time for a user, from the bot's clock.
+
+The time is in the user's time zone, from their `timezone` variable (an IANA
+name like "America/New_York"), or the bot's `timezone` variable if they don't
+have one. Otherwise it's in the clock's own time zone.
+*/
+func (rs *RiveScript) now(buf *sessionBuffer) time.Time {
+	now := rs.clock()
+
+	name, err := buf.get("timezone")
+	if err != nil || name == "" || name == UNDEFINED {
+		name = rs.vars["timezone"]
+	}
+	if name == "" {
+		return now
+	}
+
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		rs.warn("Unknown time zone %s: %s", name, err)
+		return now
+	}
+	return now.In(location)
+}
+
+/*
+formatTime formats a time for the <date> and <time> tags.
+
+A format with a `%` in it is a strftime format, like "%Y-%m-%d". Anything else
+is a Go time layout, like "2006-01-02".
+*/
+func formatTime(t time.Time, format string) string {
+	if !strings.Contains(format, "%") {
+		return t.Format(format)
+	}
+
+	var out bytes.Buffer
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' || i+1 == len(format) {
+			out.WriteByte(format[i])
+			continue
+		}
+
+		i++
+		switch directive := format[i]; directive {
+		case '%':
+			out.WriteByte('%')
+		case 'j':
+			out.WriteString(fmt.Sprintf("%03d", t.YearDay()))
+		case 'u':
+			weekday := int(t.Weekday())
+			if weekday == 0 {
+				weekday = 7
+			}
+			out.WriteString(strconv.Itoa(weekday))
+		default:
+			if layout, ok := strftimeLayouts[directive]; ok {
+				out.WriteString(t.Format(layout))
+			} else {
+				// Unknown directives are left as they are.
+				out.WriteByte('%')
+				out.WriteByte(directive)
+			}
+		}
+	}
+	return out.String()
+}
+
+// timeOfDay names the part of the day for a time: morning, afternoon, evening
+// or night.
+func timeOfDay(t time.Time) string {
+	switch hour := t.Hour(); {
+	case hour >= 5 && hour < 12:
+		return "morning"
+	case hour >= 12 && hour < 17:
+		return "afternoon"
+	case hour >= 17 && hour < 21:
+		return "evening"
+	default:
+		return "night"
+	}
+}
+
+/*
+daysBetween counts the days from one time's date to a date like
+"2006-01-02", or "01-02" for a date that happens every year.
+
+A yearly date is taken to be the next one on or after the time if future is
+true, or the last one on or before it if not.
+*/
+func daysBetween(now time.Time, date string, future bool) (int, error) {
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+
+	target, err := time.ParseInLocation("2006-01-02", date, now.Location())
+	if err != nil {
+		yearly, err := time.ParseInLocation("01-02", date, now.Location())
+		if err != nil {
+			return 0, fmt.Errorf("can't parse date %s", date)
+		}
+
+		target = time.Date(today.Year(), yearly.Month(), yearly.Day(), 0, 0, 0, 0, now.Location())
+		if future && target.Before(today) {
+			target = target.AddDate(1, 0, 0)
+		} else if !future && target.After(today) {
+			target = target.AddDate(-1, 0, 0)
+		}
+	}
+
+	// Round to whole days, in case a daylight saving change is in between.
+	diff := target.Sub(today)
+	if diff < 0 {
+		diff -= 12 * time.Hour
+	} else {
+		diff += 12 * time.Hour
+	}
+	return int(diff / (24 * time.Hour)), nil
+}
+
+// tagDateTime handles <date> and <time>, with an optional format.
+func tagDateTime(rs *RiveScript, tag *TagContext) string {
+	format := strings.TrimSpace(tag.Args)
+	if format == "" {
+		if tag.Name == "date" {
+			format = defaultDateFormat
+		} else {
+			format = defaultTimeFormat
+		}
+	}
+	return formatTime(rs.now(tag.buf), format)
+}
+
+// tagTimeOfDay handles <timeofday>.
+func tagTimeOfDay(rs *RiveScript, tag *TagContext) string {
+	return timeOfDay(rs.now(tag.buf))
+}
+
+// tagDaysUntil handles <daysuntil date> and <dayssince date>.
+func tagDaysUntil(rs *RiveScript, tag *TagContext) string {
+	future := tag.Name == "daysuntil"
+	days, err := daysBetween(rs.now(tag.buf), strings.TrimSpace(tag.Args), future)
+	if err != nil {
+		return fmt.Sprintf("[ERR: %s]", err)
+	}
+	if !future {
+		days = -days
+	}
+	return strconv.Itoa(days)
+}
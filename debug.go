@@ -9,17 +9,42 @@ import (
 // say prints a debugging message
 func (rs *RiveScript) say(message string, a ...interface{}) {
 	if rs.Debug {
-		fmt.Printf(message+"\n", a...)
+		rs.log(message, a...)
 	}
 }
 
 // warn prints a warning message for non-fatal errors
 func (rs *RiveScript) warn(message string, a ...interface{}) {
 	if !rs.Quiet {
-		fmt.Printf("[WARN] "+message+"\n", a...)
+		rs.log("[WARN] "+message, a...)
 	}
 }
 
+// log writes a message to the bot's logger, or standard output if it has
+// none.
+func (rs *RiveScript) log(message string, a ...interface{}) {
+	if rs.logger != nil {
+		rs.logger.Printf(message, a...)
+	} else {
+		fmt.Printf(message+"\n", a...)
+	}
+}
+
+/*
+Debugf logs a debug message through the bot, if debug mode is on.
+
+This is for object macro handlers and other extensions of the bot, so that
+their messages go to the same place as RiveScript's own.
+*/
+func (rs *RiveScript) Debugf(message string, a ...interface{}) {
+	rs.say(message, a...)
+}
+
+// Warnf logs a warning through the bot, unless it's in quiet mode.
+func (rs *RiveScript) Warnf(message string, a ...interface{}) {
+	rs.warn(message, a...)
+}
+
 // warnSyntax is like warn but takes a filename and line number.
 func (rs *RiveScript) warnSyntax(message string, filename string, lineno int, a ...interface{}) {
 	message += fmt.Sprintf(" at %s line %d", filename, lineno)
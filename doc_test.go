@@ -69,7 +69,7 @@ func ExampleRiveScript_javascript() {
 	bot := rivescript.New(nil)
 
 	// Create the JS handler.
-	bot.SetHandler("javascript", javascript.New(bot))
+	bot.SetHandlerV2("javascript", javascript.New(bot))
 
 	// Now we can use object macros written in JS!
 	bot.Stream(`
@@ -35,7 +35,7 @@ func main() {
 		Debug: *debug,
 		UTF8:  *utf8,
 	})
-	Bot.SetHandler("javascript", javascript.New(Bot))
+	Bot.SetHandlerV2("javascript", javascript.New(Bot))
 	Bot.LoadDirectory("../brain")
 	Bot.SortReplies()
 
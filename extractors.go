@@ -0,0 +1,407 @@
+package rivescript
+
+// Entity wildcards, like `<date>`, and the extractors behind them.
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+ExtractorFunc is a function prototype for an entity extractor.
+
+It's given the text that matched the extractor's pattern, and returns the
+value to put in the star, like "2006-01-02" for "jan 2 2006". If ok is false,
+the text isn't really one of its entities and the trigger doesn't match.
+*/
+type ExtractorFunc func(rs *RiveScript, ctx *ExtractorContext) (value string, ok bool)
+
+// ExtractorContext describes an entity for an ExtractorFunc.
+type ExtractorContext struct {
+	Name     string // The extractor's name, e.g. "date" for <date>
+	Text     string // The text from the user's message
+	Username string // The user the bot is replying to
+
+	buf *sessionBuffer
+}
+
+// Context returns the context of the reply, for the API calls that take one.
+func (ctx *ExtractorContext) Context() context.Context {
+	return replyContext(ctx.buf)
+}
+
+// extractor is a registered entity extractor.
+type extractor struct {
+	pattern *regexp.Regexp
+	fn      ExtractorFunc
+}
+
+// reExtractorName matches a valid name for an extractor.
+var reExtractorName = regexp.MustCompile(`^[a-z][a-z0-9]*$`)
+
+/*
+RegisterExtractor adds an entity wildcard for use in triggers, or replaces one
+of the same name.
+
+A trigger like `+ remind me on <date>` matches a message if the text in place
+of `<date>` matches the extractor's pattern, and its function accepts it. The
+star is the value the function returns. Like other wildcards, it can be named,
+as in `<date>{when}`.
+
+The pattern is matched against the user's message before its punctuation is
+removed, and the text it matches keeps its punctuation while the triggers that
+use the extractor are tried, so patterns can look for things like e-mail
+addresses. The other triggers see the message stripped as usual. The message
+is in lowercase, and the pattern can't have capturing groups.
+
+Register extractors before calling SortReplies(), which finds the triggers that
+use them.
+
+The built-in extractors are `<number>`, `<date>`, `<email>`, `<url>` and
+`<currency>`, and they can be replaced.
+
+Parameters
+
+	name: The name of the wildcard, e.g. "date" for `<date>`. Letters and
+		numbers only.
+	pattern: A regular expression for the text of the entity.
+	fn: A function with a prototype
+		`func(*RiveScript, *ExtractorContext) (string, bool)`, or nil to use
+		the text as it is.
+*/
+func (rs *RiveScript) RegisterExtractor(name, pattern string, fn ExtractorFunc) error {
+	name = strings.ToLower(name)
+	if !reExtractorName.MatchString(name) {
+		return fmt.Errorf("invalid extractor name %q: it must be letters and numbers, starting with a letter", name)
+	} else if name == "input" || name == "reply" {
+		return fmt.Errorf("can't use the name %s for an extractor: <%s> is already a tag in triggers", name, name)
+	}
+
+	compiled, err := regexp.Compile(pattern)
+	if err != nil {
+		return fmt.Errorf("invalid pattern for extractor %s: %s", name, err)
+	} else if compiled.NumSubexp() > 0 {
+		return fmt.Errorf("the pattern for extractor %s can't have capturing groups; use (?:...) instead", name)
+	}
+
+	rs.cLock.Lock()
+	defer rs.cLock.Unlock()
+
+	rs.extractors[name] = &extractor{
+		pattern: compiled,
+		fn:      fn,
+	}
+	return nil
+}
+
+/*
+DeleteExtractor removes an entity extractor. Its tag is matched literally in
+triggers afterward.
+
+Parameters
+
+	name: The name of the extractor to be deleted.
+*/
+func (rs *RiveScript) DeleteExtractor(name string) {
+	rs.cLock.Lock()
+	defer rs.cLock.Unlock()
+
+	delete(rs.extractors, strings.ToLower(name))
+}
+
+// Patterns for the built-in extractors.
+const (
+	numberPattern   = `(?:\d{1,3}(?:,\d{3})+|\d+)(?:\.\d+)?`
+	monthPattern    = `jan(?:uary)?|feb(?:ruary)?|mar(?:ch)?|apr(?:il)?|may|june?|july?|aug(?:ust)?|sept?(?:ember)?|oct(?:ober)?|nov(?:ember)?|dec(?:ember)?`
+	weekdayPattern  = `monday|tuesday|wednesday|thursday|friday|saturday|sunday`
+	currencyPattern = `dollars?|bucks|usd|euros?|eur|pounds?|gbp|yen|jpy`
+)
+
+// builtinExtractors returns the extractors every bot starts with.
+func builtinExtractors() map[string]*extractor {
+	return map[string]*extractor{
+		"number": {
+			pattern: regexp.MustCompile(`-?` + numberPattern),
+			fn:      extractNumber,
+		},
+		"date": {
+			pattern: regexp.MustCompile(`\d{4}-\d{1,2}-\d{1,2}|\d{1,2}/\d{1,2}/(?:\d{4}|\d{2})|` +
+				`today|tomorrow|yesterday|(?:next )?(?:` + weekdayPattern + `)|` +
+				`(?:` + monthPattern + `) \d{1,2}(?:st|nd|rd|th)?(?:,? \d{4})?|` +
+				`\d{1,2}(?:st|nd|rd|th)? (?:of )?(?:` + monthPattern + `)(?:,? \d{4})?`),
+			fn: extractDate,
+		},
+		"email": {
+			pattern: regexp.MustCompile(`[a-z0-9._%+-]+@[a-z0-9-]+(?:\.[a-z0-9-]+)*\.[a-z]{2,}`),
+		},
+		"url": {
+			pattern: regexp.MustCompile(`(?:https?://|www\.)[a-z0-9-]+(?:\.[a-z0-9-]+)+(?::\d+)?(?:/(?:[^\s]*[^\s.,!?;:)'"])?)?`),
+			fn:      extractURL,
+		},
+		"currency": {
+			pattern: regexp.MustCompile(`[$€£¥] ?` + numberPattern + `|` + numberPattern + ` ?(?:` + currencyPattern + `)\b`),
+			fn:      extractCurrency,
+		},
+	}
+}
+
+// getExtractor looks up an extractor by name.
+func (rs *RiveScript) getExtractor(name string) (*extractor, bool) {
+	rs.cLock.Lock()
+	defer rs.cLock.Unlock()
+
+	ext, ok := rs.extractors[name]
+	return ext, ok
+}
+
+// extract runs an extractor on the text of an entity wildcard.
+func (rs *RiveScript) extract(buf *sessionBuffer, name, text string) (string, bool) {
+	ext, ok := rs.getExtractor(name)
+	if !ok {
+		return "", false
+	} else if ext.fn == nil {
+		return text, true
+	}
+
+	value, ok := ext.fn(rs, &ExtractorContext{
+		Name:     name,
+		Text:     text,
+		Username: buf.username,
+		buf:      buf,
+	})
+	rs.say("Extractor %s: %s => %s (%v)", name, text, value, ok)
+	return value, ok
+}
+
+// triggerExtractors lists the extractors that a trigger uses.
+func (rs *RiveScript) triggerExtractors(pattern string) []string {
+	var names []string
+	for _, match := range reEntity.FindAllStringSubmatch(pattern, -1) {
+		if _, ok := rs.getExtractor(match[1]); ok {
+			names = append(names, match[1])
+		}
+	}
+	return names
+}
+
+/*
+entityGroup reads the name of an entity wildcard's group in a trigger's
+regexp, like "_date_when" for `<date>{when}`, or "_date_0" for a `<date>`
+with no name.
+*/
+func entityGroup(group string) (extractor, name string, ok bool) {
+	if !strings.HasPrefix(group, "_") {
+		return "", group, false
+	}
+
+	parts := strings.SplitN(group[1:], "_", 2)
+	if len(parts) != 2 || parts[1] == "" {
+		return "", group, false
+	}
+	if parts[1][0] >= '0' && parts[1][0] <= '9' {
+		return parts[0], "", true
+	}
+	return parts[0], parts[1], true
+}
+
+/*
+stripAroundEntities strips the punctuation from a user's message, except for
+the text of the entities that a trigger looks for, like e-mail addresses.
+
+This is only for matching that trigger; the other triggers see the message
+stripped as usual. The message is the one from lowerMessage.
+*/
+func (rs *RiveScript) stripAroundEntities(msg string, names []string) string {
+	strip := func(text string) string {
+		return rs.stripMessage(text, false)
+	}
+
+	var spans bySpan
+	for _, name := range names {
+		if ext, ok := rs.getExtractor(name); ok {
+			spans = append(spans, ext.pattern.FindAllStringIndex(msg, -1)...)
+		}
+	}
+	if len(spans) == 0 {
+		return strip(msg)
+	}
+	sort.Sort(spans)
+
+	var out bytes.Buffer
+	last := 0
+	for _, span := range spans {
+		start, end := span[0], span[1]
+		if end <= last {
+			continue // Inside the last one
+		} else if start < last {
+			start = last
+		}
+
+		out.WriteString(strip(msg[last:start]))
+		out.WriteString(reMeta.ReplaceAllString(msg[start:end], ""))
+		last = end
+	}
+	out.WriteString(strip(msg[last:]))
+
+	return out.String()
+}
+
+// bySpan sorts the locations of regexp matches by where they start.
+type bySpan [][]int
+
+func (s bySpan) Len() int {
+	return len(s)
+}
+func (s bySpan) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+func (s bySpan) Less(i, j int) bool {
+	return s[i][0] < s[j][0]
+}
+
+// extractNumber handles <number>, e.g. "1,234.50" becomes "1234.5".
+func extractNumber(rs *RiveScript, ctx *ExtractorContext) (string, bool) {
+	text := strings.Replace(ctx.Text, ",", "", -1)
+	value, ok := parseNumber(text)
+	if !ok {
+		return "", false
+	}
+
+	places := 0
+	if dot := strings.Index(text, "."); dot > -1 {
+		places = len(text) - dot - 1
+	}
+	return trimNumber(value.FloatString(places)), true
+}
+
+// extractURL handles <url>, adding the scheme to addresses like
+// "www.example.com".
+func extractURL(rs *RiveScript, ctx *ExtractorContext) (string, bool) {
+	if strings.HasPrefix(ctx.Text, "www.") {
+		return "http://" + ctx.Text, true
+	}
+	return ctx.Text, true
+}
+
+// currencyCodes are the ISO 4217 codes for the symbols and words of <currency>.
+var currencyCodes = map[string]string{
+	"$": "USD", "dollar": "USD", "dollars": "USD", "bucks": "USD", "usd": "USD",
+	"€": "EUR", "euro": "EUR", "euros": "EUR", "eur": "EUR",
+	"£": "GBP", "pound": "GBP", "pounds": "GBP", "gbp": "GBP",
+	"¥": "JPY", "yen": "JPY", "jpy": "JPY",
+}
+
+// reCurrency splits the text of a <currency> into its symbol and amount.
+var reCurrency = regexp.MustCompile(`^(?:([$€£¥]) ?(` + numberPattern + `)|(` + numberPattern + `) ?([a-z]+))$`)
+
+// extractCurrency handles <currency>, e.g. "$12.5" becomes "12.50 USD".
+func extractCurrency(rs *RiveScript, ctx *ExtractorContext) (string, bool) {
+	match := reCurrency.FindStringSubmatch(ctx.Text)
+	if match == nil {
+		return "", false
+	}
+
+	symbol, amount := match[1], match[2]
+	if symbol == "" {
+		symbol, amount = match[4], match[3]
+	}
+	code, ok := currencyCodes[symbol]
+	if !ok {
+		return "", false
+	}
+
+	value, ok := new(big.Rat).SetString(strings.Replace(amount, ",", "", -1))
+	if !ok {
+		return "", false
+	}
+
+	places := 2
+	if code == "JPY" {
+		places = 0
+	}
+	return fmt.Sprintf("%s %s", roundNumber(value, places, RoundHalfUp).FloatString(places), code), true
+}
+
+// Patterns for the forms of <date> that have a month name in them.
+var (
+	reMonthDay = regexp.MustCompile(`^(` + monthPattern + `) (\d{1,2})(?:st|nd|rd|th)?(?:,? (\d{4}))?$`)
+	reDayMonth = regexp.MustCompile(`^(\d{1,2})(?:st|nd|rd|th)? (?:of )?(` + monthPattern + `)(?:,? (\d{4}))?$`)
+)
+
+// monthNumbers are the months by the first three letters of their names.
+var monthNumbers = map[string]time.Month{
+	"jan": time.January, "feb": time.February, "mar": time.March,
+	"apr": time.April, "may": time.May, "jun": time.June,
+	"jul": time.July, "aug": time.August, "sep": time.September,
+	"oct": time.October, "nov": time.November, "dec": time.December,
+}
+
+/*
+extractDate handles <date>, giving the date as "2006-01-02".
+
+It understands "2006-01-02", "01/02/2006" (month first), "today", "tomorrow",
+"yesterday", weekdays (the next one after today) and dates like "january 2nd"
+or "2 jan 2006". Dates without a year are the next one on or after today, in
+the user's time zone.
+*/
+func extractDate(rs *RiveScript, ctx *ExtractorContext) (string, bool) {
+	now := rs.now(ctx.buf)
+	today := time.Date(now.Year(), now.Month(), now.Day(), 0, 0, 0, 0, now.Location())
+	text := strings.TrimPrefix(ctx.Text, "next ")
+
+	switch text {
+	case "today":
+		return today.Format("2006-01-02"), true
+	case "tomorrow":
+		return today.AddDate(0, 0, 1).Format("2006-01-02"), true
+	case "yesterday":
+		return today.AddDate(0, 0, -1).Format("2006-01-02"), true
+	}
+
+	for day := 1; day <= 7; day++ {
+		date := today.AddDate(0, 0, day)
+		if strings.ToLower(date.Weekday().String()) == text {
+			return date.Format("2006-01-02"), true
+		}
+	}
+
+	for _, layout := range []string{"2006-1-2", "1/2/2006", "1/2/06"} {
+		if date, err := time.ParseInLocation(layout, text, now.Location()); err == nil {
+			return date.Format("2006-01-02"), true
+		}
+	}
+
+	var month, day, year string
+	if match := reMonthDay.FindStringSubmatch(text); match != nil {
+		month, day, year = match[1], match[2], match[3]
+	} else if match := reDayMonth.FindStringSubmatch(text); match != nil {
+		month, day, year = match[2], match[1], match[3]
+	} else {
+		return "", false
+	}
+
+	monthNumber := monthNumbers[month[:3]]
+	dayNumber, _ := strconv.Atoi(day)
+	yearNumber := today.Year()
+	if year != "" {
+		yearNumber, _ = strconv.Atoi(year)
+	}
+
+	date := time.Date(yearNumber, monthNumber, dayNumber, 0, 0, 0, 0, now.Location())
+	if year == "" && date.Before(today) {
+		date = time.Date(yearNumber+1, monthNumber, dayNumber, 0, 0, 0, 0, now.Location())
+	}
+
+	// time.Date() rolls days like February 30 over into the next month.
+	if date.Month() != monthNumber || date.Day() != dayNumber {
+		return "", false
+	}
+	return date.Format("2006-01-02"), true
+}
@@ -0,0 +1,162 @@
+/*
+Package gotemplate implements object macros written as Go templates.
+
+The body of a `gotemplate` object is compiled with the `text/template` package
+and run when the object is called. Templates can format replies with loops and
+conditions but can't run arbitrary code, so they're safe to let content
+authors write. In your Golang code:
+
+	import (
+		rivescript "github.com/aichaos/rivescript-go"
+		"github.com/aichaos/rivescript-go/lang/gotemplate"
+	)
+
+	func main() {
+		bot := rivescript.New(nil)
+		bot.SetHandlerV2("gotemplate", gotemplate.New(bot))
+
+		// and go on as normal
+	}
+
+And in your RiveScript code:
+
+	> object greet gotemplate
+		{{if .User.name}}Hello, {{.User.name}}!{{else}}Hi there!{{end}}
+		I am {{.Bot.name}}.
+	< object
+
+	> object list gotemplate
+		{{range $i, $item := .Args}}{{if $i}}, {{end}}{{upper $item}}{{end}}
+	< object
+
+	+ hello
+	- <call>greet</call>
+
+	+ list *
+	- <call>list <star></call>
+
+The template's data has these fields:
+
+	.Args      The arguments of the <call> tag ([]string)
+	.Username  The ID of the current user
+	.User      The current user's variables (map[string]string)
+	.Bot       The bot variables (map[string]string)
+	.Global    The global variables (map[string]string)
+
+Variables that don't exist are empty strings. Besides the built-in template
+functions there are `upper`, `lower`, `title`, `trim`, `join` and `split`, and
+more functions can be added from Go with `Funcs()`.
+
+The output is trimmed of leading and trailing whitespace.
+*/
+package gotemplate
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+
+	"github.com/aichaos/rivescript-go"
+)
+
+// TemplateHandler implements macro.MacroInterfaceV2 for Go templates.
+type TemplateHandler struct {
+	lock      sync.RWMutex
+	bot       *rivescript.RiveScript
+	funcs     template.FuncMap
+	templates map[string]*template.Template
+}
+
+// Data is the data that templates are run with.
+type Data struct {
+	Args     []string
+	Username string
+	User     map[string]string
+	Bot      map[string]string
+	Global   map[string]string
+}
+
+// New creates an object handler for Go templates.
+func New(rs *rivescript.RiveScript) *TemplateHandler {
+	return &TemplateHandler{
+		bot: rs,
+		funcs: template.FuncMap{
+			"upper": strings.ToUpper,
+			"lower": strings.ToLower,
+			"title": strings.Title,
+			"trim":  strings.TrimSpace,
+			"join": func(sep string, items []string) string {
+				return strings.Join(items, sep)
+			},
+			"split": func(sep, text string) []string {
+				return strings.Split(text, sep)
+			},
+		},
+		templates: map[string]*template.Template{},
+	}
+}
+
+/*
+Funcs adds functions that templates can call, like `template.Funcs()`.
+
+Functions must be added before the objects that use them are loaded, because
+templates are checked for unknown functions when they're loaded.
+*/
+func (h *TemplateHandler) Funcs(funcs template.FuncMap) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for name, fn := range funcs {
+		h.funcs[name] = fn
+	}
+}
+
+// Load compiles a template object. It returns an error if the template has a
+// syntax error or uses a function that doesn't exist.
+func (h *TemplateHandler) Load(name string, code []string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	tmpl, err := template.New(name).
+		Funcs(h.funcs).
+		Option("missingkey=zero").
+		Parse(strings.Join(code, "\n"))
+	if err != nil {
+		return err
+	}
+
+	h.templates[name] = tmpl
+	return nil
+}
+
+// Call runs a template object and returns its output.
+func (h *TemplateHandler) Call(ctx context.Context, name string, fields []string) (string, error) {
+	h.lock.RLock()
+	tmpl, ok := h.templates[name]
+	h.lock.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("object %s isn't loaded", name)
+	}
+
+	data := Data{
+		Args:   fields,
+		User:   map[string]string{},
+		Bot:    h.bot.GetVariables(),
+		Global: h.bot.GetGlobals(),
+	}
+	if username, err := h.bot.CurrentUserContext(ctx); err == nil {
+		data.Username = username
+		if user, err := h.bot.GetUservarsContext(ctx, username); err == nil && user.Variables != nil {
+			data.User = user.Variables
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
@@ -0,0 +1,151 @@
+package javascript
+
+import (
+	"context"
+
+	"github.com/aichaos/rivescript-go"
+	"github.com/aichaos/rivescript-go/sessions"
+	"github.com/robertkrimen/otto"
+)
+
+/*
+BotAPI is the view of the bot that JavaScript object macros get as `rs`,
+unless the handler was created with the FullAPI option.
+
+It only has the methods listed here. User variables can only be read and
+written for the current user, and globals are read-only; trying anything else
+throws a PermissionError in the JavaScript code. Methods like
+`LoadDirectory()`, `ClearAllUservars()` and `SetHandler()` aren't reachable.
+
+Unlike the RiveScript methods of the same names, these return a single value,
+with "undefined" for a variable that isn't set.
+*/
+type BotAPI struct {
+	bot      *rivescript.RiveScript
+	vm       *otto.Otto
+	ctx      context.Context // The reply the object was called for
+	username string          // The user the bot is replying to
+}
+
+// checkUser throws a PermissionError unless the username is the current
+// user's.
+func (api *BotAPI) checkUser(username string) {
+	if username != api.username {
+		panic(api.vm.MakeCustomError(
+			"PermissionError",
+			"object macros can only access the current user's variables",
+		))
+	}
+}
+
+// CurrentUser returns the ID of the user the bot is replying to.
+func (api *BotAPI) CurrentUser() string {
+	return api.username
+}
+
+// GetUservar gets one of the current user's variables.
+func (api *BotAPI) GetUservar(username, name string) string {
+	api.checkUser(username)
+	value, err := api.bot.GetUservarContext(api.ctx, username, name)
+	if err != nil {
+		return rivescript.UNDEFINED
+	}
+	return value
+}
+
+// GetUservars gets all the current user's variables.
+func (api *BotAPI) GetUservars(username string) map[string]string {
+	api.checkUser(username)
+	data, err := api.bot.GetUservarsContext(api.ctx, username)
+	if err != nil || data.Variables == nil {
+		return map[string]string{}
+	}
+	return data.Variables
+}
+
+// SetUservar sets one of the current user's variables.
+func (api *BotAPI) SetUservar(username, name, value string) {
+	api.checkUser(username)
+	api.bot.SetUservarContext(api.ctx, username, name, value)
+}
+
+// SetUservars sets several of the current user's variables.
+func (api *BotAPI) SetUservars(username string, data map[string]string) {
+	api.checkUser(username)
+	api.bot.SetUservarsContext(api.ctx, username, data)
+}
+
+// LastMatch returns the current user's last matched trigger.
+func (api *BotAPI) LastMatch(username string) string {
+	api.checkUser(username)
+	trigger, _ := api.bot.LastMatchContext(api.ctx, username)
+	return trigger
+}
+
+// GetVariable gets a bot variable.
+func (api *BotAPI) GetVariable(name string) string {
+	value, _ := api.bot.GetVariable(name)
+	return value
+}
+
+// SetVariable sets a bot variable.
+func (api *BotAPI) SetVariable(name, value string) {
+	api.bot.SetVariable(name, value)
+}
+
+// GetGlobal gets a global variable.
+func (api *BotAPI) GetGlobal(name string) string {
+	value, _ := api.bot.GetGlobal(name)
+	return value
+}
+
+/*
+fullAPI is the bot that JavaScript object macros get as `rs` with the FullAPI
+option: the whole *rivescript.RiveScript, but with the methods for the users'
+data and replies given the context of the reply the object was called for.
+*/
+type fullAPI struct {
+	*rivescript.RiveScript
+	ctx context.Context
+}
+
+// Reply gets a reply, as part of the reply the object was called for.
+func (api *fullAPI) Reply(username, message string) (string, error) {
+	return api.ReplyContext(api.ctx, username, message)
+}
+
+// ReplyWithInfo gets a reply with its details, as part of the reply the
+// object was called for.
+func (api *fullAPI) ReplyWithInfo(username, message string) (*rivescript.ReplyInfo, error) {
+	return api.ReplyWithInfoContext(api.ctx, username, message)
+}
+
+// CurrentUser returns the ID of the user the bot is replying to.
+func (api *fullAPI) CurrentUser() (string, error) {
+	return api.CurrentUserContext(api.ctx)
+}
+
+// GetUservar gets a user variable.
+func (api *fullAPI) GetUservar(username, name string) (string, error) {
+	return api.GetUservarContext(api.ctx, username, name)
+}
+
+// GetUservars gets all the variables for a user.
+func (api *fullAPI) GetUservars(username string) (*sessions.UserData, error) {
+	return api.GetUservarsContext(api.ctx, username)
+}
+
+// SetUservar sets a variable for a user.
+func (api *fullAPI) SetUservar(username, name, value string) {
+	api.SetUservarContext(api.ctx, username, name, value)
+}
+
+// SetUservars sets a map of variables for a user.
+func (api *fullAPI) SetUservars(username string, data map[string]string) {
+	api.SetUservarsContext(api.ctx, username, data)
+}
+
+// LastMatch returns a user's last matched trigger.
+func (api *fullAPI) LastMatch(username string) (string, error) {
+	return api.LastMatchContext(api.ctx, username)
+}
@@ -15,7 +15,7 @@ Usage is simple. In your Golang code:
 	func main() {
 		bot := rivescript.New(nil)
 		jsHandler := javascript.New(bot)
-		bot.SetHandler("javascript", jsHandler)
+		bot.SetHandlerV2("javascript", jsHandler)
 
 		// and go on as normal
 	}
@@ -43,65 +43,237 @@ And in your RiveScript code, you can load and run JavaScript objects:
 	+ what is my name
 	- You are <get name>.
 
+Objects get the arguments of the `<call>` tag in `args`, and a restricted
+view of the bot as `rs` (see BotAPI) that can only use the current user's
+variables, get and set bot variables, and read globals:
+
+	rs.CurrentUser()
+	rs.GetUservar(username, name)
+	rs.GetUservars(username)
+	rs.SetUservar(username, name, value)
+	rs.SetUservars(username, data)
+	rs.LastMatch(username)
+	rs.GetVariable(name)
+	rs.SetVariable(name, value)
+	rs.GetGlobal(name)
+
+Objects also have a `console` whose messages go to the bot's logger: `log`,
+`info` and `debug` are debug messages, and `warn` and `error` are warnings.
+The `util` object has a few helpers, and the random ones use the bot's random
+number generator, so they follow its Seed:
+
+	util.formatDate(layout, [date])  // Format a Date in UTC with a Go time layout
+	util.random(max)                 // A whole number from 0 to max-1
+	util.choice(array)               // A random item from the array
+
+An object can be used as a library by other objects. The library returns
+what it exports, and `require(name)` runs it the first time it's required in
+a reply and then gives back the same value until the reply is over, since
+the library gets the `rs` of the object that required it:
+
+	> object greetings javascript
+		return {
+			hello: function(name) { return "Hello, " + name; }
+		};
+	< object
+
+	> object greet javascript
+		return require("greetings").hello(args[0]);
+	< object
+
+To give objects the whole *rivescript.RiveScript instead, create the handler
+with the FullAPI option. Its methods for user variables and replies, like
+`rs.Reply()`, are then part of the reply the object was called for.
+
+To protect the bot from object macros that run forever or use too much of
+the stack, create the handler with limits:
+
+	jsHandler := javascript.NewWithConfig(bot, &javascript.Config{
+		Timeout:       5 * time.Second,
+		MaxStackDepth: 1000,
+		MaxOutputSize: 4096,
+	})
+
+An object that goes over a limit is stopped, and the `<call>` tag is replaced
+with the bot's object error message.
+
+An Otto VM can only run one thing at a time, so the handler keeps a pool of
+VMs with every object loaded into each of them. By default the pool has one
+VM, so objects run one at a time; for a bot that replies from many goroutines
+at once, make it bigger:
+
+	jsHandler := javascript.NewWithConfig(bot, &javascript.Config{
+		PoolSize: runtime.NumCPU(),
+	})
+
+Global JavaScript variables are shared by every call on the same VM. To keep
+users apart, set the Isolation option to VMPerUser to give each user their own
+VM, or VMPerCall to run every call on a fresh VM.
+
 [1]: https://github.com/robertkrimen/otto
 */
 package javascript
 
 import (
+	"context"
 	"fmt"
 	"strings"
+	"sync"
 
 	"github.com/aichaos/rivescript-go"
 	"github.com/robertkrimen/otto"
 )
 
+/*
+JavaScriptHandler implements macro.MacroInterfaceV2 for JavaScript.
+
+It's safe to call objects from many goroutines at once. Each call runs on a
+VM of its own for the duration of the call, according to the handler's
+Isolation mode.
+*/
 type JavaScriptHandler struct {
-	vm        *otto.Otto
-	bot       *rivescript.RiveScript
-	functions map[string]string
+	bot    *rivescript.RiveScript
+	config Config
+
+	lock      sync.Mutex
+	template  *otto.Otto        // Has every object loaded; copied for new VMs
+	sources   []string          // Code of the objects in the order loaded
+	functions map[string]string // Code of each object by name
+	pool      chan *jsVM        // VMs for the SharedVMs mode
+	users     map[string]*jsVM  // VMs for the VMPerUser mode
 }
 
 // New creates an object handler for JavaScript with its own Otto VM.
 func New(rs *rivescript.RiveScript) *JavaScriptHandler {
+	return NewWithConfig(rs, nil)
+}
+
+// NewWithConfig creates an object handler for JavaScript with limits on how
+// its object macros run.
+func NewWithConfig(rs *rivescript.RiveScript, cfg *Config) *JavaScriptHandler {
+	if cfg == nil {
+		cfg = &Config{}
+	}
+	if cfg.PoolSize <= 0 {
+		cfg.PoolSize = 1
+	}
+
 	js := new(JavaScriptHandler)
-	js.vm = otto.New()
 	js.bot = rs
+	js.config = *cfg
+	js.template = otto.New()
 	js.functions = map[string]string{}
+	js.users = map[string]*jsVM{}
+
+	if cfg.MaxStackDepth > 0 {
+		js.template.SetStackDepthLimit(cfg.MaxStackDepth)
+	}
+	js.installStdlib()
+
+	if cfg.Isolation == SharedVMs {
+		js.pool = make(chan *jsVM, cfg.PoolSize)
+		for i := 0; i < cfg.PoolSize; i++ {
+			js.pool <- js.newVM()
+		}
+	}
 
 	return js
 }
 
-// Load loads a new JavaScript object macro into the VM.
-func (js JavaScriptHandler) Load(name string, code []string) {
+// Load loads a new JavaScript object macro into the VMs. It returns an error
+// if the code has a syntax error.
+func (js *JavaScriptHandler) Load(name string, code []string) error {
 	// Create a unique function name called the same as the object macro name.
-	js.functions[name] = fmt.Sprintf(`
+	function := fmt.Sprintf(`
 		function object_%s(rs, args) {
 			%s
 		}
-	`, name, strings.Join(code, "\n"))
+	`, name, strings.Join(code, "\n")) + registerObject(name)
 
-	// Run this code to load the function into the VM.
-	js.vm.Run(js.functions[name])
+	js.lock.Lock()
+	defer js.lock.Unlock()
+
+	// Run this code to load the function into the template VM. The others
+	// load it the next time they're used.
+	if _, err := js.template.Run(function); err != nil {
+		return err
+	}
+
+	js.sources = append(js.sources, function)
+	js.functions[name] = function
+	return nil
 }
 
-// Call executes a JavaScript macro and returns its results.
-func (js JavaScriptHandler) Call(name string, fields []string) string {
-	// Make the RiveScript object available to the JS.
-	v, err := js.vm.ToValue(js.bot)
+/*
+Call executes a JavaScript macro and returns its results, or the error thrown
+by the JavaScript code.
+
+If the macro goes over one of the handler's limits, the error is a
+*TimeoutError, *StackDepthError or *OutputSizeError.
+*/
+func (js *JavaScriptHandler) Call(ctx context.Context, name string, fields []string) (string, error) {
+	if ctx.Err() != nil {
+		return "", &TimeoutError{Name: name}
+	}
+
+	replyCtx := ctx
+	username, _ := js.bot.CurrentUserContext(ctx)
+	vm, nested := js.held(ctx, username)
+	if !nested {
+		vm = js.acquire(username)
+		defer js.release(vm)
+		ctx = context.WithValue(ctx, heldKey{js}, vm)
+	}
+
+	// Make the bot API available to the JS.
+	var api interface{} = &BotAPI{
+		bot:      js.bot,
+		vm:       vm.vm,
+		ctx:      ctx,
+		username: username,
+	}
+	if js.config.FullAPI {
+		api = &fullAPI{RiveScript: js.bot, ctx: ctx}
+	}
+	v, err := vm.vm.ToValue(api)
 	if err != nil {
-		fmt.Printf("Error binding RiveScript object to Otto: %s", err)
+		return "", fmt.Errorf("error binding RiveScript object to Otto: %s", err)
 	}
 
 	// Convert the fields into a JavaScript object.
-	jsFields, err := js.vm.ToValue(fields)
+	jsFields, err := vm.vm.ToValue(fields)
 	if err != nil {
-		fmt.Printf("Error binding fields to Otto: %s", err)
+		return "", fmt.Errorf("error binding fields to Otto: %s", err)
 	}
 
+	// Give it the console, and the API and the libraries of this reply for
+	// the libraries it requires. The ones of the object we're nested in are
+	// put back afterwards.
+	if nested {
+		console, _ := vm.vm.Get("console")
+		outer, _ := vm.vm.Get("__rivescript_api")
+		modules, _ := vm.vm.Get("__rivescript_modules")
+		outerReply := vm.reply
+		defer func() {
+			vm.vm.Set("console", console)
+			vm.vm.Set("__rivescript_api", outer)
+			vm.vm.Set("__rivescript_modules", modules)
+			vm.reply = outerReply
+		}()
+	}
+	js.setConsole(vm.vm, name)
+	vm.vm.Set("__rivescript_api", v)
+	js.setModules(vm, replyCtx)
+
 	// Run the JS function call and get the result.
-	result, err := js.vm.Call(fmt.Sprintf("object_%s", name), nil, v, jsFields)
+	var result otto.Value
+	err = js.run(ctx, vm, name, func() error {
+		var err error
+		result, err = vm.vm.Call(fmt.Sprintf("object_%s", name), nil, v, jsFields)
+		return err
+	})
 	if err != nil {
-		fmt.Printf("Error: %s", err)
+		return "", err
 	}
 
 	reply := ""
@@ -109,6 +281,14 @@ func (js JavaScriptHandler) Call(name string, fields []string) string {
 		reply, _ = result.ToString()
 	}
 
+	if js.config.MaxOutputSize > 0 && len(reply) > js.config.MaxOutputSize {
+		return "", &OutputSizeError{
+			Name:  name,
+			Size:  len(reply),
+			Limit: js.config.MaxOutputSize,
+		}
+	}
+
 	// Return it.
-	return reply
+	return reply, nil
 }
@@ -0,0 +1,141 @@
+package javascript
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/*
+Config sets how JavaScript object macros are run, and what they can do with
+the bot.
+
+A zero value for any of the limits means there's no limit.
+*/
+type Config struct {
+	// Isolation controls how VMs are shared between calls. The default is a
+	// pool of VMs shared by all users.
+	Isolation Isolation
+
+	// PoolSize is the number of VMs in the pool for the SharedVMs isolation
+	// mode, which is how many objects can run at the same time. Default 1.
+	PoolSize int
+
+	// Timeout is how long an object macro may run before it's stopped.
+	Timeout time.Duration
+
+	// MaxStackDepth is how deeply JavaScript functions may call each other.
+	MaxStackDepth int
+
+	// MaxOutputSize is the largest result, in bytes, an object macro may
+	// return.
+	MaxOutputSize int
+
+	// FullAPI gives object macros the whole *rivescript.RiveScript as `rs`,
+	// instead of the restricted BotAPI. Only use this if you trust everybody
+	// who writes object macros for the bot.
+	FullAPI bool
+}
+
+// TimeoutError is returned when an object macro runs longer than the timeout,
+// or its context is canceled.
+type TimeoutError struct {
+	Name    string        // Name of the object macro
+	Timeout time.Duration // The handler's Timeout, or zero if canceled
+}
+
+func (e *TimeoutError) Error() string {
+	if e.Timeout == 0 {
+		return fmt.Sprintf("javascript: object %s was canceled", e.Name)
+	}
+	return fmt.Sprintf("javascript: object %s timed out after %s", e.Name, e.Timeout)
+}
+
+// StackDepthError is returned when an object macro goes deeper than the
+// maximum call stack depth.
+type StackDepthError struct {
+	Name  string // Name of the object macro
+	Limit int    // The handler's MaxStackDepth
+}
+
+func (e *StackDepthError) Error() string {
+	return fmt.Sprintf("javascript: object %s exceeded the call stack depth of %d", e.Name, e.Limit)
+}
+
+// OutputSizeError is returned when an object macro's result is larger than
+// the maximum output size.
+type OutputSizeError struct {
+	Name  string // Name of the object macro
+	Size  int    // Size of the result, in bytes
+	Limit int    // The handler's MaxOutputSize
+}
+
+func (e *OutputSizeError) Error() string {
+	return fmt.Sprintf("javascript: object %s returned %d bytes, more than the limit of %d",
+		e.Name, e.Size, e.Limit)
+}
+
+// halt is the value the VM panics with when it's interrupted.
+type halt struct{}
+
+/*
+run runs a function on the VM, interrupting it if the context is done or the
+timeout passes first.
+
+Calls can be nested on a VM, when an object asks for a reply, and they share
+its Interrupt channel, so the interrupt doesn't say which call it's for.
+Instead, each call is marked as stopped when its time is up, and the
+interrupt stops the innermost call if it or any call it's nested in is
+stopped (see jsVM.interrupt). A nested call that's stopped on behalf of the
+one it's in returns a TimeoutError, and the interrupt is sent again for the
+outer call.
+*/
+func (js *JavaScriptHandler) run(ctx context.Context, vm *jsVM, name string, fn func() error) (err error) {
+	if js.config.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, js.config.Timeout)
+		defer cancel()
+	}
+
+	// Watch for the context to be done while the code runs.
+	call := vm.begin()
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			vm.stop(call)
+		case <-done:
+		}
+	}()
+
+	defer func() {
+		close(done)
+		<-stopped
+		vm.end(call)
+
+		if caught := recover(); caught != nil {
+			if _, ok := caught.(halt); !ok {
+				panic(caught)
+			}
+
+			timeoutErr := &TimeoutError{Name: name}
+			if ctx.Err() == context.DeadlineExceeded {
+				timeoutErr.Timeout = js.config.Timeout
+			}
+			err = timeoutErr
+		}
+	}()
+
+	err = fn()
+	if err != nil && js.config.MaxStackDepth > 0 &&
+		strings.Contains(err.Error(), "Maximum call stack size exceeded") {
+		err = &StackDepthError{
+			Name:  name,
+			Limit: js.config.MaxStackDepth,
+		}
+	}
+	return err
+}
@@ -0,0 +1,213 @@
+package javascript
+
+import (
+	"context"
+	"sync"
+
+	"github.com/robertkrimen/otto"
+)
+
+// Isolation controls how object macros share JavaScript VMs.
+type Isolation int
+
+// Valid options for Isolation.
+const (
+	// SharedVMs runs object macros on a pool of VMs shared by every user.
+	// Global JavaScript variables are shared between calls on the same VM.
+	SharedVMs Isolation = iota
+
+	// VMPerCall runs every call on a fresh VM, so nothing is shared.
+	VMPerCall
+
+	// VMPerUser gives every user their own VM, so global JavaScript
+	// variables are kept between one user's calls but not shared with
+	// other users. Use ForgetUser() when a user's VM is no longer needed.
+	VMPerUser
+)
+
+// jsVM is one of the handler's VMs.
+type jsVM struct {
+	sync.Mutex // Used for the users' VMs
+	vm         *otto.Otto
+	loaded     int             // Number of the handler's sources run in this VM
+	username   string          // The user whose VM it is, for VMPerUser
+	reply      context.Context // The reply its libraries were required in
+
+	callLock sync.Mutex
+	calls    []*runningCall // The calls running on it, innermost last
+}
+
+// runningCall is a call running on a VM, for interrupting it.
+type runningCall struct {
+	stopped bool // Its context is done
+}
+
+// begin adds a call to the ones running on the VM.
+func (v *jsVM) begin() *runningCall {
+	call := &runningCall{}
+	v.callLock.Lock()
+	v.calls = append(v.calls, call)
+	v.callLock.Unlock()
+	return call
+}
+
+// stop marks a call as stopped and interrupts the VM.
+func (v *jsVM) stop(call *runningCall) {
+	v.callLock.Lock()
+	call.stopped = true
+	v.callLock.Unlock()
+	v.arm()
+}
+
+/*
+end removes a call from the ones running on the VM.
+
+If a call it was nested in was stopped, its interrupt may have been used up
+stopping this one, so it's sent again. When no calls are left, an interrupt
+still waiting in the channel is thrown away.
+*/
+func (v *jsVM) end(call *runningCall) {
+	v.callLock.Lock()
+	stopped := false
+	for i, other := range v.calls {
+		if other == call {
+			v.calls = append(v.calls[:i], v.calls[i+1:]...)
+			break
+		}
+	}
+	for _, other := range v.calls {
+		stopped = stopped || other.stopped
+	}
+	if len(v.calls) == 0 {
+		select {
+		case <-v.vm.Interrupt:
+		default:
+		}
+	}
+	v.callLock.Unlock()
+
+	if stopped {
+		v.arm()
+	}
+}
+
+// arm sends the VM an interrupt, unless there's one waiting already. Every
+// interrupt does the same thing, so one is enough.
+func (v *jsVM) arm() {
+	select {
+	case v.vm.Interrupt <- v.interrupt:
+	default:
+	}
+}
+
+// interrupt is run by the VM when it's interrupted, in the innermost call. It
+// stops the call if it or a call it's nested in is stopped; otherwise the
+// interrupt is left over from a call that's finished, and does nothing.
+func (v *jsVM) interrupt() {
+	v.callLock.Lock()
+	stopped := false
+	for _, call := range v.calls {
+		stopped = stopped || call.stopped
+	}
+	v.callLock.Unlock()
+
+	if stopped {
+		panic(halt{})
+	}
+}
+
+// heldKey is the context key for the VM that a running object holds.
+type heldKey struct {
+	js *JavaScriptHandler
+}
+
+/*
+held finds the VM held by an object that asked for the reply a new call is
+for, if the new call should run on it.
+
+Getting another VM could wait forever for the one the object holds, so the
+new call runs on it too, nested in the object's call. With VMPerCall, a new
+VM never waits, and with VMPerUser, only the same user's calls share one.
+*/
+func (js *JavaScriptHandler) held(ctx context.Context, username string) (*jsVM, bool) {
+	v, ok := ctx.Value(heldKey{js}).(*jsVM)
+	if !ok {
+		return nil, false
+	}
+
+	switch js.config.Isolation {
+	case VMPerCall:
+		return nil, false
+	case VMPerUser:
+		return v, v.username == username
+	}
+	return v, true
+}
+
+// newVM creates a VM with every object loaded so far. The handler must be
+// locked.
+func (js *JavaScriptHandler) newVM() *jsVM {
+	vm := js.template.Copy()
+	vm.Interrupt = make(chan func(), 1)
+	return &jsVM{
+		vm:     vm,
+		loaded: len(js.sources),
+	}
+}
+
+// acquire gets a VM to call an object on, with every object loaded. It must
+// be given back with release().
+func (js *JavaScriptHandler) acquire(username string) *jsVM {
+	var v *jsVM
+
+	switch js.config.Isolation {
+	case VMPerCall:
+		js.lock.Lock()
+		v = js.newVM()
+		js.lock.Unlock()
+		return v
+	case VMPerUser:
+		js.lock.Lock()
+		v = js.users[username]
+		if v == nil {
+			v = js.newVM()
+			v.username = username
+			js.users[username] = v
+		}
+		js.lock.Unlock()
+		v.Lock()
+	default:
+		v = <-js.pool
+	}
+
+	// Load the objects that were added since this VM was last used.
+	js.lock.Lock()
+	sources := js.sources[v.loaded:]
+	js.lock.Unlock()
+	for _, source := range sources {
+		v.vm.Run(source)
+	}
+	v.loaded += len(sources)
+
+	return v
+}
+
+// release gives back a VM from acquire().
+func (js *JavaScriptHandler) release(v *jsVM) {
+	switch js.config.Isolation {
+	case VMPerCall:
+	case VMPerUser:
+		v.Unlock()
+	default:
+		js.pool <- v
+	}
+}
+
+// ForgetUser deletes a user's VM when using the VMPerUser isolation mode.
+// They'll get a new one the next time they call an object.
+func (js *JavaScriptHandler) ForgetUser(username string) {
+	js.lock.Lock()
+	defer js.lock.Unlock()
+
+	delete(js.users, username)
+}
@@ -0,0 +1,153 @@
+package javascript
+
+// The standard library available to every object macro.
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/robertkrimen/otto"
+)
+
+// prelude is run in the template VM before any objects are loaded. It keeps
+// track of the objects so they can be used as libraries with require(). The
+// libraries are kept for one reply (see setModules).
+const prelude = `
+	var __rivescript_objects = {};
+	var __rivescript_modules = {};
+	var __rivescript_api;
+
+	function require(name) {
+		if (!__rivescript_modules.hasOwnProperty(name)) {
+			if (!__rivescript_objects.hasOwnProperty(name)) {
+				throw new Error("require: no JavaScript object named " + name);
+			}
+			__rivescript_modules[name] = __rivescript_objects[name](__rivescript_api, []);
+		}
+		return __rivescript_modules[name];
+	}
+`
+
+// installStdlib sets up the standard library in the template VM.
+func (js *JavaScriptHandler) installStdlib() {
+	if _, err := js.template.Run(prelude); err != nil {
+		panic(fmt.Sprintf("javascript: couldn't run the prelude: %s", err))
+	}
+
+	js.template.Set("util", map[string]interface{}{
+		"formatDate": js.formatDate,
+		"random":     js.random,
+		"choice":     js.choice,
+	})
+}
+
+/*
+setModules gives a VM the libraries required so far in a reply, forgetting
+the ones required in another reply.
+
+A library is run with the API of the object that required it first, and may
+hold on to it, so it can't be shared with the calls of another reply, which
+could be for another user.
+*/
+func (js *JavaScriptHandler) setModules(vm *jsVM, reply context.Context) {
+	if vm.reply == reply {
+		return
+	}
+	modules, _ := vm.vm.Object(`({})`)
+	vm.vm.Set("__rivescript_modules", modules)
+	vm.reply = reply
+}
+
+// registerObject is the code that makes an object available to require().
+// Loading an object again forgets the library it returned before.
+func registerObject(name string) string {
+	return fmt.Sprintf(`
+		__rivescript_objects[%q] = object_%s;
+		delete __rivescript_modules[%q];
+	`, name, name, name)
+}
+
+// setConsole gives the VM a console object that logs through the bot, with
+// the name of the object macro being called.
+func (js *JavaScriptHandler) setConsole(vm *otto.Otto, name string) {
+	logger := func(log func(string, ...interface{})) func(otto.FunctionCall) otto.Value {
+		return func(call otto.FunctionCall) otto.Value {
+			parts := make([]string, len(call.ArgumentList))
+			for i, arg := range call.ArgumentList {
+				parts[i] = arg.String()
+			}
+			log("[javascript %s] %s", name, strings.Join(parts, " "))
+			return otto.UndefinedValue()
+		}
+	}
+
+	vm.Set("console", map[string]interface{}{
+		"log":   logger(js.bot.Debugf),
+		"info":  logger(js.bot.Debugf),
+		"debug": logger(js.bot.Debugf),
+		"warn":  logger(js.bot.Warnf),
+		"error": logger(js.bot.Warnf),
+	})
+}
+
+/*
+formatDate implements util.formatDate(layout, [time]).
+
+The layout is a Go time layout, like "2006-01-02 15:04". The time is a Date
+object or milliseconds since the epoch, and defaults to now on the bot's
+clock. It's formatted in UTC, so the result doesn't depend on the machine's
+time zone.
+*/
+func (js *JavaScriptHandler) formatDate(call otto.FunctionCall) otto.Value {
+	layout := call.Argument(0).String()
+	when := js.bot.Now()
+
+	if arg := call.Argument(1); arg.IsDefined() {
+		if arg.Class() == "Date" {
+			value, err := arg.Object().Call("getTime")
+			if err != nil {
+				panic(call.Otto.MakeTypeError(err.Error()))
+			}
+			arg = value
+		}
+		ms, err := arg.ToInteger()
+		if err != nil {
+			panic(call.Otto.MakeTypeError("util.formatDate: the time must be a Date or a number"))
+		}
+		when = time.Unix(0, ms*int64(time.Millisecond))
+	}
+
+	value, _ := call.Otto.ToValue(when.UTC().Format(layout))
+	return value
+}
+
+// random implements util.random(max), which returns a whole number from 0 up
+// to (but not including) max using the bot's random number generator.
+func (js *JavaScriptHandler) random(call otto.FunctionCall) otto.Value {
+	max, err := call.Argument(0).ToInteger()
+	if err != nil {
+		panic(call.Otto.MakeTypeError("util.random: max must be a number"))
+	}
+	value, _ := call.Otto.ToValue(js.bot.RandomInt(int(max)))
+	return value
+}
+
+// choice implements util.choice(array), which returns a random item from an
+// array using the bot's random number generator.
+func (js *JavaScriptHandler) choice(call otto.FunctionCall) otto.Value {
+	array := call.Argument(0)
+	if array.Class() != "Array" {
+		panic(call.Otto.MakeTypeError("util.choice: expected an array"))
+	}
+
+	length, _ := array.Object().Get("length")
+	n, _ := length.ToInteger()
+	if n == 0 {
+		return otto.UndefinedValue()
+	}
+
+	item, _ := array.Object().Get(fmt.Sprintf("%d", js.bot.RandomInt(int(n))))
+	return item
+}
@@ -0,0 +1,94 @@
+package lua
+
+// The bot API that's available to Lua objects as the `rs` table.
+
+import (
+	"context"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// newAPI creates the `rs` table.
+func (h *LuaHandler) newAPI() *lua.LTable {
+	api := h.vm.NewTable()
+	h.vm.SetFuncs(api, map[string]lua.LGFunction{
+		"CurrentUser": h.method(func(L *lua.LState, args *arguments) int {
+			value, err := h.bot.CurrentUserContext(h.context())
+			return pushResult(L, value, err)
+		}),
+		"GetUservar": h.method(func(L *lua.LState, args *arguments) int {
+			value, err := h.bot.GetUservarContext(h.context(), args.string(), args.string())
+			return pushResult(L, value, err)
+		}),
+		"SetUservar": h.method(func(L *lua.LState, args *arguments) int {
+			h.bot.SetUservarContext(h.context(), args.string(), args.string(), args.string())
+			return 0
+		}),
+		"GetVariable": h.method(func(L *lua.LState, args *arguments) int {
+			value, err := h.bot.GetVariable(args.string())
+			return pushResult(L, value, err)
+		}),
+		"SetVariable": h.method(func(L *lua.LState, args *arguments) int {
+			h.bot.SetVariable(args.string(), args.string())
+			return 0
+		}),
+		"GetGlobal": h.method(func(L *lua.LState, args *arguments) int {
+			value, err := h.bot.GetGlobal(args.string())
+			return pushResult(L, value, err)
+		}),
+		"LastMatch": h.method(func(L *lua.LState, args *arguments) int {
+			value, err := h.bot.LastMatchContext(h.context(), args.string())
+			return pushResult(L, value, err)
+		}),
+		"Reply": h.method(func(L *lua.LState, args *arguments) int {
+			value, err := h.bot.ReplyContext(h.context(), args.string(), args.string())
+			return pushResult(L, value, err)
+		}),
+	})
+	return api
+}
+
+// context returns the context of the object that's running, which carries
+// the reply it was called for.
+func (h *LuaHandler) context() context.Context {
+	if ctx := h.vm.Context(); ctx != nil {
+		return ctx
+	}
+	return context.Background()
+}
+
+// arguments reads the arguments of a call to an API function in order.
+type arguments struct {
+	L *lua.LState
+	n int
+}
+
+// string returns the next argument as a string.
+func (a *arguments) string() string {
+	a.n++
+	return a.L.CheckString(a.n)
+}
+
+// method wraps an API function so that it can be called with `rs.Name()` or
+// `rs:Name()`.
+func (h *LuaHandler) method(fn func(L *lua.LState, args *arguments) int) lua.LGFunction {
+	return func(L *lua.LState) int {
+		args := &arguments{L: L}
+		if L.GetTop() > 0 && L.Get(1) == h.api {
+			args.n = 1
+		}
+		return fn(L, args)
+	}
+}
+
+// pushResult returns a Go function's result to Lua: the value, or nil and the
+// error message.
+func pushResult(L *lua.LState, value string, err error) int {
+	if err != nil {
+		L.Push(lua.LNil)
+		L.Push(lua.LString(err.Error()))
+		return 2
+	}
+	L.Push(lua.LString(value))
+	return 1
+}
@@ -0,0 +1,198 @@
+/*
+Package lua implements Lua object macros for RiveScript.
+
+This is powered by GopherLua[1], a Lua 5.1 virtual machine written in pure
+Go. In your Golang code:
+
+	import (
+		rivescript "github.com/aichaos/rivescript-go"
+		"github.com/aichaos/rivescript-go/lang/lua"
+	)
+
+	func main() {
+		bot := rivescript.New(nil)
+		bot.SetHandlerV2("lua", lua.New(bot))
+
+		// and go on as normal
+	}
+
+And in your RiveScript code, you can load and run Lua objects:
+
+	> object add lua
+		return tonumber(args[1]) + tonumber(args[2])
+	< object
+
+	> object setname lua
+		-- Set the user's name via Lua
+		local uid = rs.CurrentUser()
+		rs.SetUservar(uid, args[1], args[2])
+	< object
+
+	+ add # and #
+	- <star1> + <star2> = <call>add <star1> <star2></call>
+
+	+ my name is *
+	- I will remember that.<call>setname name <formal></call>
+
+Objects get the arguments of the `<call>` tag in the `args` table (numbered
+from 1, as usual in Lua) and an `rs` table with the same bot API that
+JavaScript objects use:
+
+	rs.CurrentUser()
+	rs.GetUservar(username, name)
+	rs.SetUservar(username, name, value)
+	rs.GetVariable(name)
+	rs.SetVariable(name, value)
+	rs.GetGlobal(name)
+	rs.LastMatch(username)
+	rs.Reply(username, message)
+
+The functions can be called as `rs.Name(...)` or `rs:Name(...)`. Those that
+look something up return nil and an error message if it wasn't found.
+
+The objects run in a sandbox: only the base, table, string, math and coroutine
+libraries are available, without the functions of the base library that load
+files or modules. There's no `os`, `io`, `package` or `debug`.
+
+[1]: https://github.com/yuin/gopher-lua
+*/
+package lua
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/aichaos/rivescript-go"
+	lua "github.com/yuin/gopher-lua"
+)
+
+// heldKey is the context key that marks a reply whose object holds the VM.
+type heldKey struct{}
+
+// LuaHandler implements macro.MacroInterfaceV2 for Lua.
+type LuaHandler struct {
+	lock      sync.Mutex // The Lua VM can only be used by one goroutine
+	vm        *lua.LState
+	bot       *rivescript.RiveScript
+	api       *lua.LTable
+	functions map[string]*lua.LFunction
+}
+
+// New creates an object handler for Lua with its own sandboxed Lua VM.
+func New(rs *rivescript.RiveScript) *LuaHandler {
+	h := &LuaHandler{
+		vm: lua.NewState(lua.Options{
+			SkipOpenLibs: true,
+		}),
+		bot:       rs,
+		functions: map[string]*lua.LFunction{},
+	}
+	h.sandbox()
+	h.api = h.newAPI()
+	return h
+}
+
+// sandbox opens the safe standard libraries in the VM.
+func (h *LuaHandler) sandbox() {
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.CoroutineLibName, lua.OpenCoroutine},
+	} {
+		h.vm.Push(h.vm.NewFunction(lib.fn))
+		h.vm.Push(lua.LString(lib.name))
+		h.vm.Call(1, 0)
+	}
+
+	// Remove the base functions that reach outside the sandbox.
+	for _, name := range []string{"dofile", "loadfile", "require", "module"} {
+		h.vm.SetGlobal(name, lua.LNil)
+	}
+}
+
+// Load loads a new Lua object macro into the VM. It returns an error if the
+// code has a syntax error.
+func (h *LuaHandler) Load(name string, code []string) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	// The object's code becomes the body of a function.
+	source := fmt.Sprintf("return function(rs, args)\n%s\nend", strings.Join(code, "\n"))
+	chunk, err := h.vm.LoadString(source)
+	if err != nil {
+		return err
+	}
+
+	// Run the chunk to get the function out of it.
+	h.vm.Push(chunk)
+	if err := h.vm.PCall(0, 1, nil); err != nil {
+		return err
+	}
+	fn, ok := h.vm.Get(-1).(*lua.LFunction)
+	h.vm.Pop(1)
+	if !ok {
+		return fmt.Errorf("object %s didn't compile to a function", name)
+	}
+
+	h.functions[name] = fn
+	return nil
+}
+
+/*
+Call executes a Lua macro and returns its result, or the error raised by the
+Lua code. The object is stopped if the context is done.
+
+An object that asks for a reply with `rs.Reply()` still holds the VM, so an
+object called for that reply runs on the same VM, nested in the first.
+*/
+func (h *LuaHandler) Call(ctx context.Context, name string, fields []string) (string, error) {
+	if ctx.Value(heldKey{}) != h {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		ctx = context.WithValue(ctx, heldKey{}, h)
+	}
+
+	fn, ok := h.functions[name]
+	if !ok {
+		return "", fmt.Errorf("object %s isn't loaded", name)
+	}
+
+	// Convert the fields into a Lua table.
+	args := h.vm.NewTable()
+	for _, field := range fields {
+		args.Append(lua.LString(field))
+	}
+
+	// Keep the context of the object we're nested in, if any, to restore.
+	outer := h.vm.Context()
+	h.vm.SetContext(ctx)
+	defer func() {
+		if outer != nil {
+			h.vm.SetContext(outer)
+		} else {
+			h.vm.RemoveContext()
+		}
+	}()
+
+	h.vm.Push(fn)
+	h.vm.Push(h.api)
+	h.vm.Push(args)
+	if err := h.vm.PCall(2, 1, nil); err != nil {
+		return "", err
+	}
+
+	result := h.vm.Get(-1)
+	h.vm.Pop(1)
+
+	if result == lua.LNil {
+		return "", nil
+	}
+	return result.String(), nil
+}
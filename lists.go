@@ -0,0 +1,185 @@
+package rivescript
+
+// List user variables.
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+/*
+listPrefix starts the name of the user variable a list is stored in.
+
+Lists are kept apart from the ordinary variables, so that a value that only
+looks like a list is never read as one, and `<get name>` is never a list's
+encoding.
+*/
+const listPrefix = "list:"
+
+/*
+decodeList reads a list from its user variable.
+
+Lists are stored as a JSON array of strings, so every session manager can keep
+them as an ordinary user variable. A variable that isn't set is an empty list,
+and one that isn't a JSON array (set by hand, say) is a list of that value.
+*/
+func decodeList(value string) []string {
+	if value == "" || value == UNDEFINED {
+		return []string{}
+	}
+
+	var list []string
+	if json.Unmarshal([]byte(value), &list) == nil && list != nil {
+		return list
+	}
+	return []string{value}
+}
+
+// encodeList writes a list for storing in a user variable.
+func encodeList(list []string) string {
+	if list == nil {
+		list = []string{}
+	}
+	data, _ := json.Marshal(list)
+	return string(data)
+}
+
+/*
+GetUserList gets a list variable for a user.
+
+Lists are made with tags like `<push name=value>`, and stored as a JSON array
+in the user variable "list:" + name. A list that isn't set is empty.
+
+Parameters
+
+	username: The user ID to look up the list for.
+	name: The name of the list variable.
+*/
+func (rs *RiveScript) GetUserList(username, name string) ([]string, error) {
+	return rs.session(context.Background(), username).getList(name)
+}
+
+/*
+SetUserList sets a list variable for a user.
+
+Parameters
+
+	username: The user ID to set the list for.
+	name: The name of the list variable.
+	list: The items of the list.
+*/
+func (rs *RiveScript) SetUserList(username, name string, list []string) {
+	rs.session(context.Background(), username).setList(name, list)
+}
+
+// getList gets a user's list.
+func (buf *sessionBuffer) getList(name string) ([]string, error) {
+	value, err := buf.get(listPrefix + name)
+	if err != nil {
+		return []string{}, err
+	}
+	return decodeList(value), nil
+}
+
+// setList sets a user's list.
+func (buf *sessionBuffer) setList(name string, list []string) {
+	buf.set(map[string]string{listPrefix + name: encodeList(list)})
+}
+
+// tagList gets a user's list for a tag; a missing variable is an empty list.
+func tagList(tag *TagContext, name string) []string {
+	list, _ := tag.buf.getList(name)
+	return list
+}
+
+// splitTagArgs splits the "name=value" arguments of a tag. The value may have
+// more = signs in it.
+func splitTagArgs(args string) (name, value string, hasValue bool) {
+	parts := strings.SplitN(args, "=", 2)
+	if len(parts) == 2 {
+		return strings.TrimSpace(parts[0]), parts[1], true
+	}
+	return strings.TrimSpace(parts[0]), "", false
+}
+
+// tagPush handles <push name=value>, which adds an item to the end of a list.
+func tagPush(rs *RiveScript, tag *TagContext) string {
+	name, value, ok := splitTagArgs(tag.Args)
+	if !ok {
+		rs.warn("Malformed <push> tag: %s %s", tag.Name, tag.Args)
+		return ""
+	}
+	tag.buf.setList(name, append(tagList(tag, name), value))
+	return ""
+}
+
+// tagPop handles <pop name>, which removes the last item of a list and gives
+// it back.
+func tagPop(rs *RiveScript, tag *TagContext) string {
+	list := tagList(tag, tag.Args)
+	if len(list) == 0 {
+		return UNDEFINED
+	}
+	item := list[len(list)-1]
+	tag.buf.setList(tag.Args, list[:len(list)-1])
+	return item
+}
+
+// tagRemove handles <remove name=value>, which removes every copy of an item
+// from a list.
+func tagRemove(rs *RiveScript, tag *TagContext) string {
+	name, value, ok := splitTagArgs(tag.Args)
+	if !ok {
+		rs.warn("Malformed <remove> tag: %s %s", tag.Name, tag.Args)
+		return ""
+	}
+
+	list := tagList(tag, name)
+	kept := []string{}
+	for _, item := range list {
+		if item != value {
+			kept = append(kept, item)
+		}
+	}
+	tag.buf.setList(name, kept)
+	return ""
+}
+
+// tagHas handles <has name=value>, which is "true" if the list has the item
+// and "false" if not.
+func tagHas(rs *RiveScript, tag *TagContext) string {
+	name, value, _ := splitTagArgs(tag.Args)
+	for _, item := range tagList(tag, name) {
+		if item == value {
+			return "true"
+		}
+	}
+	return "false"
+}
+
+// tagCount handles <count name>, the number of items in a list.
+func tagCount(rs *RiveScript, tag *TagContext) string {
+	return strconv.Itoa(len(tagList(tag, tag.Args)))
+}
+
+// tagJoin handles <join name> and <join name=separator>, which give the items
+// of a list joined by ", " or the separator.
+func tagJoin(rs *RiveScript, tag *TagContext) string {
+	name, separator, ok := splitTagArgs(tag.Args)
+	if !ok {
+		separator = ", "
+	}
+	return strings.Join(tagList(tag, name), separator)
+}
+
+// tagPick handles <pick name>, a random item from a list, like (@array) is
+// for the bot's arrays.
+func tagPick(rs *RiveScript, tag *TagContext) string {
+	list := tagList(tag, tag.Args)
+	if len(list) == 0 {
+		return UNDEFINED
+	}
+	return list[rs.randomInt(len(list))]
+}
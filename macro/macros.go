@@ -1,11 +1,54 @@
 // Package macros exports types relevant to object macros.
 package macro
 
+import "context"
+
 // MacroInterface is the interface for a Go object macro handler.
 //
 // Here, "object macro handler" means Go code is handling object macros for a
 // foreign programming language, for example JavaScript.
+//
+// New handlers should implement MacroInterfaceV2 instead, which can report
+// errors back to RiveScript.
 type MacroInterface interface {
 	Load(name string, code []string)
 	Call(name string, fields []string) string
 }
+
+/*
+MacroInterfaceV2 is the interface for an object macro handler that reports
+its errors.
+
+Load returns an error if the object's code couldn't be loaded, e.g. because
+of a syntax error. RiveScript passes the error back from `LoadFile()` and
+`Stream()` in strict mode, or warns about it and skips the object otherwise.
+
+Call returns an error if the object failed while running. The error is logged
+and the `<call>` tag is replaced with the bot's object error message. The
+context is canceled if the caller gives up on the reply, and handlers should
+stop running the object when it is.
+*/
+type MacroInterfaceV2 interface {
+	Load(name string, code []string) error
+	Call(ctx context.Context, name string, fields []string) (string, error)
+}
+
+// Upgrade adapts a MacroInterface handler to MacroInterfaceV2. Its Load and
+// Call never return errors, and its Call ignores the context.
+func Upgrade(handler MacroInterface) MacroInterfaceV2 {
+	return v1Handler{handler}
+}
+
+// v1Handler wraps a MacroInterface handler.
+type v1Handler struct {
+	handler MacroInterface
+}
+
+func (h v1Handler) Load(name string, code []string) error {
+	h.handler.Load(name, code)
+	return nil
+}
+
+func (h v1Handler) Call(ctx context.Context, name string, fields []string) (string, error) {
+	return h.handler.Call(name, fields), nil
+}
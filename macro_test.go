@@ -9,17 +9,28 @@ package rivescript_test
 // cycle.
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
 	"testing"
+	"text/template"
+	"time"
 
 	rivescript "github.com/aichaos/rivescript-go"
+	"github.com/aichaos/rivescript-go/lang/gotemplate"
 	"github.com/aichaos/rivescript-go/lang/javascript"
+	"github.com/aichaos/rivescript-go/lang/lua"
 )
 
 // This one has to test the public interface because of the JavaScript handler
 // expecting a *RiveScript of the correct color.
 func TestJavaScript(t *testing.T) {
 	rs := rivescript.New(nil)
-	rs.SetHandler("javascript", javascript.New(rs))
+	rs.SetHandlerV2("javascript", javascript.New(rs))
 	rs.Stream(`
 		> object reverse javascript
 			var msg = args.join(" ");
@@ -55,3 +66,804 @@ func TestJavaScript(t *testing.T) {
 	rs.RemoveHandler("javascript")
 	assert("reverse hello world", "[ERR: Object Not Found]")
 }
+
+// Errors from loading and running JavaScript objects are reported.
+func TestJavaScriptErrors(t *testing.T) {
+	broken := `
+		> object broken javascript
+			return "unclosed;
+		< object
+	`
+
+	// A syntax error is fatal in strict mode...
+	rs := rivescript.New(nil)
+	rs.SetHandlerV2("javascript", javascript.New(rs))
+	if err := rs.Stream(broken); err == nil {
+		t.Errorf("expected an error loading a broken object in strict mode")
+	}
+
+	// ...and skips the object otherwise.
+	rs = rivescript.New(&rivescript.Config{
+		ObjectError: "Oops!",
+	})
+	rs.Quiet = true
+	rs.SetHandlerV2("javascript", javascript.New(rs))
+	if err := rs.Stream(broken); err != nil {
+		t.Errorf("got an error loading a broken object in non-strict mode: %s", err)
+	}
+	rs.Stream(`
+		> object throws javascript
+			throw new Error("something went wrong");
+		< object
+
+		+ broken
+		- <call>broken</call>
+
+		+ throws
+		- <call>throws</call>
+	`)
+	rs.SortReplies()
+
+	assertReply(t, rs, "broken", "[ERR: Object Not Found]")
+	assertReply(t, rs, "throws", "Oops!")
+}
+
+// legacyHandler is an object macro handler with the original interface.
+type legacyHandler struct{}
+
+func (legacyHandler) Load(name string, code []string) {}
+
+func (legacyHandler) Call(name string, fields []string) string {
+	return name + " " + strings.Join(fields, ",")
+}
+
+// Handlers of the original interface still work.
+func TestLegacyHandler(t *testing.T) {
+	rs := rivescript.New(nil)
+	rs.SetHandler("legacy", legacyHandler{})
+	rs.Stream(`
+		> object echo legacy
+			whatever
+		< object
+
+		+ echo *
+		- <call>echo <star></call>
+	`)
+	rs.SortReplies()
+
+	assertReply(t, rs, "echo a b", "echo a,b")
+}
+
+// Go subroutines with the V2 prototype get the call's context and can change
+// the user's data through their result.
+func TestSubroutineV2(t *testing.T) {
+	rs := rivescript.New(nil)
+	rs.Quiet = true
+	rs.SetSubroutineV2("weather", func(rs *rivescript.RiveScript, call *rivescript.CallContext) (*rivescript.CallResult, error) {
+		return &rivescript.CallResult{
+			Reply: fmt.Sprintf("%s %s %q %q %v %s", call.Username, call.Topic,
+				call.Stars, call.Args, call.Named["units"], call.Raw),
+		}, nil
+	})
+	rs.SetSubroutineV2("enter", func(rs *rivescript.RiveScript, call *rivescript.CallContext) (*rivescript.CallResult, error) {
+		return &rivescript.CallResult{
+			Reply:    "Entering. ",
+			Set:      map[string]string{"place": call.Args[0]},
+			Topic:    "room",
+			Redirect: "look",
+		}, nil
+	})
+	rs.SetSubroutineV2("fail", func(rs *rivescript.RiveScript, call *rivescript.CallContext) (*rivescript.CallResult, error) {
+		return nil, errors.New("failed")
+	})
+	rs.SetSubroutine("legacy", func(rs *rivescript.RiveScript, args []string) string {
+		return strings.Join(args, "|")
+	})
+	rs.Stream(`
+		+ weather in *
+		- <call>weather "<star>" units=metric say="a \\"quoted\\" word"</call>
+
+		+ enter *
+		- <call>enter <star></call>
+
+		+ fail
+		- <call>fail</call>
+
+		+ legacy
+		- <call>legacy "a b" c=d</call>
+
+		> topic room
+			+ look
+			- You see the <get place>.
+		< topic
+	`)
+	rs.SortReplies()
+
+	assertReply(t, rs, "weather in new york",
+		`local-user random ["new york"] ["new york"] metric "new york" units=metric say="a \\"quoted\\" word"`)
+	assertReply(t, rs, "enter kitchen", "Entering. You see the kitchen.")
+	if topic, _ := rs.GetUservar("local-user", "topic"); topic != "room" {
+		t.Errorf("expected the topic to be room, got %s", topic)
+	}
+	rs.SetUservar("local-user", "topic", "random")
+	assertReply(t, rs, "fail", "[ERR: Error when executing object]")
+	assertReply(t, rs, "legacy", `"a|b"|c=d`)
+}
+
+// assertReply checks the bot's reply to a message.
+func assertReply(t *testing.T, rs *rivescript.RiveScript, input, expected string) {
+	reply, err := rs.Reply("local-user", input)
+	if err != nil {
+		t.Errorf("Got error when trying to get a reply: %v", err)
+	} else if reply != expected {
+		t.Errorf("Got unexpected reply. Expected %s, got %s", expected, reply)
+	}
+}
+
+// Object macros that go over the JavaScript handler's limits are stopped.
+func TestJavaScriptLimits(t *testing.T) {
+	rs := rivescript.New(nil)
+	js := javascript.NewWithConfig(rs, &javascript.Config{
+		Timeout:       50 * time.Millisecond,
+		MaxStackDepth: 100,
+		MaxOutputSize: 10,
+	})
+	rs.SetHandlerV2("javascript", js)
+	err := rs.Stream(`
+		> object loop javascript
+			while (true) {}
+		< object
+
+		> object recurse javascript
+			function f() { return f(); }
+			return f();
+		< object
+
+		> object long javascript
+			return "This is more than ten bytes.";
+		< object
+
+		> object short javascript
+			return "OK";
+		< object
+	`)
+	if err != nil {
+		t.Fatalf("couldn't load the objects: %s", err)
+	}
+
+	ctx := context.Background()
+	if _, err := js.Call(ctx, "loop", nil); err == nil {
+		t.Errorf("expected the loop to time out")
+	} else if _, ok := err.(*javascript.TimeoutError); !ok {
+		t.Errorf("expected a TimeoutError, got %T: %s", err, err)
+	}
+
+	if _, err := js.Call(ctx, "recurse", nil); err == nil {
+		t.Errorf("expected the recursion to overflow the stack")
+	} else if _, ok := err.(*javascript.StackDepthError); !ok {
+		t.Errorf("expected a StackDepthError, got %T: %s", err, err)
+	}
+
+	if _, err := js.Call(ctx, "long", nil); err == nil {
+		t.Errorf("expected the long output to be rejected")
+	} else if _, ok := err.(*javascript.OutputSizeError); !ok {
+		t.Errorf("expected an OutputSizeError, got %T: %s", err, err)
+	}
+
+	// The VM still works after being interrupted.
+	if reply, err := js.Call(ctx, "short", nil); err != nil || reply != "OK" {
+		t.Errorf("expected OK from the short object, got %s (%v)", reply, err)
+	}
+
+	// A canceled context stops the object too.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := js.Call(canceled, "short", nil); err == nil {
+		t.Errorf("expected an error from a canceled context")
+	}
+}
+
+func TestLua(t *testing.T) {
+	rs := rivescript.New(nil)
+	rs.SetHandlerV2("lua", lua.New(rs))
+	err := rs.Stream(`
+		> object reverse lua
+			return string.reverse(table.concat(args, " "))
+		< object
+
+		> object setname lua
+			local uid = rs.CurrentUser()
+			rs:SetUservar(uid, "name", args[1])
+			return "Set " .. rs.GetUservar(uid, "name")
+		< object
+
+		> object missing lua
+			local value, err = rs.GetVariable("nothing")
+			if value == nil then
+				return "not found"
+			end
+		< object
+
+		> object sandbox lua
+			return tostring(os) .. " " .. tostring(io) .. " " .. tostring(dofile)
+		< object
+
+		> object fails lua
+			error("something went wrong")
+		< object
+
+		> object ask lua
+			return rs.Reply(args[1], "reverse nested")
+		< object
+
+		+ reverse *
+		- <call>reverse <star></call>
+
+		+ my name is *
+		- <call>setname <formal></call>
+
+		+ missing
+		- <call>missing</call>
+
+		+ sandbox
+		- <call>sandbox</call>
+
+		+ fails
+		- <call>fails</call>
+
+		+ ask
+		- <call>ask <id></call>
+	`)
+	if err != nil {
+		t.Fatalf("couldn't load the Lua objects: %s", err)
+	}
+	rs.Quiet = true
+	rs.SortReplies()
+
+	assertReply(t, rs, "reverse hello world", "dlrow olleh")
+	assertReply(t, rs, "my name is alice", "Set Alice")
+	assertReply(t, rs, "missing", "not found")
+	assertReply(t, rs, "sandbox", "nil nil nil")
+	assertReply(t, rs, "fails", "[ERR: Error when executing object]")
+
+	// An object can ask for a reply that calls another object.
+	done := make(chan bool)
+	go func() {
+		assertReply(t, rs, "ask", "detsen")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("an object asking for a reply that calls an object deadlocked")
+	}
+
+	// Syntax errors are reported when loading.
+	if err := rs.Stream("> object broken lua\n\treturn (\n< object"); err == nil {
+		t.Errorf("expected an error loading a broken Lua object")
+	}
+
+	// Objects stop when their context is done.
+	handler := lua.New(rs)
+	handler.Load("loop", []string{"while true do end"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := handler.Call(ctx, "loop", nil); err == nil {
+		t.Errorf("expected the Lua loop to be stopped")
+	}
+
+	// And the VM still works afterwards.
+	handler.Load("hello", []string{`return "hello"`})
+	if reply, err := handler.Call(context.Background(), "hello", nil); reply != "hello" {
+		t.Errorf("expected hello after stopping a loop, got %s (%v)", reply, err)
+	}
+}
+
+func TestGoTemplate(t *testing.T) {
+	rs := rivescript.New(nil)
+	handler := gotemplate.New(rs)
+	handler.Funcs(template.FuncMap{
+		"shout": func(text string) string {
+			return strings.ToUpper(text) + "!"
+		},
+	})
+	rs.SetHandlerV2("gotemplate", handler)
+	err := rs.Stream(`
+		! var name = Aiden
+		! global owner = Noah
+
+		> object greet gotemplate
+			{{if .User.name}}Hello, {{.User.name}}!{{else}}Hi there!{{end}}
+			I am {{.Bot.name}}, made by {{.Global.owner}}.
+		< object
+
+		> object list gotemplate
+			{{range $i, $item := .Args}}{{if $i}}, {{end}}{{shout $item}}{{end}}
+		< object
+
+		> object missing gotemplate
+			[{{.User.nothing}}]
+		< object
+
+		+ hello
+		- <call>greet</call>
+
+		+ my name is *
+		- <set name=<formal>>OK.
+
+		+ list *
+		- <call>list <star></call>
+
+		+ missing
+		- <call>missing</call>
+	`)
+	if err != nil {
+		t.Fatalf("couldn't load the template objects: %s", err)
+	}
+	rs.SortReplies()
+
+	assertReply(t, rs, "hello", "Hi there!\nI am Aiden, made by Noah.")
+	assertReply(t, rs, "my name is alice", "OK.")
+	assertReply(t, rs, "hello", "Hello, Alice!\nI am Aiden, made by Noah.")
+	assertReply(t, rs, "list red green", "RED!, GREEN!")
+	assertReply(t, rs, "missing", "[]")
+
+	// Unknown functions are caught when loading.
+	if err := rs.Stream("> object broken gotemplate\n{{nosuchfunc}}\n< object"); err == nil {
+		t.Errorf("expected an error loading a template with an unknown function")
+	}
+}
+
+// JavaScript objects only get the restricted bot API, unless FullAPI is set.
+func TestJavaScriptBotAPI(t *testing.T) {
+	source := `
+		! var name = Aiden
+		! global owner = Noah
+
+		> object allowed javascript
+			var uid = rs.CurrentUser();
+			rs.SetUservar(uid, "name", args[0]);
+			return rs.GetUservar(uid, "name") + " " + rs.GetVariable("name") + " " +
+				rs.GetGlobal("owner") + " " + rs.LastMatch(uid);
+		< object
+
+		> object reachable javascript
+			var found = [];
+			var names = ["LoadDirectory", "LoadFile", "Stream", "ClearAllUservars",
+				"ClearUservars", "SetHandler", "SetHandlerV2", "SetSubroutine",
+				"SetGlobal", "Reply", "GetAllUservars", "FreezeUservars", "bot", "vm"];
+			for (var i = 0; i < names.length; i++) {
+				if (rs[names[i]] !== undefined) {
+					found.push(names[i]);
+				}
+			}
+			return found.length ? found.join(",") : "none";
+		< object
+
+		> object otheruser javascript
+			rs.SetUservar("bob", "name", "Mallory");
+			return "should not get here";
+		< object
+
+		+ my name is *
+		- <call>allowed <formal></call>
+
+		+ reachable
+		- <call>reachable</call>
+
+		+ other user
+		- <call>otheruser</call>
+	`
+
+	rs := rivescript.New(nil)
+	rs.SetHandlerV2("javascript", javascript.New(rs))
+	rs.Stream(source)
+	rs.SortReplies()
+	rs.Quiet = true
+
+	assertReply(t, rs, "my name is alice", "Alice Aiden Noah my name is *")
+	assertReply(t, rs, "reachable", "none")
+	assertReply(t, rs, "other user", "[ERR: Error when executing object]")
+	if name, _ := rs.GetUservar("bob", "name"); name == "Mallory" {
+		t.Errorf("an object set another user's variable")
+	}
+
+	// With the full API the whole bot is reachable.
+	rs = rivescript.New(nil)
+	rs.SetHandlerV2("javascript", javascript.NewWithConfig(rs, &javascript.Config{
+		FullAPI: true,
+	}))
+	rs.Stream(source)
+	rs.SortReplies()
+
+	reply, _ := rs.Reply("alice", "reachable")
+	if !strings.Contains(reply, "ClearAllUservars") {
+		t.Errorf("expected the full API to be reachable, got: %s", reply)
+	}
+}
+
+// JavaScript objects can log through the bot, use the standard library, and
+// require other objects as libraries.
+func TestJavaScriptStdlib(t *testing.T) {
+	source := `
+		> object greetings javascript
+			var count = 0;
+			return {
+				hello: function(name) {
+					count++;
+					return "Hello, " + name + " (" + count + ")";
+				}
+			};
+		< object
+
+		> object greet javascript
+			var greetings = require("greetings");
+			return greetings.hello(args[0]);
+		< object
+
+		> object missing javascript
+			return require("nosuchobject");
+		< object
+
+		> object user javascript
+			var username = rs.CurrentUser();
+			return {
+				name: function() { return username; }
+			};
+		< object
+
+		> object whoami javascript
+			return require("user").name();
+		< object
+
+		> object logger javascript
+			console.log("hello", args[0], {a: 1});
+			console.warn("careful");
+			return "logged";
+		< object
+
+		> object date javascript
+			return util.formatDate("2006-01-02 15:04", Date.UTC(2020, 0, 2, 3, 4));
+		< object
+
+		> object today javascript
+			return util.formatDate("2006-01-02");
+		< object
+
+		> object dice javascript
+			var rolls = [];
+			for (var i = 0; i < 10; i++) {
+				rolls.push(util.random(6) + 1);
+			}
+			return rolls.join(",") + " " + util.choice(["a", "b", "c"]);
+		< object
+
+		> object json javascript
+			return JSON.stringify(JSON.parse('{"a":[1,2]}'));
+		< object
+
+		+ greet *
+		- <call>greet <star></call> <call>greet again</call>
+
+		+ whoami
+		- <call>whoami</call>
+
+		+ missing
+		- <call>missing</call>
+
+		+ log *
+		- <call>logger <star></call>
+
+		+ date
+		- <call>date</call>
+
+		+ today
+		- <call>today</call>
+
+		+ dice
+		- <call>dice</call>
+
+		+ json
+		- <call>json</call>
+	`
+
+	var output bytes.Buffer
+	newBot := func() *rivescript.RiveScript {
+		output.Reset()
+		rs := rivescript.New(&rivescript.Config{
+			Seed:   42,
+			Logger: log.New(&output, "", 0),
+			Clock: func() time.Time {
+				return time.Date(2021, time.March, 4, 23, 0, 0, 0, time.FixedZone("", -5*60*60))
+			},
+		})
+		rs.SetHandlerV2("javascript", javascript.New(rs))
+		rs.Stream(source)
+		rs.SortReplies()
+		return rs
+	}
+	rs := newBot()
+
+	// Libraries are run once per reply and kept until it's over.
+	assertReply(t, rs, "greet alice", "Hello, alice (1) Hello, again (2)")
+	assertReply(t, rs, "greet bob", "Hello, bob (1) Hello, again (2)")
+
+	// They're run with the API of the reply that required them.
+	for _, username := range []string{"alice", "bob"} {
+		if reply, _ := rs.Reply(username, "whoami"); reply != username {
+			t.Errorf("expected the library to see %s, got %s", username, reply)
+		}
+	}
+	assertReply(t, rs, "missing", "[ERR: Error when executing object]")
+
+	// console.log is a debug message, console.warn is a warning.
+	output.Reset()
+	assertReply(t, rs, "log world", "logged")
+	if got := output.String(); got != "[WARN] [javascript logger] careful\n" {
+		t.Errorf("unexpected log output without debug mode: %q", got)
+	}
+	rs.Debug = true
+	output.Reset()
+	rs.Reply("local-user", "log world")
+	rs.Debug = false
+	if !strings.Contains(output.String(), "[javascript logger] hello world [object Object]\n") {
+		t.Errorf("console.log didn't reach the logger: %q", output.String())
+	}
+
+	assertReply(t, rs, "date", "2020-01-02 03:04")
+	assertReply(t, rs, "today", "2021-03-05")
+	assertReply(t, rs, "json", `{"a":[1,2]}`)
+
+	// Random numbers follow the bot's seed.
+	dice, _ := newBot().Reply("local-user", "dice")
+	if again, _ := newBot().Reply("local-user", "dice"); again != dice {
+		t.Errorf("random numbers didn't follow the seed: %s vs. %s", dice, again)
+	}
+}
+
+// The isolation modes decide which calls share JavaScript global state.
+func TestJavaScriptIsolation(t *testing.T) {
+	counter := []string{
+		`if (typeof counter === "undefined") { counter = 0; }`,
+		`counter++;`,
+		`return counter;`,
+	}
+
+	call := func(js *javascript.JavaScriptHandler) string {
+		reply, err := js.Call(context.Background(), "counter", nil)
+		if err != nil {
+			t.Errorf("error calling the counter: %s", err)
+		}
+		return reply
+	}
+
+	expect := func(mode string, got []string, expected ...string) {
+		if strings.Join(got, ",") != strings.Join(expected, ",") {
+			t.Errorf("%s: expected counters %v, got %v", mode, expected, got)
+		}
+	}
+
+	// A single shared VM counts every call.
+	js := javascript.New(rivescript.New(nil))
+	js.Load("counter", counter)
+	expect("shared", []string{call(js), call(js), call(js)}, "1", "2", "3")
+
+	// A fresh VM for every call starts over each time.
+	js = javascript.NewWithConfig(rivescript.New(nil), &javascript.Config{
+		Isolation: javascript.VMPerCall,
+	})
+	js.Load("counter", counter)
+	expect("per call", []string{call(js), call(js), call(js)}, "1", "1", "1")
+
+	// Objects loaded after VMs were made are available in them.
+	js = javascript.NewWithConfig(rivescript.New(nil), &javascript.Config{
+		PoolSize: 4,
+	})
+	js.Load("counter", counter)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := js.Call(context.Background(), "counter", nil); err != nil {
+				t.Errorf("error calling the counter concurrently: %s", err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// The bot API is bound to the user of each call, even when replies for
+// several users run at once.
+func TestJavaScriptConcurrentUsers(t *testing.T) {
+	rs := rivescript.New(nil)
+	rs.SetHandlerV2("javascript", javascript.NewWithConfig(rs, &javascript.Config{
+		PoolSize: 4,
+	}))
+	rs.Stream(`
+		> object whoami javascript
+			var uid = rs.CurrentUser();
+			rs.SetUservar(uid, "seen", uid);
+			return uid + " " + rs.GetUservar(uid, "seen");
+		< object
+
+		+ who am i
+		- <call>whoami</call>
+	`)
+	rs.SortReplies()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 40; i++ {
+		username := []string{"alice", "bob"}[i%2]
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			reply, err := rs.Reply(username, "who am i")
+			if expect := username + " " + username; err != nil || reply != expect {
+				t.Errorf("expected %q for %s, got %q (%v)", expect, username, reply, err)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Each user gets their own VM in the VMPerUser mode.
+func TestJavaScriptVMPerUser(t *testing.T) {
+	rs := rivescript.New(nil)
+	rs.SetHandlerV2("javascript", javascript.NewWithConfig(rs, &javascript.Config{
+		Isolation: javascript.VMPerUser,
+	}))
+	rs.Stream(`
+		> object counter javascript
+			if (typeof counter === "undefined") { counter = 0; }
+			counter++;
+			return counter;
+		< object
+
+		+ count
+		- <call>counter</call>
+	`)
+	rs.SortReplies()
+
+	for _, step := range []struct {
+		username string
+		expect   string
+	}{
+		{"alice", "1"},
+		{"alice", "2"},
+		{"bob", "1"},
+		{"alice", "3"},
+	} {
+		if reply, _ := rs.Reply(step.username, "count"); reply != step.expect {
+			t.Errorf("expected %s's count to be %s, got %s", step.username, step.expect, reply)
+		}
+	}
+}
+
+// An object that asks for a reply can call objects on the VM it's holding.
+func TestJavaScriptNestedReply(t *testing.T) {
+	for _, isolation := range []javascript.Isolation{javascript.SharedVMs, javascript.VMPerUser} {
+		rs := rivescript.New(nil)
+		rs.SetHandlerV2("javascript", javascript.NewWithConfig(rs, &javascript.Config{
+			Isolation: isolation,
+			FullAPI:   true,
+		}))
+		rs.Stream(`
+			> object ask javascript
+				var user = rs.CurrentUser()[0];
+				return rs.Reply(user, "shout " + args.join(" "))[0] + " from " + user;
+			< object
+
+			> object shout javascript
+				return args.join(" ").toUpperCase();
+			< object
+
+			+ ask *
+			- <call>ask <star></call>
+
+			+ shout *
+			- <call>shout <star></call>
+		`)
+		rs.SortReplies()
+
+		done := make(chan bool)
+		go func() {
+			reply, err := rs.Reply("alice", "ask hello")
+			if err != nil || reply != "HELLO from alice" {
+				t.Errorf("unexpected reply with isolation %d: %s (%v)", isolation, reply, err)
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("an object asking for a reply deadlocked with isolation %d", isolation)
+		}
+	}
+}
+
+// An object that times out while a reply it asked for is running is stopped
+// too, and doesn't hang the VM.
+func TestJavaScriptNestedTimeout(t *testing.T) {
+	rs := rivescript.New(nil)
+	rs.SetHandlerV2("javascript", javascript.NewWithConfig(rs, &javascript.Config{
+		Timeout: 100 * time.Millisecond,
+		FullAPI: true,
+	}))
+	rs.Stream(`
+		> object ask javascript
+			var user = rs.CurrentUser()[0];
+			var reply = rs.Reply(user, args.join(" "))[0];
+			while (true) {}
+		< object
+
+		> object loop javascript
+			while (true) {}
+		< object
+
+		> object quick javascript
+			return "quick";
+		< object
+
+		+ ask *
+		- <call>ask <star></call>
+
+		+ loop
+		- <call>loop</call>
+
+		+ quick
+		- <call>quick</call>
+	`)
+	rs.SortReplies()
+
+	for _, inner := range []string{"loop", "quick"} {
+		done := make(chan bool)
+		go func() {
+			reply, err := rs.Reply("alice", "ask "+inner)
+			if err != nil || reply != "[ERR: Error when executing object]" {
+				t.Errorf("expected the object to time out asking for %s, got %s (%v)", inner, reply, err)
+			}
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("an object that asked for %s never timed out", inner)
+		}
+	}
+
+	assertReply(t, rs, "quick", "quick")
+}
+
+// BenchmarkJavaScript compares the throughput of the isolation modes when
+// objects are called from many goroutines.
+func BenchmarkJavaScript(b *testing.B) {
+	code := []string{
+		`var total = 0;`,
+		`for (var i = 0; i < 100; i++) { total += i; }`,
+		`return args.join(" ") + total;`,
+	}
+
+	for _, bench := range []struct {
+		name   string
+		config javascript.Config
+	}{
+		{"SharedVM", javascript.Config{}},
+		{"Pool4", javascript.Config{PoolSize: 4}},
+		{"Pool16", javascript.Config{PoolSize: 16}},
+		{"VMPerCall", javascript.Config{Isolation: javascript.VMPerCall}},
+		{"VMPerUser", javascript.Config{Isolation: javascript.VMPerUser}},
+	} {
+		config := bench.config
+		b.Run(bench.name, func(b *testing.B) {
+			js := javascript.NewWithConfig(rivescript.New(nil), &config)
+			js.Load("sum", code)
+
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					js.Call(context.Background(), "sum", []string{"total"})
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,168 @@
+package rivescript
+
+// Map user variables.
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// mapPrefix starts the name of the user variable a map is stored in. Like
+// lists, maps are kept apart from the ordinary variables.
+const mapPrefix = "map:"
+
+/*
+decodeMap reads a map from its user variable.
+
+Maps are stored as a JSON object of strings, so every session manager can keep
+them as an ordinary user variable. A variable that isn't set, or that isn't a
+JSON object (set by hand, say), is an empty map.
+*/
+func decodeMap(value string) map[string]string {
+	table := map[string]string{}
+	if value == "" || value == UNDEFINED {
+		return table
+	}
+
+	if json.Unmarshal([]byte(value), &table) != nil || table == nil {
+		return map[string]string{}
+	}
+	return table
+}
+
+// encodeMap writes a map for storing in a user variable.
+func encodeMap(table map[string]string) string {
+	if table == nil {
+		table = map[string]string{}
+	}
+	data, _ := json.Marshal(table)
+	return string(data)
+}
+
+/*
+GetUserMap gets a map variable for a user.
+
+Maps are made with tags like `<mapset name key=value>`, and stored as a JSON
+object in the user variable "map:" + name. A map that isn't set is empty.
+
+Parameters
+
+	username: The user ID to look up the map for.
+	name: The name of the map variable.
+*/
+func (rs *RiveScript) GetUserMap(username, name string) (map[string]string, error) {
+	return rs.session(context.Background(), username).getMap(name)
+}
+
+/*
+SetUserMap sets a map variable for a user.
+
+Parameters
+
+	username: The user ID to set the map for.
+	name: The name of the map variable.
+	table: The keys and values of the map.
+*/
+func (rs *RiveScript) SetUserMap(username, name string, table map[string]string) {
+	rs.session(context.Background(), username).setMap(name, table)
+}
+
+// getMap gets a user's map.
+func (buf *sessionBuffer) getMap(name string) (map[string]string, error) {
+	value, err := buf.get(mapPrefix + name)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	return decodeMap(value), nil
+}
+
+// setMap sets a user's map.
+func (buf *sessionBuffer) setMap(name string, table map[string]string) {
+	buf.set(map[string]string{mapPrefix + name: encodeMap(table)})
+}
+
+// tagMap gets a user's map for a tag; a missing variable is an empty map.
+func tagMap(tag *TagContext, name string) map[string]string {
+	table, _ := tag.buf.getMap(name)
+	return table
+}
+
+// splitMapArgs splits the "name key" arguments of a map tag. The key is the
+// rest of the arguments, and may have spaces in it.
+func splitMapArgs(args string) (name, key string) {
+	parts := strings.SplitN(strings.TrimSpace(args), " ", 2)
+	if len(parts) == 2 {
+		return parts[0], strings.TrimSpace(parts[1])
+	}
+	return parts[0], ""
+}
+
+// tagMapSet handles <mapset name key=value>, which sets a key of a map.
+func tagMapSet(rs *RiveScript, tag *TagContext) string {
+	name, pair := splitMapArgs(tag.Args)
+	key, value, ok := splitTagArgs(pair)
+	if !ok || key == "" {
+		rs.warn("Malformed <mapset> tag: %s %s", tag.Name, tag.Args)
+		return ""
+	}
+
+	table := tagMap(tag, name)
+	table[key] = value
+	tag.buf.setMap(name, table)
+	return ""
+}
+
+// tagMapGet handles <mapget name key>, the value of a key of a map, or
+// "undefined" if the map doesn't have it.
+func tagMapGet(rs *RiveScript, tag *TagContext) string {
+	name, key := splitMapArgs(tag.Args)
+	if value, ok := tagMap(tag, name)[key]; ok {
+		return value
+	}
+	return UNDEFINED
+}
+
+// tagMapDelete handles <mapdelete name key>, which removes a key from a map.
+func tagMapDelete(rs *RiveScript, tag *TagContext) string {
+	name, key := splitMapArgs(tag.Args)
+	table := tagMap(tag, name)
+	if _, ok := table[key]; ok {
+		delete(table, key)
+		tag.buf.setMap(name, table)
+	}
+	return ""
+}
+
+// tagMapHas handles <maphas name key>, which is "true" if the map has the key
+// and "false" if not.
+func tagMapHas(rs *RiveScript, tag *TagContext) string {
+	name, key := splitMapArgs(tag.Args)
+	if _, ok := tagMap(tag, name)[key]; ok {
+		return "true"
+	}
+	return "false"
+}
+
+// tagMapCount handles <mapcount name>, the number of keys in a map.
+func tagMapCount(rs *RiveScript, tag *TagContext) string {
+	return strconv.Itoa(len(tagMap(tag, tag.Args)))
+}
+
+// tagMapKeys handles <mapkeys name> and <mapkeys name=separator>, which give
+// the keys of a map in order, joined by ", " or the separator.
+func tagMapKeys(rs *RiveScript, tag *TagContext) string {
+	name, separator, ok := splitTagArgs(tag.Args)
+	if !ok {
+		separator = ", "
+	}
+
+	keys := []string{}
+	for key := range tagMap(tag, name) {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, separator)
+}
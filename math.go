@@ -0,0 +1,92 @@
+package rivescript
+
+// Decimal math for the math tags and numeric conditions.
+
+import (
+	"math/big"
+	"regexp"
+	"strings"
+)
+
+// Rounding is how math results are rounded to the bot's MathPrecision.
+type Rounding int
+
+// Valid options for Rounding.
+const (
+	// RoundHalfUp rounds halves away from zero, so 2.5 becomes 3 and -2.5
+	// becomes -3.
+	RoundHalfUp Rounding = iota
+
+	// RoundHalfEven rounds halves to the nearest even number, so 2.5 becomes 2
+	// and 3.5 becomes 4. This is also known as banker's rounding.
+	RoundHalfEven
+
+	// RoundDown drops the extra digits, rounding toward zero.
+	RoundDown
+
+	// RoundUp rounds away from zero if there are any extra digits.
+	RoundUp
+)
+
+// defaultMathPrecision is how many decimal places math results keep if the
+// config doesn't say.
+const defaultMathPrecision = 10
+
+// reNumber matches a decimal number.
+var reNumber = regexp.MustCompile(`^[+-]?(\d+\.?\d*|\.\d+)$`)
+
+// parseNumber parses a decimal number, like "12", "-0.5" or "9.99".
+func parseNumber(text string) (*big.Rat, bool) {
+	text = strings.TrimSpace(text)
+	if !reNumber.MatchString(text) {
+		return nil, false
+	}
+	return new(big.Rat).SetString(text)
+}
+
+// roundNumber rounds a number to the given decimal places.
+func roundNumber(value *big.Rat, places int, mode Rounding) *big.Rat {
+	scale := new(big.Int).Exp(big.NewInt(10), big.NewInt(int64(places)), nil)
+	scaled := new(big.Rat).Mul(value, new(big.Rat).SetInt(scale))
+
+	// Split it into the whole part (rounded toward zero) and the rest.
+	whole := new(big.Int).Quo(scaled.Num(), scaled.Denom())
+	rest := new(big.Rat).Sub(scaled, new(big.Rat).SetInt(whole))
+	restAbs := new(big.Rat).Abs(rest)
+	half := big.NewRat(1, 2)
+
+	away := false
+	switch mode {
+	case RoundHalfUp:
+		away = restAbs.Cmp(half) >= 0
+	case RoundHalfEven:
+		cmp := restAbs.Cmp(half)
+		away = cmp > 0 || (cmp == 0 && whole.Bit(0) == 1)
+	case RoundUp:
+		away = rest.Sign() != 0
+	}
+	if away {
+		whole.Add(whole, big.NewInt(int64(scaled.Sign())))
+	}
+
+	return new(big.Rat).SetFrac(whole, scale)
+}
+
+// formatNumber rounds a number with the bot's precision and formats it
+// without trailing zeros, so whole numbers don't have a decimal point.
+func (rs *RiveScript) formatNumber(value *big.Rat) string {
+	places := rs.mathPrecision
+	return trimNumber(roundNumber(value, places, rs.mathRounding).FloatString(places))
+}
+
+// trimNumber removes the trailing zeros after a decimal point.
+func trimNumber(text string) string {
+	if strings.Contains(text, ".") {
+		text = strings.TrimRight(text, "0")
+		text = strings.TrimSuffix(text, ".")
+	}
+	if text == "-0" {
+		text = "0"
+	}
+	return text
+}
@@ -1,5 +1,7 @@
 package rivescript
 
+import "fmt"
+
 // parse loads the RiveScript code into the bot's memory.
 func (rs *RiveScript) parse(path string, lines []string) error {
 	rs.say("Parsing code...")
@@ -74,6 +76,39 @@ func (rs *RiveScript) parse(path string, lines []string) error {
 			trigger.trigger = trig.Trigger
 			trigger.reply = trig.Reply
 			trigger.condition = trig.Condition
+			if isRegexpTrigger(trig.Trigger) {
+				pattern, err := compileRegexpTrigger(trig.Trigger)
+				if err != nil {
+					err = fmt.Errorf("invalid regular expression trigger '%s' in %s: %s",
+						trig.Trigger, path, err)
+					if rs.Strict {
+						return err
+					}
+					rs.warn("%s", err)
+					continue
+				}
+				trigger.regexp = pattern
+			} else if err := checkStarNames(trig.Trigger); err != nil {
+				err = fmt.Errorf("invalid trigger '%s' in %s: %s", trig.Trigger, path, err)
+				if rs.Strict {
+					return err
+				}
+				rs.warn("%s", err)
+				continue
+			}
+			for _, line := range trig.Condition {
+				cond, err := parseCondition(line, rs.conditionCase)
+				if err != nil {
+					err = fmt.Errorf("invalid condition for trigger '%s' in %s: %s (condition: %s)",
+						trig.Trigger, path, err, line)
+					if rs.Strict {
+						return err
+					}
+					rs.warn("%s", err)
+					continue
+				}
+				trigger.conditions = append(trigger.conditions, cond)
+			}
 			trigger.redirect = trig.Redirect
 			trigger.previous = trig.Previous
 
@@ -86,7 +121,16 @@ func (rs *RiveScript) parse(path string, lines []string) error {
 		// Have a language handler for this?
 		if _, ok := rs.handlers[object.Language]; ok {
 			rs.say("Loading object macro %s (%s)", object.Name, object.Language)
-			rs.handlers[object.Language].Load(object.Name, object.Code)
+			err := rs.handlers[object.Language].Load(object.Name, object.Code)
+			if err != nil {
+				err = fmt.Errorf("failed to load object macro %s (%s) in %s: %s",
+					object.Name, object.Language, path, err)
+				if rs.Strict {
+					return err
+				}
+				rs.warn("%s", err)
+				continue
+			}
 			rs.objlangs[object.Name] = object.Language
 		}
 	}
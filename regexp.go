@@ -15,8 +15,11 @@ var (
 	reReplyArray    = regexp.MustCompile(`\(@([A-Za-z0-9_]+)\)`)
 	reBotvars       = regexp.MustCompile(`<bot (.+?)>`)
 	reUservars      = regexp.MustCompile(`<get (.+?)>`)
-	reInput         = regexp.MustCompile(`<input([1-9])>`)
-	reReply         = regexp.MustCompile(`<reply([1-9])>`)
+	reNamedStar     = regexp.MustCompile(`<star ([A-Za-z0-9_]+)>`)
+	reStarName      = regexp.MustCompile(`([*#_])\{([A-Za-z][A-Za-z0-9_]*)\}`)
+	reEntity        = regexp.MustCompile(`<([a-z][a-z0-9]*)>(?:\{([A-Za-z][A-Za-z0-9_]*)\})?`)
+	reInput         = regexp.MustCompile(`<input(\d*)>`)
+	reReply         = regexp.MustCompile(`<reply(\d*)>`)
 	reRandom        = regexp.MustCompile(`\{random\}(.+?)\{/random\}`)
 
 	// Self-contained tags like <set> that contain no nested tag.
@@ -0,0 +1,1176 @@
+package rivescript_test
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	rivescript "github.com/aichaos/rivescript-go"
+	"github.com/aichaos/rivescript-go/sessions"
+	"github.com/aichaos/rivescript-go/sessions/memory"
+)
+
+// The <input> and <reply> tags reach as far back as the HistorySize.
+func TestHistorySize(t *testing.T) {
+	source := `
+		+ message #
+		- Reply <star>.
+
+		+ recall
+		- <input10>/<reply10>, <input12>/<reply12>, <input13>/<reply13>
+	`
+
+	bot := rivescript.New(&rivescript.Config{
+		Strict:      true,
+		HistorySize: 12,
+	})
+	bot.Stream(source)
+	bot.SortReplies()
+
+	// The default bot only remembers the last nine.
+	small := rivescript.New(nil)
+	small.Stream(source)
+	small.SortReplies()
+
+	for i := 1; i <= 13; i++ {
+		message := fmt.Sprintf("message %d", i)
+		assertReply(t, bot, message, fmt.Sprintf("Reply %d.", i))
+		assertReply(t, small, message, fmt.Sprintf("Reply %d.", i))
+	}
+
+	assertReply(t, bot, "recall", "message 4/Reply 4., message 2/Reply 2., undefined/undefined")
+	assertReply(t, small, "recall", "undefined/undefined, undefined/undefined, undefined/undefined")
+}
+
+// Concurrent replies for the same user mustn't lose each other's updates
+// when LockUsers is on.
+func TestLockUsers(t *testing.T) {
+	bot := rivescript.New(&rivescript.Config{
+		Strict:    true,
+		LockUsers: true,
+	})
+	bot.Stream(`
+		+ click
+		- <add clicks=1>Clicked.
+	`)
+	bot.SortReplies()
+	bot.SetUservar("alice", "clicks", "0")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bot.Reply("alice", "click")
+		}()
+	}
+	wg.Wait()
+
+	if clicks, _ := bot.GetUservar("alice", "clicks"); clicks != "50" {
+		t.Errorf("expected 50 clicks, got %s", clicks)
+	}
+}
+
+// countingStore counts the writes that reach the session manager.
+type countingStore struct {
+	*memory.MemoryStore
+	sets    int
+	updates int
+}
+
+func (s *countingStore) Set(username string, vars map[string]string) {
+	s.sets++
+	s.MemoryStore.Set(username, vars)
+}
+
+func (s *countingStore) Update(username string, update sessions.Update) error {
+	s.updates++
+	return s.MemoryStore.Update(username, update)
+}
+
+// legacyStore is a session manager written before sessions.HistoryAdder and
+// sessions.Updater, which only has the SessionManager methods.
+type legacyStore struct {
+	sessions.SessionManager
+	inputs []string
+}
+
+func (s *legacyStore) AddHistory(username, input, reply string) {
+	s.inputs = append(s.inputs, input)
+	s.SessionManager.AddHistory(username, input, reply)
+}
+
+// Session managers with the original AddHistory() still get the history.
+func TestLegacyHistory(t *testing.T) {
+	store := &legacyStore{SessionManager: memory.New()}
+	bot := rivescript.New(&rivescript.Config{SessionManager: store})
+	bot.Stream(`
+		+ hello
+		- Hi!
+	`)
+	bot.SortReplies()
+
+	assertReply(t, bot, "hello", "Hi!")
+	if len(store.inputs) != 1 || store.inputs[0] != "hello" {
+		t.Errorf("expected the history to be added with AddHistory(), got %v", store.inputs)
+	}
+	if history, _ := store.GetHistory("local-user"); history.Reply(1) != "Hi!" {
+		t.Errorf("the history wasn't saved: %v", history.Entries)
+	}
+}
+
+// A reply's session changes are saved in one batch at the end.
+func TestSessionBuffer(t *testing.T) {
+	store := &countingStore{MemoryStore: memory.New()}
+	bot := rivescript.New(&rivescript.Config{
+		Strict:         true,
+		SessionManager: store,
+	})
+	bot.SetSubroutineV2("peek", func(rs *rivescript.RiveScript, call *rivescript.CallContext) (*rivescript.CallResult, error) {
+		// Object macros with the reply's context see the changes made so far
+		// in the reply.
+		value, _ := rs.GetUservarContext(call.Context(), "alice", "name")
+		rs.SetUservarContext(call.Context(), "alice", "seen", value)
+		return &rivescript.CallResult{Reply: value}, nil
+	})
+	bot.SetSubroutine("mark", func(rs *rivescript.RiveScript, args []string) string {
+		// Without the context, it's the session manager they use.
+		value, _ := rs.GetUservar("alice", "name")
+		rs.SetUservar("alice", "marked", "yes:"+value)
+		return ""
+	})
+	bot.Stream(`
+		+ my name is *
+		- <set name=<formal>><set age=5><add age=1>{topic=named}
+		^ Hi <call>peek</call>, you're <get age>.<call>mark</call>
+
+		> topic named
+			+ *
+			- You are <get name>.
+		< topic
+
+		+ deep
+		@ deep
+	`)
+	bot.SortReplies()
+
+	reply, err := bot.Reply("alice", "my name is alice")
+	if err != nil || reply != "Hi Alice, you're 6." {
+		t.Errorf("unexpected reply: %s (%v)", reply, err)
+	}
+	if store.sets != 1 || store.updates != 1 {
+		t.Errorf("expected one update and one set, got %d and %d", store.updates, store.sets)
+	}
+
+	for name, expect := range map[string]string{
+		"name":   "Alice",
+		"age":    "6",
+		"topic":  "named",
+		"seen":   "Alice",
+		"marked": "yes:",
+	} {
+		if value, _ := store.Get("alice", name); value != expect {
+			t.Errorf("expected %s to be saved as %s, got %s", name, expect, value)
+		}
+	}
+	if history, _ := store.GetHistory("alice"); history.Input(1) != "my name is alice" {
+		t.Errorf("the history wasn't saved: %v", history.Entries)
+	}
+	if lastMatch, _ := store.GetLastMatch("alice"); lastMatch != "my name is *" {
+		t.Errorf("the last match wasn't saved: %s", lastMatch)
+	}
+
+	// Changes from a failed reply are thrown away.
+	store.updates = 0
+	if _, err := bot.Reply("bob", "deep"); err == nil {
+		t.Errorf("expected a deep recursion error")
+	}
+	if store.updates != 0 {
+		t.Errorf("expected the failed reply not to be saved")
+	}
+}
+
+// A reply that an object macro asks for during another reply for the same
+// user is part of it: it sees its changes, and is saved along with it.
+func TestNestedReply(t *testing.T) {
+	store := &countingStore{MemoryStore: memory.New()}
+	bot := rivescript.New(&rivescript.Config{
+		Strict:         true,
+		LockUsers:      true,
+		SessionManager: store,
+	})
+	bot.SetSubroutineV2("ask", func(rs *rivescript.RiveScript, call *rivescript.CallContext) (*rivescript.CallResult, error) {
+		reply, err := rs.ReplyContext(call.Context(), call.Username, call.Raw)
+		if err != nil {
+			return &rivescript.CallResult{Reply: "error"}, nil
+		}
+		return &rivescript.CallResult{Reply: reply}, nil
+	})
+	bot.Stream(`
+		+ outer
+		- <set outer=yes><call>ask inner</call> <call>ask fail</call>
+
+		+ inner
+		- <set inner=<get outer>>ok
+
+		+ fail
+		@ fail<set broken=yes>
+	`)
+	bot.SortReplies()
+
+	reply, err := bot.Reply("alice", "outer")
+	if err != nil || reply != "ok error" {
+		t.Errorf("unexpected reply: %s (%v)", reply, err)
+	}
+	if store.updates != 1 {
+		t.Errorf("expected the nested reply to be saved with the outer one, got %d updates", store.updates)
+	}
+	for name, expect := range map[string]string{
+		"outer":  "yes",
+		"inner":  "yes",
+		"broken": "",
+	} {
+		if value, _ := store.Get("alice", name); value != expect {
+			t.Errorf("expected %s to be saved as %q, got %q", name, expect, value)
+		}
+	}
+
+	// Each reply reports the trigger it matched itself.
+	var inner *rivescript.ReplyInfo
+	bot.SetSubroutineV2("info", func(rs *rivescript.RiveScript, call *rivescript.CallContext) (*rivescript.CallResult, error) {
+		var err error
+		inner, err = rs.ReplyWithInfoContext(call.Context(), call.Username, call.Raw)
+		return &rivescript.CallResult{Reply: "asked"}, err
+	})
+	bot.Stream(`
+		+ outer *
+		- <call>info inner <star></call>
+
+		+ inner *
+		- ok
+	`)
+	bot.SortReplies()
+
+	info, err := bot.ReplyWithInfo("alice", "outer one")
+	if err != nil || info.Reply != "asked" || info.Trigger != "outer *" || strings.Join(info.Stars, ",") != "one" {
+		t.Errorf("unexpected outer reply info: %+v (%v)", info, err)
+	}
+	if inner == nil || inner.Reply != "ok" || inner.Trigger != "inner *" || strings.Join(inner.Stars, ",") != "one" {
+		t.Errorf("unexpected inner reply info: %+v", inner)
+	}
+}
+
+// Concurrent replies for the same user are saved or thrown away on their own.
+func TestConcurrentReplies(t *testing.T) {
+	bot := rivescript.New(&rivescript.Config{Strict: true})
+	waiting := make(chan bool)
+	release := make(chan bool)
+	bot.SetSubroutine("wait", func(rs *rivescript.RiveScript, args []string) string {
+		waiting <- true
+		<-release
+		return ""
+	})
+	bot.Stream(`
+		+ slow
+		- <set slow=yes><call>wait</call>Done.
+
+		+ slow fail
+		@ <set slow=yes><call>wait</call>fail
+
+		+ quick
+		- <set quick=yes>Done.
+
+		+ fail
+		@ fail<set broken=yes>
+	`)
+	bot.SortReplies()
+
+	tests := []struct {
+		slow, quick string
+		slowErr     bool
+		quickErr    bool
+		slowVar     string
+		quickVar    string
+	}{
+		{"slow", "fail", false, true, "yes", ""},
+		{"slow fail", "quick", true, false, "", "yes"},
+	}
+	for i, test := range tests {
+		username := fmt.Sprintf("user%d", i)
+		errs := make(chan error)
+		go func() {
+			_, err := bot.Reply(username, test.slow)
+			errs <- err
+		}()
+
+		// Finish the second reply while the first is waiting.
+		<-waiting
+		if _, err := bot.Reply(username, test.quick); (err != nil) != test.quickErr {
+			t.Errorf("%s: unexpected error from %q: %v", username, test.quick, err)
+		}
+		release <- true
+		if err := <-errs; (err != nil) != test.slowErr {
+			t.Errorf("%s: unexpected error from %q: %v", username, test.slow, err)
+		}
+
+		vars, _ := bot.GetUservars(username)
+		if vars.Variables["slow"] != test.slowVar || vars.Variables["quick"] != test.quickVar {
+			t.Errorf("%s: unexpected variables: %v", username, vars.Variables)
+		}
+		if _, ok := vars.Variables["broken"]; ok {
+			t.Errorf("%s: a failed reply's variables were saved", username)
+		}
+	}
+}
+
+// CurrentUser() doesn't guess when replies for several users are running.
+func TestCurrentUser(t *testing.T) {
+	bot := rivescript.New(&rivescript.Config{Strict: true})
+	waiting := make(chan bool)
+	release := make(chan bool)
+	bot.SetSubroutine("wait", func(rs *rivescript.RiveScript, args []string) string {
+		waiting <- true
+		<-release
+		return ""
+	})
+	bot.SetSubroutine("whoami", func(rs *rivescript.RiveScript, args []string) string {
+		username, err := rs.CurrentUser()
+		if err != nil {
+			return "unknown"
+		}
+		return username
+	})
+	bot.Stream(`
+		+ slow
+		- <call>wait</call>Done.
+
+		+ who am i
+		- <call>whoami</call>
+	`)
+	bot.SortReplies()
+
+	if _, err := bot.CurrentUser(); err == nil {
+		t.Errorf("expected an error outside of a reply")
+	}
+	assertReply(t, bot, "who am i", "local-user")
+
+	done := make(chan bool)
+	go func() {
+		bot.Reply("alice", "slow")
+		done <- true
+	}()
+	<-waiting
+	if reply, _ := bot.Reply("bob", "who am i"); reply != "unknown" {
+		t.Errorf("expected CurrentUser() not to guess between two users, got %q", reply)
+	}
+	release <- true
+	<-done
+}
+
+// Registered tags nest with each other and with the built-in tags.
+func TestRegisterTag(t *testing.T) {
+	bot := rivescript.New(nil)
+	bot.RegisterTag("reverse", func(rs *rivescript.RiveScript, tag *rivescript.TagContext) string {
+		runes := []rune(tag.Args)
+		for i, j := 0, len(runes)-1; i < j; i, j = i+1, j-1 {
+			runes[i], runes[j] = runes[j], runes[i]
+		}
+		return string(runes)
+	})
+	bot.RegisterTag("Shout", func(rs *rivescript.RiveScript, tag *rivescript.TagContext) string {
+		return strings.ToUpper(tag.Args) + "!"
+	})
+	bot.Stream(`
+		+ my name is *
+		- <set name=<formal>><set backwards=<reverse <get name>>>Hi, <shout <get name>>
+
+		+ backwards
+		- <get backwards> <reverse <shout <star>>>
+
+		+ unknown
+		- <unknown tag> <add count=2><get count>
+
+		+ double *
+		- <set n=<star>><mult n=2><get n>
+	`)
+	bot.SortReplies()
+
+	assertReply(t, bot, "my name is alice", "Hi, ALICE!")
+	assertReply(t, bot, "backwards", "ecilA !DENIFEDNU")
+	assertReply(t, bot, "unknown", "<unknown tag> 2")
+	assertReply(t, bot, "double 21", "42")
+
+	// Built-in tags can be replaced or deleted.
+	bot.RegisterTag("get", func(rs *rivescript.RiveScript, tag *rivescript.TagContext) string {
+		return "[" + tag.Args + "]"
+	})
+	assertReply(t, bot, "double 5", "[n]")
+	bot.DeleteTag("reverse")
+	assertReply(t, bot, "backwards", "[backwards] <reverse UNDEFINED!>")
+}
+
+// Conditions can be combined with and, or, not and parentheses.
+func TestCompoundConditions(t *testing.T) {
+	bot := rivescript.New(nil)
+	bot.Stream(`
+		+ can i drink
+		* <get age> >= 21 and <get country> == us => Yes, you can.
+		* <get age> >= 18 and not <get country> == us => Yes, you can here.
+		* (<get country> == us or <get country> == ca) and <get age> < 18 => Not for years.
+		* not (<get age> < 18 or <get age> == undefined) => Not in <get country>.
+		- I don't know your age.
+
+		+ i am # in *
+		- <set age=<star1>><set country=<star2>>OK.
+	`)
+	bot.SortReplies()
+	bot.Quiet = true
+
+	assertReply(t, bot, "can i drink", "I don't know your age.")
+	for _, test := range []struct{ age, country, expected string }{
+		{"25", "us", "Yes, you can."},
+		{"19", "us", "Not in us."},
+		{"19", "uk", "Yes, you can here."},
+		{"16", "ca", "Not for years."},
+		{"16", "uk", "I don't know your age."},
+	} {
+		assertReply(t, bot, "i am "+test.age+" in "+test.country, "OK.")
+		assertReply(t, bot, "can i drink", test.expected)
+	}
+
+	// Mistakes are caught when the condition is loaded.
+	for _, condition := range []string{
+		"(<get age> >= 18 and) => Missing a comparison.",
+		"(<get age> >= 18 => Missing a parenthesis.",
+		"<get age> 18 => Missing an operator.",
+		"<get age> >= 18 or or <get age> < 5 => Doubled or.",
+		"<get age> >= 18",
+	} {
+		strict := rivescript.New(&rivescript.Config{Strict: true})
+		err := strict.Stream("+ test\n* " + condition + "\n- Default.")
+		if err == nil {
+			t.Errorf("expected an error loading condition: %s", condition)
+		}
+	}
+}
+
+// Values can have the keywords of compound conditions in them, in quotes or
+// in a condition written the old way, as one comparison.
+func TestConditionKeywordValues(t *testing.T) {
+	bot := rivescript.New(nil)
+	err := bot.Stream(`
+		+ how sure
+		* <get answer> == not sure => You're not sure.
+		* <get answer> eq rock and roll => Rock and roll!
+		* <get answer> == (maybe) => Maybe.
+		* <get answer> == "this or that" and <get ready> == "" => Not ready.
+		* <get answer> == "this or that" or <get answer> == "and" => Make up your mind.
+		- You're sure.
+
+		+ get ready
+		- <set ready=yes>OK.
+	`)
+	if err != nil {
+		t.Fatalf("error loading the conditions: %s", err)
+	}
+	bot.SortReplies()
+
+	for _, test := range []struct{ answer, expected string }{
+		{"not sure", "You're not sure."},
+		{"rock and roll", "Rock and roll!"},
+		{"(maybe)", "Maybe."},
+		{"this or that", "Not ready."},
+		{"and", "Make up your mind."},
+		{"yes", "You're sure."},
+	} {
+		bot.SetUservar("local-user", "answer", test.answer)
+		assertReply(t, bot, "how sure", test.expected)
+	}
+
+	bot.SetUservar("local-user", "answer", "this or that")
+	assertReply(t, bot, "get ready", "OK.")
+	assertReply(t, bot, "how sure", "Make up your mind.")
+}
+
+// Double quotes around a value in a condition aren't part of it, even in a
+// condition written before they meant anything, where they used to be.
+func TestConditionQuotes(t *testing.T) {
+	bot := rivescript.New(nil)
+	err := bot.Stream(`
+		+ are you sure
+		* "yes" == <get answer> => You're sure.
+		* <get answer> == "no" => You're not sure.
+		- Make up your mind.
+	`)
+	if err != nil {
+		t.Fatalf("error loading the conditions: %s", err)
+	}
+	bot.SortReplies()
+
+	for _, test := range []struct{ answer, expected string }{
+		{"yes", "You're sure."},
+		{"no", "You're not sure."},
+		{`"yes"`, "Make up your mind."},
+		{`"no"`, "Make up your mind."},
+	} {
+		bot.SetUservar("local-user", "answer", test.answer)
+		assertReply(t, bot, "are you sure", test.expected)
+	}
+}
+
+// The math tags can work with decimals, and numeric conditions always do.
+func TestDecimalMath(t *testing.T) {
+	source := `
+		+ add price
+		- <add total=1.5><get total>
+
+		+ add tax
+		- <add total=0.12><get total>
+
+		+ halve
+		- <div total=2><get total>
+
+		+ divide by zero
+		- <div total=0>
+
+		+ thirds
+		- <div total=3><get total>
+
+		+ mod
+		- <mod total=1><get total>
+
+		+ min
+		- <min total=0.25><get total>
+
+		+ max
+		- <max total=7><get total>
+
+		+ round
+		- <round total><get total>
+
+		+ round cents
+		- <round total=2><get total>
+
+		+ can i afford it
+		* <get total> > 9.99 => No.
+		- Yes.
+	`
+	newBot := func(cfg *rivescript.Config) *rivescript.RiveScript {
+		bot := rivescript.New(cfg)
+		bot.Stream(source)
+		bot.SortReplies()
+		return bot
+	}
+	set := func(bot *rivescript.RiveScript, value string) {
+		bot.SetUservar("local-user", "total", value)
+	}
+
+	bot := newBot(&rivescript.Config{MathDecimal: true})
+	assertReply(t, bot, "add price", "1.5")
+	assertReply(t, bot, "add tax", "1.62")
+	assertReply(t, bot, "can i afford it", "Yes.")
+	set(bot, "9.99")
+	assertReply(t, bot, "can i afford it", "Yes.")
+	set(bot, "10")
+	assertReply(t, bot, "can i afford it", "No.")
+	assertReply(t, bot, "halve", "5")
+	assertReply(t, bot, "halve", "2.5")
+	assertReply(t, bot, "divide by zero", "[ERR: Can't Divide By Zero]")
+	assertReply(t, bot, "mod", "0.5")
+	set(bot, "-2.5")
+	assertReply(t, bot, "mod", "-0.5")
+	assertReply(t, bot, "min", "-0.5")
+	assertReply(t, bot, "max", "7")
+	set(bot, "7")
+	assertReply(t, bot, "thirds", "2.3333333333")
+	assertReply(t, bot, "round cents", "2.33")
+	set(bot, "-2.5")
+	assertReply(t, bot, "round", "-3")
+	set(bot, "abc")
+	assertReply(t, bot, "add price", "[ERR: Math can't add non-numeric user variable total]abc")
+
+	// The precision and rounding are configurable.
+	precision := 2
+	bot = newBot(&rivescript.Config{
+		MathDecimal:   true,
+		MathPrecision: &precision,
+		MathRounding:  rivescript.RoundHalfEven,
+	})
+	set(bot, "2")
+	assertReply(t, bot, "thirds", "0.67")
+	set(bot, "2.5")
+	assertReply(t, bot, "round", "2")
+	set(bot, "0.125")
+	assertReply(t, bot, "round cents", "0.12")
+
+	// Zero decimal places, with rounding.
+	precision = 0
+	bot = newBot(&rivescript.Config{
+		MathDecimal:   true,
+		MathPrecision: &precision,
+	})
+	set(bot, "11")
+	assertReply(t, bot, "halve", "6")
+
+	// The old integer math by default, where only whole numbers work, but
+	// conditions still compare decimals.
+	bot = newBot(nil)
+	set(bot, "11")
+	assertReply(t, bot, "halve", "5")
+	set(bot, "-11")
+	assertReply(t, bot, "halve", "-5")
+	assertReply(t, bot, "add price", "[ERR: Math can't add non-numeric value 1.5]-5")
+	assertReply(t, bot, "mod", "0")
+	assertReply(t, bot, "max", "7")
+	set(bot, "2.5")
+	assertReply(t, bot, "halve", "[ERR: Math can't div non-numeric user variable total]2.5")
+	set(bot, "10.5")
+	assertReply(t, bot, "can i afford it", "No.")
+	set(bot, "9.5")
+	assertReply(t, bot, "can i afford it", "Yes.")
+}
+
+// Conditions can compare strings, match regular expressions and check
+// arrays, ignoring case by default.
+func TestStringConditions(t *testing.T) {
+	source := `
+		! array colors = red|green|blue|light blue
+
+		+ check
+		* <get thing> in @colors => A color.
+		* <get thing> contains berry => A berry.
+		* <get thing> startswith pine => A tree, or a fruit.
+		* <get thing> endswith fish => A fish.
+		* <get thing> matches ^[0-9]+$ => A number.
+		* not <get thing> matches <bot pattern> => Not a bot word.
+		- Something else.
+	`
+	newBot := func(cfg *rivescript.Config) *rivescript.RiveScript {
+		bot := rivescript.New(cfg)
+		bot.SetVariable("pattern", "^bot")
+		bot.Stream(source)
+		bot.SortReplies()
+		return bot
+	}
+
+	bot := newBot(nil)
+	for _, test := range []struct{ thing, expected string }{
+		{"Light Blue", "A color."},
+		{"Blueberry", "A berry."},
+		{"PineApple", "A tree, or a fruit."},
+		{"swordfish", "A fish."},
+		{"12345", "A number."},
+		{"cats", "Not a bot word."},
+		{"Bots", "Something else."},
+	} {
+		bot.SetUservar("local-user", "thing", test.thing)
+		assertReply(t, bot, "check", test.expected)
+	}
+
+	// Case sensitive mode.
+	bot = newBot(&rivescript.Config{CaseSensitiveConditions: true})
+	bot.SetUservar("local-user", "thing", "Light Blue")
+	assertReply(t, bot, "check", "Not a bot word.")
+	bot.SetUservar("local-user", "thing", "bots")
+	assertReply(t, bot, "check", "Something else.")
+
+	// The word operators are only operators where one is expected, and a
+	// pattern is the rest of the condition unless it's in quotes.
+	bot = rivescript.New(nil)
+	err := bot.Stream(`
+		+ status
+		* <get status> == logged in => Welcome back.
+		* <get status> == signed  up and <get thing> endswith in => Signed up and in.
+		* <get status> matches "^(new|guest)$" and <get thing> == in => New, and in.
+		* <get status> matches ^(yes|no)( thanks)?$ => An answer.
+		- Unknown.
+	`)
+	if err != nil {
+		t.Fatalf("error loading the conditions: %s", err)
+	}
+	bot.SortReplies()
+	for _, test := range []struct{ status, thing, expected string }{
+		{"logged in", "", "Welcome back."},
+		{"signed  up", "built in", "Signed up and in."},
+		{"signed up", "built in", "Unknown."},
+		{"Guest", "in", "New, and in."},
+		{"guest", "out", "Unknown."},
+		{"no thanks", "", "An answer."},
+		{"maybe", "", "Unknown."},
+	} {
+		bot.SetUservar("local-user", "status", test.status)
+		bot.SetUservar("local-user", "thing", test.thing)
+		assertReply(t, bot, "status", test.expected)
+	}
+
+	// Mistakes are caught when the condition is loaded.
+	for _, condition := range []string{
+		"<get thing> in colors => Not an array.",
+		"<get thing> matches [a-z => Bad regexp.",
+	} {
+		strict := rivescript.New(&rivescript.Config{Strict: true})
+		err := strict.Stream("+ test\n* " + condition + "\n- Default.")
+		if err == nil {
+			t.Errorf("expected an error loading condition: %s", condition)
+		}
+	}
+}
+
+// The date and time tags use the bot's clock and the user's time zone.
+func TestDateTimeTags(t *testing.T) {
+	clock := time.Date(2020, time.December, 20, 14, 30, 0, 0, time.UTC)
+	bot := rivescript.New(&rivescript.Config{
+		Clock: func() time.Time { return clock },
+	})
+	bot.Stream(`
+		+ what day is it
+		- It's <date>.
+
+		+ what time is it
+		- It's <time>.
+
+		+ timestamp
+		- <date 2006-01-02 15:04> <time %Y-%m-%d %H:%M %% %q>
+
+		+ hello
+		- Good <timeofday>!
+
+		+ how long until christmas
+		- <daysuntil 12-25> days, and it's been <dayssince 2020-01-01> days this year.
+
+		+ how long since the summer
+		- <dayssince 07-01> days.
+
+		+ bad date
+		- <daysuntil tomorrow>
+	`)
+	bot.SortReplies()
+
+	assertReply(t, bot, "what day is it", "It's Sunday, December 20, 2020.")
+	assertReply(t, bot, "what time is it", "It's 2:30 PM.")
+	assertReply(t, bot, "timestamp", "2020-12-20 14:30 2020-12-20 14:30 % %q")
+	assertReply(t, bot, "hello", "Good afternoon!")
+	assertReply(t, bot, "how long until christmas", "5 days, and it's been 354 days this year.")
+	assertReply(t, bot, "how long since the summer", "172 days.")
+	assertReply(t, bot, "bad date", "[ERR: can't parse date tomorrow]")
+
+	// The user's time zone, or the bot's.
+	bot.SetVariable("timezone", "Asia/Tokyo")
+	assertReply(t, bot, "what time is it", "It's 11:30 PM.")
+	assertReply(t, bot, "hello", "Good night!")
+	bot.SetUservar("local-user", "timezone", "America/New_York")
+	assertReply(t, bot, "what time is it", "It's 9:30 AM.")
+	assertReply(t, bot, "hello", "Good morning!")
+
+	// After Christmas, it's next year's.
+	clock = time.Date(2020, time.December, 26, 12, 0, 0, 0, time.UTC)
+	assertReply(t, bot, "how long until christmas", "364 days, and it's been 360 days this year.")
+
+	// The history and object macros use the same clock.
+	if now := bot.Now(); !now.Equal(clock) {
+		t.Errorf("expected Now() to be %s, got %s", clock, now)
+	}
+	data, _ := bot.GetUservars("local-user")
+	if when := data.History.Entries[0].Time; !when.Equal(clock) {
+		t.Errorf("expected the history to be timestamped %s, got %s", clock, when)
+	}
+}
+
+// List variables can be built and read with tags, and from Go.
+func TestUserLists(t *testing.T) {
+	bot := rivescript.New(&rivescript.Config{Seed: 1})
+	bot.Stream(`
+		+ add * to my list
+		- <push shopping=<star>>You have <count shopping> things on your list.
+
+		+ remove * from my list
+		- <remove shopping=<star>>OK.
+
+		+ what is on my list
+		- <join shopping>.
+
+		+ what is on my list with and
+		- <join shopping= and >.
+
+		+ is * on my list
+		* <has shopping=<star>> == true => Yes.
+		- No.
+
+		+ undo
+		- Removed <pop shopping>.
+
+		+ pick one
+		- <pick shopping>
+	`)
+	bot.SortReplies()
+
+	assertReply(t, bot, "undo", "Removed undefined.")
+	assertReply(t, bot, "add milk to my list", "You have 1 things on your list.")
+	assertReply(t, bot, "add eggs to my list", "You have 2 things on your list.")
+	assertReply(t, bot, "add bread to my list", "You have 3 things on your list.")
+	assertReply(t, bot, "what is on my list", "milk, eggs, bread.")
+	assertReply(t, bot, "what is on my list with and", "milk and eggs and bread.")
+	assertReply(t, bot, "is eggs on my list", "Yes.")
+	assertReply(t, bot, "remove eggs from my list", "OK.")
+	assertReply(t, bot, "is eggs on my list", "No.")
+	assertReply(t, bot, "undo", "Removed bread.")
+	assertReply(t, bot, "pick one", "milk")
+
+	// The list is a JSON array in a user variable of its own.
+	if value, _ := bot.GetUservar("local-user", "list:shopping"); value != `["milk"]` {
+		t.Errorf("unexpected stored list: %s", value)
+	}
+	if _, err := bot.GetUservar("local-user", "shopping"); err == nil {
+		t.Errorf("expected the list to be kept apart from the shopping variable")
+	}
+	bot.SetUserList("local-user", "shopping", []string{"a, b", "c"})
+	list, err := bot.GetUserList("local-user", "shopping")
+	if err != nil || strings.Join(list, "|") != "a, b|c" {
+		t.Errorf("unexpected list: %q %v", list, err)
+	}
+
+	// An ordinary variable is never a list, even if it looks like one.
+	bot.SetUservar("local-user", "shopping", `["cheese"]`)
+	assertReply(t, bot, "add jam to my list", "You have 3 things on your list.")
+	assertReply(t, bot, "what is on my list", "a, b, c, jam.")
+	if value, _ := bot.GetUservar("local-user", "shopping"); value != `["cheese"]` {
+		t.Errorf("the shopping variable was changed: %s", value)
+	}
+}
+
+// Map variables can be built and read with tags, and from Go.
+func TestUserMaps(t *testing.T) {
+	bot := rivescript.New(nil)
+	bot.Stream(`
+		+ my * is called *
+		- <mapset pets <star1>={formal}<star2>{/formal}>You have <mapcount pets> pets.
+
+		+ what is my * called
+		* <maphas pets <star>> == true => Your <star> is <mapget pets <star>>.
+		- You don't have a <star>.
+
+		+ forget my *
+		- <mapdelete pets <star>>OK.
+
+		+ what pets do i have
+		- <mapkeys pets>.
+
+		+ list my pets
+		- <mapkeys pets= and >.
+	`)
+	bot.SortReplies()
+
+	assertReply(t, bot, "what is my dog called", "You don't have a dog.")
+	assertReply(t, bot, "my dog is called rex", "You have 1 pets.")
+	assertReply(t, bot, "my cat is called tom", "You have 2 pets.")
+	assertReply(t, bot, "my cat is called felix", "You have 2 pets.")
+	assertReply(t, bot, "what is my cat called", "Your cat is Felix.")
+	assertReply(t, bot, "what pets do i have", "cat, dog.")
+	assertReply(t, bot, "list my pets", "cat and dog.")
+	assertReply(t, bot, "forget my cat", "OK.")
+	assertReply(t, bot, "what is my cat called", "You don't have a cat.")
+
+	// The map is a JSON object in a user variable of its own.
+	if value, _ := bot.GetUservar("local-user", "map:pets"); value != `{"dog":"Rex"}` {
+		t.Errorf("unexpected stored map: %s", value)
+	}
+	bot.SetUserMap("local-user", "pets", map[string]string{"fish": "Nemo"})
+	table, err := bot.GetUserMap("local-user", "pets")
+	if err != nil || len(table) != 1 || table["fish"] != "Nemo" {
+		t.Errorf("unexpected map: %v %v", table, err)
+	}
+	assertReply(t, bot, "what pets do i have", "fish.")
+}
+
+// Local variables last for one reply, through its redirects, and are never
+// saved with the user's variables.
+func TestLocalVariables(t *testing.T) {
+	bot := rivescript.New(nil)
+	bot.Stream(`
+		+ order *
+		- <setlocal item=<star>><setlocal count=1>{@confirm} {@receipt}
+
+		+ order two *
+		@ order <star>
+
+		+ confirm
+		- You ordered <getlocal count> <getlocal item>.
+
+		+ receipt
+		* <getlocal item> == undefined => No receipt.
+		- Receipt for <getlocal item>.
+
+		+ what did i order
+		- <getlocal item>
+	`)
+	bot.SortReplies()
+
+	assertReply(t, bot, "order tea", "You ordered 1 tea. Receipt for tea.")
+	assertReply(t, bot, "order two coffees", "You ordered 1 coffees. Receipt for coffees.")
+	assertReply(t, bot, "what did i order", "undefined")
+	assertReply(t, bot, "receipt", "No receipt.")
+
+	vars, _ := bot.GetUservars("local-user")
+	for _, name := range []string{"item", "count"} {
+		if _, ok := vars.Variables[name]; ok {
+			t.Errorf("local variable %s was saved to the session", name)
+		}
+	}
+
+	// Every reply has its own, even a nested reply or one that runs at the
+	// same time for the same user.
+	waiting := make(chan bool)
+	release := make(chan bool)
+	bot.SetSubroutine("wait", func(rs *rivescript.RiveScript, args []string) string {
+		waiting <- true
+		<-release
+		return ""
+	})
+	bot.SetSubroutineV2("ask", func(rs *rivescript.RiveScript, call *rivescript.CallContext) (*rivescript.CallResult, error) {
+		reply, err := rs.ReplyContext(call.Context(), call.Username, call.Raw)
+		return &rivescript.CallResult{Reply: reply}, err
+	})
+	bot.Stream(`
+		+ slow
+		- <setlocal item=slow><call>wait</call><getlocal item>
+
+		+ nested
+		- <setlocal item=outer>[<call>ask peek</call> <call>ask inner</call>] <getlocal item>
+
+		+ inner
+		- <setlocal item=inner>{@peek}
+
+		+ peek
+		- <getlocal item>
+	`)
+	bot.SortReplies()
+
+	assertReply(t, bot, "nested", "[undefined inner] outer")
+
+	replies := make(chan string)
+	go func() {
+		reply, _ := bot.Reply("local-user", "slow")
+		replies <- reply
+	}()
+	<-waiting
+	assertReply(t, bot, "what did i order", "undefined")
+	assertReply(t, bot, "order tea", "You ordered 1 tea. Receipt for tea.")
+	release <- true
+	if reply := <-replies; reply != "slow" {
+		t.Errorf("expected the slow reply to keep its local variable, got %q", reply)
+	}
+}
+
+// Raw regular expression triggers match the message before it's stripped,
+// with their groups as stars.
+func TestRegexpTriggers(t *testing.T) {
+	bot := rivescript.New(nil)
+	err := bot.Stream(`
+		+ /^order\s+#?(?P<number>\d{6})$/
+		- Looking up order <star number> (<star1>).
+
+		+ order *
+		- That doesn't look like an order number.
+
+		+ /^(\d{5})(?:\s+(\d{4}))?$/
+		- ZIP code <star1>, extension <star2>, <star nothing>.
+
+		+ /hello/
+		- You said hello somewhere.
+
+		+ hello
+		- Hello!
+
+		+ *
+		- Catch-all.
+	`)
+	if err != nil {
+		t.Fatalf("couldn't load the regexp triggers: %s", err)
+	}
+	bot.SortReplies()
+
+	assertReply(t, bot, "Order #123456", "Looking up order 123456 (123456).")
+	assertReply(t, bot, "order 12345", "That doesn't look like an order number.")
+	assertReply(t, bot, "90210 1234", "ZIP code 90210, extension 1234, undefined.")
+	assertReply(t, bot, "hello", "Hello!")
+	assertReply(t, bot, "well hello there", "You said hello somewhere.")
+	assertReply(t, bot, "goodbye", "Catch-all.")
+
+	// The punctuation is kept, with or without UTF-8 mode, but the other
+	// triggers still see the stripped message.
+	for _, utf8 := range []bool{false, true} {
+		bot := rivescript.New(&rivescript.Config{UTF8: utf8})
+		bot.Stream(`
+			+ /^email (?P<addr>\S+@\S+)$/
+			- Writing to <star addr>.
+
+			+ email *
+			- That's not an e-mail address: <star>.
+		`)
+		bot.SortReplies()
+		assertReply(t, bot, "Email Foo@Bar.com", "Writing to foo@bar.com.")
+		assertReply(t, bot, "email <b>x@y.z</b>", "Writing to bx@y.z/b.")
+		assertReply(t, bot, "email me!", "That's not an e-mail address: me.")
+	}
+
+	// Invalid expressions are caught when they're loaded.
+	strict := rivescript.New(&rivescript.Config{Strict: true})
+	if err := strict.Stream("+ /^order (\\d+$/\n- Broken."); err == nil {
+		t.Errorf("expected an error loading an invalid regexp trigger")
+	}
+}
+
+// Wildcards can be named, and referred to by name wherever stars can be.
+func TestNamedStars(t *testing.T) {
+	bot := rivescript.New(nil)
+	err := bot.Stream(`
+		+ my name is *{name}
+		- <set name=<star name>>Nice to meet you, <star name>.
+
+		+ i am #{age} years old and live in *{city}
+		* <star age> < 18 => A young person from <star city>.
+		- {@remember <star city>}
+
+		+ remember *{place}
+		- I'll remember <star place> (<star1>).
+
+		+ call me _{first_name}
+		- Hi, <star first_name>! <star missing>
+	`)
+	if err != nil {
+		t.Fatalf("couldn't load the named stars: %s", err)
+	}
+	bot.SortReplies()
+
+	assertReply(t, bot, "my name is alice", "Nice to meet you, alice.")
+	assertReply(t, bot, "i am 12 years old and live in paris", "A young person from paris.")
+	assertReply(t, bot, "i am 40 years old and live in rome", "I'll remember rome (rome).")
+	assertReply(t, bot, "call me bob", "Hi, bob! undefined")
+
+	// The stars come back with the reply.
+	info, err := bot.ReplyWithInfo("local-user", "I am 40 years old and live in Rome")
+	if err != nil {
+		t.Fatalf("ReplyWithInfo: %s", err)
+	}
+	if info.Reply != "I'll remember rome (rome)." ||
+		info.Trigger != "i am #{age} years old and live in *{city}" ||
+		strings.Join(info.Stars, ",") != "40,rome" ||
+		info.NamedStars["age"] != "40" || info.NamedStars["city"] != "rome" {
+		t.Errorf("unexpected reply info: %+v", info)
+	}
+
+	// A name can only be used once in a trigger.
+	strict := rivescript.New(&rivescript.Config{Strict: true})
+	if err := strict.Stream("+ *{x} and *{x}\n- Twice."); err == nil {
+		t.Errorf("expected an error loading a trigger with a repeated star name")
+	}
+}
+
+// Entity wildcards match the entities their extractors find in a message.
+func TestEntityWildcards(t *testing.T) {
+	clock := time.Date(2026, time.October, 18, 12, 0, 0, 0, time.UTC) // A Sunday
+	bot := rivescript.New(&rivescript.Config{
+		Clock: func() time.Time { return clock },
+	})
+
+	// Extractors of the app's own.
+	err := bot.RegisterExtractor("order", `[a-z]{2}-\d{4}`, func(rs *rivescript.RiveScript, ctx *rivescript.ExtractorContext) (string, bool) {
+		return strings.ToUpper(ctx.Text), ctx.Text != "xx-0000"
+	})
+	if err != nil {
+		t.Errorf("couldn't register the order extractor: %s", err)
+	}
+	if err := bot.RegisterExtractor("color", `(red|green)`, nil); err == nil {
+		t.Errorf("expected an error registering an extractor with a capturing group")
+	}
+	if err := bot.RegisterExtractor("input", `\d+`, nil); err == nil {
+		t.Errorf("expected an error registering an extractor named input")
+	}
+
+	err = bot.Stream(`
+		+ remind me [on] <date>
+		- Reminder set for <star>.
+
+		+ my email is <email>{address}
+		- Got it: <star address>.
+
+		+ i paid <currency>
+		- Paid <star>.
+
+		+ i have <number> apples
+		- You have <star> apples.
+
+		+ i have * apples
+		- How many is <star>?
+
+		+ visit <url>
+		- Opening <star>.
+
+		+ track order <order>
+		- Tracking <star>.
+
+		+ *
+		- I don't understand.
+	`)
+	if err != nil {
+		t.Fatalf("couldn't load the entity wildcards: %s", err)
+	}
+	bot.SortReplies()
+
+	assertReply(t, bot, "Remind me on October 31st", "Reminder set for 2026-10-31.")
+	assertReply(t, bot, "Remind me on Jan 5", "Reminder set for 2027-01-05.")
+	assertReply(t, bot, "Remind me on 10/20/2026", "Reminder set for 2026-10-20.")
+	assertReply(t, bot, "Remind me friday", "Reminder set for 2026-10-23.")
+	assertReply(t, bot, "Remind me tomorrow!", "Reminder set for 2026-10-19.")
+	assertReply(t, bot, "Remind me on 2/30/2027", "I don't understand.")
+	assertReply(t, bot, "My email is Bob.Smith@Example.com.", "Got it: bob.smith@example.com.")
+	assertReply(t, bot, "I paid $12.5!", "Paid 12.50 USD.")
+	assertReply(t, bot, "I paid 1,000 euros", "Paid 1000.00 EUR.")
+	assertReply(t, bot, "I have 1,234.50 apples", "You have 1234.5 apples.")
+	assertReply(t, bot, "I have many apples", "How many is many?")
+	assertReply(t, bot, "Visit www.example.com/docs.", "Opening http://www.example.com/docs.")
+	assertReply(t, bot, "Track order ab-1234", "Tracking AB-1234.")
+	assertReply(t, bot, "Track order xx-0000", "I don't understand.")
+
+	// The extracted values come back with the reply.
+	info, err := bot.ReplyWithInfo("local-user", "my email is alice@example.org")
+	if err != nil {
+		t.Fatalf("ReplyWithInfo: %s", err)
+	}
+	if info.NamedStars["address"] != "alice@example.org" {
+		t.Errorf("unexpected reply info: %+v", info)
+	}
+
+	// The other triggers see the message stripped as usual.
+	bot = rivescript.New(nil)
+	bot.Stream(`
+		+ call me at <number>
+		- Calling <star>.
+
+		+ i have # apples
+		- You have <star> apples.
+
+		+ paid *
+		- Paid <star>.
+	`)
+	bot.SortReplies()
+	assertReply(t, bot, "Call me at 5,551,234.", "Calling 5551234.")
+	assertReply(t, bot, "I have 1,000 apples", "You have 1000 apples.")
+	assertReply(t, bot, "I have 3.5 apples", "You have 35 apples.")
+	assertReply(t, bot, "Paid $5.", "Paid 5.")
+
+	// Extractors can be registered while replies are running.
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			bot.RegisterExtractor("number", `\d+`, nil)
+		}
+		done <- true
+	}()
+	for i := 0; i < 50; i++ {
+		bot.Reply("local-user", "call me at 5")
+	}
+	<-done
+}
@@ -13,6 +13,7 @@ package rivescript
 */
 
 import (
+	"log"
 	"math/rand"
 	"regexp"
 	"sync"
@@ -38,32 +39,41 @@ type RiveScript struct {
 	UnicodePunctuation *regexp.Regexp
 
 	// Internal helpers
-	parser *parser.Parser
+	parser        *parser.Parser
+	historySize   int              // Number of history entries kept per user
+	objectError   string           // Text for a failed <call>
+	logger        *log.Logger      // Where debug messages and warnings go
+	mathDecimal   bool             // Math tags use decimals, not integers
+	mathPrecision int              // Decimal places kept by math tags
+	mathRounding  Rounding         // How math tags round their results
+	conditionCase bool             // String operators in conditions match case
+	clock         func() time.Time // The current time for the date tags
 
 	// Internal data structures
-	cLock       sync.Mutex                      // Lock for config variables.
-	global      map[string]string               // 'global' variables
-	vars        map[string]string               // 'var' bot variables
-	sub         map[string]string               // 'sub' substitutions
-	person      map[string]string               // 'person' substitutions
-	array       map[string][]string             // 'array'
-	sessions    sessions.SessionManager         // user variable session manager
-	includes    map[string]map[string]bool      // included topics
-	inherits    map[string]map[string]bool      // inherited topics
-	objlangs    map[string]string               // object macro languages
-	handlers    map[string]macro.MacroInterface // object language handlers
-	subroutines map[string]Subroutine           // Golang object handlers
-	topics      map[string]*astTopic            // main topic structure
-	sorted      *sortBuffer                     // Sorted data from SortReplies()
+	cLock       sync.Mutex                        // Lock for config variables.
+	global      map[string]string                 // 'global' variables
+	vars        map[string]string                 // 'var' bot variables
+	sub         map[string]string                 // 'sub' substitutions
+	person      map[string]string                 // 'person' substitutions
+	array       map[string][]string               // 'array'
+	sessions    sessions.SessionManager           // user variable session manager
+	locker      sessions.Locker                   // per-user locks, if LockUsers
+	buffers     map[string][]*sessionBuffer       // users' sessions during replies
+	bufferLock  sync.Mutex                        // lock for the session buffers
+	includes    map[string]map[string]bool        // included topics
+	inherits    map[string]map[string]bool        // inherited topics
+	objlangs    map[string]string                 // object macro languages
+	handlers    map[string]macro.MacroInterfaceV2 // object language handlers
+	subroutines map[string]SubroutineV2           // Golang object handlers
+	tags        map[string]TagFunc                // Tags run inside-out in replies
+	extractors  map[string]*extractor             // Entity wildcards in triggers
+	topics      map[string]*astTopic              // main topic structure
+	sorted      *sortBuffer                       // Sorted data from SortReplies()
 
 	// The random number god.
 	random     rand.Source
 	rng        *rand.Rand
 	randomLock sync.Mutex
-
-	// State information.
-	inReplyContext bool
-	currentUser    string
 }
 
 /*
@@ -86,9 +96,25 @@ func New(cfg *Config) *RiveScript {
 	if cfg.Depth == 0 {
 		cfg.Depth = 50
 	}
+	if cfg.HistorySize <= 0 {
+		cfg.HistorySize = sessions.HistorySize
+	}
 	if cfg.SessionManager == nil {
 		cfg.SessionManager = memory.New()
 	}
+	mathPrecision := defaultMathPrecision
+	if cfg.MathPrecision != nil {
+		mathPrecision = *cfg.MathPrecision
+		if mathPrecision < 0 {
+			mathPrecision = 0
+		}
+	}
+	if cfg.Clock == nil {
+		cfg.Clock = time.Now
+	}
+	if cfg.ObjectError == "" {
+		cfg.ObjectError = "[ERR: Error when executing object]"
+	}
 
 	// Random number seed.
 	var random rand.Source
@@ -100,11 +126,19 @@ func New(cfg *Config) *RiveScript {
 
 	rs := &RiveScript{
 		// Set the default config objects that don't have good zero-values.
-		Debug:    cfg.Debug,
-		Strict:   cfg.Strict,
-		Depth:    cfg.Depth,
-		UTF8:     cfg.UTF8,
-		sessions: cfg.SessionManager,
+		Debug:         cfg.Debug,
+		Strict:        cfg.Strict,
+		Depth:         cfg.Depth,
+		UTF8:          cfg.UTF8,
+		sessions:      cfg.SessionManager,
+		historySize:   cfg.HistorySize,
+		objectError:   cfg.ObjectError,
+		mathDecimal:   cfg.MathDecimal,
+		mathPrecision: mathPrecision,
+		mathRounding:  cfg.MathRounding,
+		conditionCase: cfg.CaseSensitiveConditions,
+		logger:        cfg.Logger,
+		clock:         cfg.Clock,
 
 		// Default punctuation that gets removed from messages in UTF-8 mode.
 		UnicodePunctuation: regexp.MustCompile(`[.,!?;:]`),
@@ -118,15 +152,27 @@ func New(cfg *Config) *RiveScript {
 		includes:    map[string]map[string]bool{},
 		inherits:    map[string]map[string]bool{},
 		objlangs:    map[string]string{},
-		handlers:    map[string]macro.MacroInterface{},
-		subroutines: map[string]Subroutine{},
+		handlers:    map[string]macro.MacroInterfaceV2{},
+		subroutines: map[string]SubroutineV2{},
+		tags:        builtinTags(),
+		extractors:  builtinExtractors(),
 		topics:      map[string]*astTopic{},
 		sorted:      new(sortBuffer),
+		buffers:     map[string][]*sessionBuffer{},
 
 		random: random,
 		rng:    rand.New(random),
 	}
 
+	// Lock users during their replies?
+	if cfg.LockUsers {
+		if locker, ok := cfg.SessionManager.(sessions.Locker); ok {
+			rs.locker = locker
+		} else {
+			rs.locker = sessions.NewLocalLocker()
+		}
+	}
+
 	// Helper modules.
 	rs.parser = parser.New(parser.ParserConfig{
 		Strict:  cfg.Strict,
@@ -147,9 +193,6 @@ const (
 	UNDEFTAG = "<undef>"
 )
 
-// Subroutine is a function prototype for defining custom object macros in Go.
-type Subroutine func(*RiveScript, []string) string
-
 // SetUnicodePunctuation allows you to override the text of the unicode
 // punctuation regexp. Provide a string literal that will validate in
 // `regexp.MustCompile()`
@@ -0,0 +1,369 @@
+package rivescript
+
+// Session buffering for replies.
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aichaos/rivescript-go/sessions"
+)
+
+/*
+sessionBuffer holds a user's data for the duration of one reply.
+
+The user's data is read from the session manager once, when the reply begins,
+and every read and write during the reply uses the buffered copy. The changes
+are saved in one batch when the reply is finished, or thrown away if the reply
+ends in an error.
+
+Every reply has its own buffer. When an object macro asks for a reply for the
+same user during a reply (passing on the context it was called with), the new
+reply is nested in the first: its buffer starts from the first reply's data,
+and its changes are merged into the first reply's if it succeeds, to be saved
+along with them.
+
+A buffer that doesn't belong to a reply isn't buffering at all, and its reads
+and writes go straight to the session manager. The public API uses one of
+those when it isn't given the context of a reply.
+*/
+type sessionBuffer struct {
+	rs       *RiveScript
+	username string
+	ctx      context.Context // Carries the buffer to object macros
+	parent   *sessionBuffer  // The reply this one is nested in, if any
+	children int             // Number of nested replies running
+	done     bool            // The reply is finished
+
+	data    *sessions.UserData // The user's data with the pending changes
+	pending sessions.Update    // Changes not yet saved to the session manager
+	locals  map[string]string  // Reply-scoped variables, never saved
+}
+
+// sessionKey is the context key for the session buffer of a reply.
+type sessionKey struct{}
+
+// replyContext returns the context of a reply, for the contexts given to tags,
+// extractors and object macros.
+func replyContext(buf *sessionBuffer) context.Context {
+	if buf == nil {
+		return context.Background()
+	}
+	return buf.ctx
+}
+
+// copyUserData makes a copy of a user's data that's safe to change.
+func copyUserData(data *sessions.UserData) *sessions.UserData {
+	copied := &sessions.UserData{
+		Variables: map[string]string{},
+		History:   sessions.NewHistory(),
+	}
+	if data != nil {
+		for name, value := range data.Variables {
+			copied.Variables[name] = value
+		}
+		copied.LastMatch = data.LastMatch
+		if data.History != nil {
+			copied.History.Entries = append(copied.History.Entries, data.History.Entries...)
+		}
+	}
+	return copied
+}
+
+// reset forgets the pending changes.
+func (buf *sessionBuffer) reset() {
+	buf.pending = sessions.Update{
+		Variables:   map[string]string{},
+		HistorySize: buf.rs.historySize,
+	}
+}
+
+// buffered tells whether the buffer holds the user's data for a reply.
+func (buf *sessionBuffer) buffered() bool {
+	return buf.ctx != nil
+}
+
+/*
+parentSession finds the reply that a new reply for a user is nested in.
+
+That's the reply carried by the context, if it's for the same user and hasn't
+finished yet.
+*/
+func (rs *RiveScript) parentSession(ctx context.Context, username string) *sessionBuffer {
+	parent, ok := ctx.Value(sessionKey{}).(*sessionBuffer)
+	if !ok || parent.username != username {
+		return nil
+	}
+
+	rs.bufferLock.Lock()
+	defer rs.bufferLock.Unlock()
+	if parent.done {
+		return nil
+	}
+	return parent
+}
+
+// beginSession starts buffering a user's session for a reply.
+func (rs *RiveScript) beginSession(ctx context.Context, username string) *sessionBuffer {
+	buf := &sessionBuffer{
+		rs:       rs,
+		username: username,
+		locals:   map[string]string{},
+	}
+	buf.reset()
+	buf.ctx = context.WithValue(ctx, sessionKey{}, buf)
+
+	// A nested reply starts from the data of the reply it's in. Otherwise,
+	// initialize a user profile for this user, and read their data.
+	parent := rs.parentSession(ctx, username)
+	var data *sessions.UserData
+	if parent == nil {
+		data = rs.sessions.Init(username)
+	}
+
+	rs.bufferLock.Lock()
+	defer rs.bufferLock.Unlock()
+	if parent != nil {
+		buf.parent = parent
+		parent.children++
+		data = parent.data
+	}
+	buf.data = copyUserData(data)
+	rs.buffers[username] = append(rs.buffers[username], buf)
+
+	return buf
+}
+
+/*
+endSession finishes a reply's session buffer.
+
+If `commit` is true, the reply's changes are saved, or merged into the reply
+it's nested in. If not, they're thrown away. The error is from saving them.
+*/
+func (rs *RiveScript) endSession(buf *sessionBuffer, commit bool) error {
+	rs.bufferLock.Lock()
+	buf.done = true
+	active := rs.buffers[buf.username]
+	for i, other := range active {
+		if other == buf {
+			active = append(active[:i], active[i+1:]...)
+			break
+		}
+	}
+	if len(active) == 0 {
+		delete(rs.buffers, buf.username)
+	} else {
+		rs.buffers[buf.username] = active
+	}
+
+	parent := buf.parent
+	if parent != nil {
+		parent.children--
+	}
+	if commit && parent != nil {
+		parent.setVars(buf.pending.Variables)
+		if buf.pending.HasLastMatch {
+			parent.setLastMatchVar(buf.pending.LastMatch)
+		}
+		for _, entry := range buf.pending.History {
+			parent.addHistoryEntry(entry)
+		}
+	}
+	rs.bufferLock.Unlock()
+
+	if !commit {
+		rs.say("Discarding session changes for %s", buf.username)
+		return nil
+	}
+	if parent != nil {
+		return nil
+	}
+	return sessions.ApplyUpdate(rs.sessions, buf.username, buf.pending)
+}
+
+/*
+session finds the buffer to use for a user's data from outside the reply code,
+like in the public API.
+
+That's the reply carried by the context, if it's for the same user. Otherwise
+the buffer is unbuffered and uses the session manager directly, even if the
+user is in a reply: without the context there's no telling which reply is
+asking.
+*/
+func (rs *RiveScript) session(ctx context.Context, username string) *sessionBuffer {
+	if buf, ok := ctx.Value(sessionKey{}).(*sessionBuffer); ok && buf.username == username {
+		return buf
+	}
+	return &sessionBuffer{rs: rs, username: username}
+}
+
+/*
+flushSession saves the pending changes of a user's reply right away.
+
+This is for operations that work directly on the session manager, like
+freezing and thawing, so that they see the changes made so far in the reply
+(and the replies it's nested in). The function is run after the changes are
+saved, and then the buffers are reloaded with the user's data from the
+session manager.
+*/
+func (rs *RiveScript) flushSession(buf *sessionBuffer, fn func() error) error {
+	if !buf.buffered() {
+		return fn()
+	}
+
+	// Save the outermost reply's changes first.
+	chain := []*sessionBuffer{}
+	rs.bufferLock.Lock()
+	for frame := buf; frame != nil; frame = frame.parent {
+		chain = append([]*sessionBuffer{frame}, chain...)
+	}
+	updates := []sessions.Update{}
+	for _, frame := range chain {
+		updates = append(updates, frame.pending)
+		frame.reset()
+	}
+	rs.bufferLock.Unlock()
+
+	for _, update := range updates {
+		if err := sessions.ApplyUpdate(rs.sessions, buf.username, update); err != nil {
+			return err
+		}
+	}
+	err := fn()
+
+	// Reload what the session manager has now.
+	data, _ := rs.sessions.GetAny(buf.username)
+	if data == nil || data.Variables == nil {
+		data = rs.sessions.Init(buf.username)
+	}
+	rs.bufferLock.Lock()
+	for _, frame := range chain {
+		frame.data = copyUserData(data)
+	}
+	rs.bufferLock.Unlock()
+
+	return err
+}
+
+// The accessors for user data below use the buffered copy during a reply, or
+// the session manager if the buffer is unbuffered.
+
+func (buf *sessionBuffer) get(name string) (string, error) {
+	if !buf.buffered() {
+		return buf.rs.sessions.Get(buf.username, name)
+	}
+
+	buf.rs.bufferLock.Lock()
+	defer buf.rs.bufferLock.Unlock()
+	value, ok := buf.data.Variables[name]
+	if !ok {
+		return "", fmt.Errorf(`variable "%s" for user "%s" not set`, name, buf.username)
+	}
+	return value, nil
+}
+
+func (buf *sessionBuffer) set(vars map[string]string) {
+	if !buf.buffered() {
+		buf.rs.sessions.Set(buf.username, vars)
+		return
+	}
+
+	buf.rs.bufferLock.Lock()
+	defer buf.rs.bufferLock.Unlock()
+	buf.setVars(vars)
+}
+
+func (buf *sessionBuffer) userData() (*sessions.UserData, error) {
+	if !buf.buffered() {
+		return buf.rs.sessions.GetAny(buf.username)
+	}
+
+	buf.rs.bufferLock.Lock()
+	defer buf.rs.bufferLock.Unlock()
+	return copyUserData(buf.data), nil
+}
+
+func (buf *sessionBuffer) lastMatch() (string, error) {
+	if !buf.buffered() {
+		return buf.rs.sessions.GetLastMatch(buf.username)
+	}
+
+	buf.rs.bufferLock.Lock()
+	defer buf.rs.bufferLock.Unlock()
+	return buf.data.LastMatch, nil
+}
+
+func (buf *sessionBuffer) setLastMatch(trigger string) {
+	if !buf.buffered() {
+		buf.rs.sessions.SetLastMatch(buf.username, trigger)
+		return
+	}
+
+	buf.rs.bufferLock.Lock()
+	defer buf.rs.bufferLock.Unlock()
+	buf.setLastMatchVar(trigger)
+}
+
+func (buf *sessionBuffer) history() (*sessions.History, error) {
+	data, err := buf.userData()
+	if err != nil {
+		return nil, err
+	}
+	return data.History, nil
+}
+
+func (buf *sessionBuffer) addHistory(entry sessions.HistoryEntry) {
+	if !buf.buffered() {
+		sessions.AddHistoryEntry(buf.rs.sessions, buf.username, entry, buf.rs.historySize)
+		return
+	}
+
+	buf.rs.bufferLock.Lock()
+	defer buf.rs.bufferLock.Unlock()
+	buf.addHistoryEntry(entry)
+}
+
+// Local variables only live in the buffer, for the length of the reply. A
+// nested reply has its own, and doesn't see the ones of the reply it's in.
+
+func (buf *sessionBuffer) getLocal(name string) (string, bool) {
+	if !buf.buffered() {
+		return "", false
+	}
+
+	buf.rs.bufferLock.Lock()
+	defer buf.rs.bufferLock.Unlock()
+	value, ok := buf.locals[name]
+	return value, ok
+}
+
+func (buf *sessionBuffer) setLocal(name, value string) bool {
+	if !buf.buffered() {
+		return false
+	}
+
+	buf.rs.bufferLock.Lock()
+	defer buf.rs.bufferLock.Unlock()
+	buf.locals[name] = value
+	return true
+}
+
+// The functions below change the buffered data, with the bufferLock held.
+
+func (buf *sessionBuffer) setVars(vars map[string]string) {
+	for name, value := range vars {
+		buf.data.Variables[name] = value
+		buf.pending.Variables[name] = value
+	}
+}
+
+func (buf *sessionBuffer) setLastMatchVar(trigger string) {
+	buf.data.LastMatch = trigger
+	buf.pending.LastMatch = trigger
+	buf.pending.HasLastMatch = true
+}
+
+func (buf *sessionBuffer) addHistoryEntry(entry sessions.HistoryEntry) {
+	buf.data.History.Add(entry, buf.pending.HistorySize)
+	buf.pending.History = append(buf.pending.History, entry)
+}
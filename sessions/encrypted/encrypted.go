@@ -0,0 +1,432 @@
+/*
+Package encrypted provides a session manager that encrypts user data at rest.
+
+It wraps another SessionManager (such as the memory or Redis stores) and
+encrypts the values of user variables with AES-GCM before they're handed to
+the underlying store, and decrypts them again on the way out. Optionally, the
+input and reply text in the user's history can be encrypted too.
+
+Each encrypted value is stored along with the ID of the key that encrypted it,
+in the form `enc:<key id>:<base64 data>`, so that keys can be rotated: add a
+new key, make it the CurrentKey, and keep the old keys around until every
+value has been re-encrypted (see `Rotate()` and `RotateAll()`).
+
+	import (
+		rivescript "github.com/aichaos/rivescript-go"
+		"github.com/aichaos/rivescript-go/sessions/encrypted"
+		"github.com/aichaos/rivescript-go/sessions/redis"
+	)
+
+	func main() {
+		store, err := encrypted.New(redis.New(nil), encrypted.Config{
+			Keys: map[string][]byte{
+				"2017-05": key, // 16, 24 or 32 bytes for AES-128/192/256
+			},
+			CurrentKey: "2017-05",
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		bot := rivescript.New(&rivescript.Config{
+			SessionManager: store,
+		})
+	}
+
+Values that aren't in the encrypted format are passed through as-is, so an
+existing store can be switched over to encryption and its users will be
+encrypted as their variables are next set (or all at once with RotateAll()).
+
+Note that the data returned by this session manager (e.g. by `GetAll()` or
+`sessions.Export()`) is decrypted.
+*/
+package encrypted
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/aichaos/rivescript-go/sessions"
+)
+
+// prefix marks a value as encrypted.
+const prefix = "enc:"
+
+// Config configures the encryption keys.
+type Config struct {
+	// Keys maps key IDs to AES keys, which must be 16, 24 or 32 bytes long.
+	// Keep old keys in here for as long as there may be values that were
+	// encrypted with them. Key IDs can't contain a colon.
+	Keys map[string][]byte
+
+	// CurrentKey is the ID of the key used to encrypt new values.
+	CurrentKey string
+
+	// EncryptHistory encrypts the input and reply in the user's history as
+	// well as their variables.
+	EncryptHistory bool
+}
+
+// EncryptedStore is a SessionManager that encrypts data for another one.
+type EncryptedStore struct {
+	sessions.SessionManager
+
+	ciphers        map[string]cipher.AEAD
+	currentKey     string
+	encryptHistory bool
+	locker         sessions.Locker
+}
+
+// New creates an EncryptedStore that wraps another session manager.
+func New(sm sessions.SessionManager, config Config) (*EncryptedStore, error) {
+	if _, ok := config.Keys[config.CurrentKey]; !ok {
+		return nil, fmt.Errorf("the current key %q isn't one of the keys", config.CurrentKey)
+	}
+
+	locker, ok := sm.(sessions.Locker)
+	if !ok {
+		locker = sessions.NewLocalLocker()
+	}
+
+	s := &EncryptedStore{
+		SessionManager: sm,
+		ciphers:        map[string]cipher.AEAD{},
+		currentKey:     config.CurrentKey,
+		encryptHistory: config.EncryptHistory,
+		locker:         locker,
+	}
+
+	for id, key := range config.Keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid key ID %q: must be non-empty with no colons", id)
+		}
+
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %s", id, err)
+		}
+		gcm, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key %q: %s", id, err)
+		}
+		s.ciphers[id] = gcm
+	}
+
+	return s, nil
+}
+
+// encrypt encrypts a value with the current key. The username and field
+// name are bound to the ciphertext, so that it can't be swapped into a
+// different user or variable.
+func (s *EncryptedStore) encrypt(username, field, value string) string {
+	gcm := s.ciphers[s.currentKey]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		// Never fall back to storing the plain text.
+		panic("encrypted: can't read random nonce: " + err.Error())
+	}
+
+	sealed := gcm.Seal(nonce, nonce, []byte(value), additionalData(username, field))
+	return prefix + s.currentKey + ":" + base64.StdEncoding.EncodeToString(sealed)
+}
+
+// decrypt decrypts a value. Values that weren't encrypted are returned as-is.
+func (s *EncryptedStore) decrypt(username, field, value string) (string, error) {
+	if !strings.HasPrefix(value, prefix) {
+		return value, nil
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(value, prefix), ":", 2)
+	if len(parts) != 2 {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	gcm, ok := s.ciphers[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("value was encrypted with unknown key %q", parts[0])
+	}
+
+	sealed, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil || len(sealed) < gcm.NonceSize() {
+		return "", errors.New("malformed encrypted value")
+	}
+
+	nonce := sealed[:gcm.NonceSize()]
+	plain, err := gcm.Open(nil, nonce, sealed[gcm.NonceSize():], additionalData(username, field))
+	if err != nil {
+		return "", fmt.Errorf(`can't decrypt "%s" for user "%s": %s`, field, username, err)
+	}
+	return string(plain), nil
+}
+
+// additionalData is the authenticated data bound to an encrypted value.
+func additionalData(username, field string) []byte {
+	return []byte(username + "\x00" + field)
+}
+
+// decryptUser decrypts a copy of a user's data.
+func (s *EncryptedStore) decryptUser(username string, data *sessions.UserData) (*sessions.UserData, error) {
+	if data == nil {
+		return nil, nil
+	}
+
+	result := &sessions.UserData{
+		Variables: map[string]string{},
+		LastMatch: data.LastMatch,
+		History:   sessions.NewHistory(),
+	}
+
+	for name, value := range data.Variables {
+		plain, err := s.decrypt(username, name, value)
+		if err != nil {
+			return nil, err
+		}
+		result.Variables[name] = plain
+	}
+
+	if data.History != nil {
+		history, err := s.decryptHistory(username, data.History)
+		if err != nil {
+			return nil, err
+		}
+		result.History = history
+	}
+
+	return result, nil
+}
+
+// decryptHistory decrypts a copy of a user's history.
+func (s *EncryptedStore) decryptHistory(username string, history *sessions.History) (*sessions.History, error) {
+	result := sessions.NewHistory()
+	for _, entry := range history.Entries {
+		var err error
+		if entry.Input, err = s.decrypt(username, "history:input", entry.Input); err != nil {
+			return nil, err
+		}
+		if entry.Reply, err = s.decrypt(username, "history:reply", entry.Reply); err != nil {
+			return nil, err
+		}
+		result.Entries = append(result.Entries, entry)
+	}
+	return result, nil
+}
+
+/*
+Init makes sure the user has a session, and returns their decrypted data.
+
+If their data can't be decrypted (say, its key was removed), a fresh default
+session is returned instead; the stored data is left alone.
+*/
+func (s *EncryptedStore) Init(username string) *sessions.UserData {
+	data := s.SessionManager.Init(username)
+	if plain, err := s.decryptUser(username, data); err == nil {
+		return plain
+	}
+	return defaultSession()
+}
+
+// defaultSession initializes the default session variables for a user.
+func defaultSession() *sessions.UserData {
+	return &sessions.UserData{
+		Variables: map[string]string{
+			"topic": "random",
+		},
+		LastMatch: "",
+		History:   sessions.NewHistory(),
+	}
+}
+
+// Set encrypts and stores user variables.
+func (s *EncryptedStore) Set(username string, vars map[string]string) {
+	encrypted := map[string]string{}
+	for name, value := range vars {
+		encrypted[name] = s.encrypt(username, name, value)
+	}
+	s.SessionManager.Set(username, encrypted)
+}
+
+// AddHistory adds to the user's history, encrypting it if configured to.
+func (s *EncryptedStore) AddHistory(username, input, reply string) {
+	s.AddHistoryEntry(username, sessions.HistoryEntry{Input: input, Reply: reply}, sessions.HistorySize)
+}
+
+// AddHistoryEntry adds an entry to the user's history, encrypting it if
+// configured to.
+func (s *EncryptedStore) AddHistoryEntry(username string, entry sessions.HistoryEntry, size int) {
+	if s.encryptHistory {
+		entry.Input = s.encrypt(username, "history:input", entry.Input)
+		entry.Reply = s.encrypt(username, "history:reply", entry.Reply)
+	}
+	sessions.AddHistoryEntry(s.SessionManager, username, entry, size)
+}
+
+// Update encrypts and saves a batch of changes to a user's data.
+func (s *EncryptedStore) Update(username string, update sessions.Update) error {
+	encrypted := map[string]string{}
+	for name, value := range update.Variables {
+		encrypted[name] = s.encrypt(username, name, value)
+	}
+	update.Variables = encrypted
+
+	if s.encryptHistory {
+		history := make([]sessions.HistoryEntry, len(update.History))
+		for i, entry := range update.History {
+			entry.Input = s.encrypt(username, "history:input", entry.Input)
+			entry.Reply = s.encrypt(username, "history:reply", entry.Reply)
+			history[i] = entry
+		}
+		update.History = history
+	}
+
+	return sessions.ApplyUpdate(s.SessionManager, username, update)
+}
+
+// Get gets and decrypts a user variable.
+func (s *EncryptedStore) Get(username, name string) (string, error) {
+	value, err := s.SessionManager.Get(username, name)
+	if err != nil {
+		return value, err
+	}
+	return s.decrypt(username, name, value)
+}
+
+// GetAny gets and decrypts all of a user's data.
+func (s *EncryptedStore) GetAny(username string) (*sessions.UserData, error) {
+	data, err := s.SessionManager.GetAny(username)
+	if err != nil {
+		return data, err
+	}
+	return s.decryptUser(username, data)
+}
+
+// GetAll gets and decrypts the data for all users. Users whose data can't
+// be decrypted are left out.
+func (s *EncryptedStore) GetAll() map[string]*sessions.UserData {
+	result := map[string]*sessions.UserData{}
+	for username, data := range s.SessionManager.GetAll() {
+		if plain, err := s.decryptUser(username, data); err == nil {
+			result[username] = plain
+		}
+	}
+	return result
+}
+
+// GetHistory gets and decrypts the user's history.
+func (s *EncryptedStore) GetHistory(username string) (*sessions.History, error) {
+	history, err := s.SessionManager.GetHistory(username)
+	if err != nil {
+		return history, err
+	}
+	return s.decryptHistory(username, history)
+}
+
+// GetFrozen returns the user's decrypted frozen snapshot, if the underlying
+// session manager supports it.
+func (s *EncryptedStore) GetFrozen(username string) (*sessions.UserData, error) {
+	getter, ok := s.SessionManager.(sessions.FrozenGetter)
+	if !ok {
+		return nil, errors.New("the session manager can't get frozen data")
+	}
+
+	data, err := getter.GetFrozen(username)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptUser(username, data)
+}
+
+// Lock locks a user with the underlying session manager's Locker, or with an
+// in-process lock if it doesn't have one.
+func (s *EncryptedStore) Lock(username string) (func(), error) {
+	return s.locker.Lock(username)
+}
+
+/*
+Rotate re-encrypts a user's variables with the current key, along with the
+variables of their frozen snapshot if they have one.
+
+The snapshot is re-encrypted by storing it as the user's data and calling
+`Freeze()`, like `sessions.Import()` does, and then the user's data is put
+back, so the user is locked while it's done. Nothing is written if any of
+the user's data can't be decrypted.
+
+History entries are not re-encrypted; they age out of the history on their
+own, so keep old keys around for at least that long.
+*/
+func (s *EncryptedStore) Rotate(username string) error {
+	unlock, err := s.Lock(username)
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	raw, err := s.SessionManager.GetAny(username)
+	if err != nil {
+		return err
+	}
+	data, err := s.decryptUser(username, raw)
+	if err != nil {
+		return err
+	}
+
+	// Decrypt the frozen snapshot too, if there is one.
+	var frozenRaw, frozen *sessions.UserData
+	if getter, ok := s.SessionManager.(sessions.FrozenGetter); ok {
+		if frozenRaw, err = getter.GetFrozen(username); err == nil {
+			if frozen, err = s.decryptUser(username, frozenRaw); err != nil {
+				return err
+			}
+		}
+	}
+
+	if frozen == nil {
+		if len(data.Variables) > 0 {
+			s.Set(username, data.Variables)
+		}
+		return nil
+	}
+
+	s.SessionManager.Clear(username)
+	s.put(username, frozen.Variables, frozenRaw)
+	if err := s.SessionManager.Freeze(username); err != nil {
+		return err
+	}
+	s.SessionManager.Clear(username)
+	s.put(username, data.Variables, raw)
+	return nil
+}
+
+// put stores a user's data after it was cleared for Rotate(). The variables
+// are encrypted with the current key, and the last match and history are
+// stored as they were.
+func (s *EncryptedStore) put(username string, vars map[string]string, raw *sessions.UserData) {
+	s.SessionManager.Init(username)
+	if len(vars) > 0 {
+		s.Set(username, vars)
+	}
+	s.SessionManager.SetLastMatch(username, raw.LastMatch)
+
+	// Add the history oldest first, so it ends up in the same order.
+	if raw.History != nil {
+		size := len(raw.History.Entries)
+		for i := size - 1; i >= 0; i-- {
+			sessions.AddHistoryEntry(s.SessionManager, username, raw.History.Entries[i], size)
+		}
+	}
+}
+
+// RotateAll re-encrypts every user's variables, and their frozen snapshots,
+// with the current key.
+func (s *EncryptedStore) RotateAll() error {
+	for username := range s.SessionManager.GetAll() {
+		if err := s.Rotate(username); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,121 @@
+package encrypted_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aichaos/rivescript-go/sessions"
+	"github.com/aichaos/rivescript-go/sessions/encrypted"
+	"github.com/aichaos/rivescript-go/sessions/memory"
+)
+
+var (
+	oldKey = bytes.Repeat([]byte("a"), 32)
+	newKey = bytes.Repeat([]byte("b"), 32)
+)
+
+func TestEncrypted(t *testing.T) {
+	backend := memory.New()
+	store, err := encrypted.New(backend, encrypted.Config{
+		Keys:           map[string][]byte{"old": oldKey},
+		CurrentKey:     "old",
+		EncryptHistory: true,
+	})
+	if err != nil {
+		t.Fatalf("couldn't create the store: %s", err)
+	}
+
+	store.Set("alice", map[string]string{"email": "alice@example.com"})
+	store.AddHistoryEntry("alice", sessions.HistoryEntry{Input: "my email is alice@example.com", Reply: "ok"}, 9)
+
+	// The backend should only have ciphertext.
+	raw, _ := backend.Get("alice", "email")
+	if !strings.HasPrefix(raw, "enc:old:") || strings.Contains(raw, "alice@") {
+		t.Errorf("expected the email to be encrypted in the backend, got %s", raw)
+	}
+	history, _ := backend.GetHistory("alice")
+	if strings.Contains(history.Input(1), "alice@") {
+		t.Errorf("expected the history to be encrypted in the backend, got %s", history.Input(1))
+	}
+
+	// But it reads back as plain text.
+	if value, _ := store.Get("alice", "email"); value != "alice@example.com" {
+		t.Errorf("expected to decrypt the email, got %s", value)
+	}
+	if history, _ := store.GetHistory("alice"); history.Input(1) != "my email is alice@example.com" {
+		t.Errorf("expected to decrypt the history, got %s", history.Input(1))
+	}
+	if all := store.GetAll(); all["alice"].Variables["email"] != "alice@example.com" {
+		t.Errorf("expected GetAll to decrypt the email, got %v", all["alice"].Variables)
+	}
+
+	// A ciphertext copied to another variable must not decrypt.
+	backend.Set("alice", map[string]string{"name": raw})
+	if _, err := store.Get("alice", "name"); err == nil {
+		t.Errorf("expected an error decrypting a value moved to another variable")
+	}
+	store.Set("alice", map[string]string{"name": "Alice"})
+
+	// Freeze her variables, so the snapshot gets rotated too.
+	store.Freeze("alice")
+	store.Set("alice", map[string]string{"name": "Alicia"})
+
+	// Rotate to a new key, keeping the old one around.
+	rotated, _ := encrypted.New(backend, encrypted.Config{
+		Keys:       map[string][]byte{"old": oldKey, "new": newKey},
+		CurrentKey: "new",
+	})
+	if value, _ := rotated.Get("alice", "email"); value != "alice@example.com" {
+		t.Errorf("expected the old key to still decrypt, got %s", value)
+	}
+	if err := rotated.RotateAll(); err != nil {
+		t.Errorf("RotateAll failed: %s", err)
+	}
+	raw, _ = backend.Get("alice", "email")
+	if !strings.HasPrefix(raw, "enc:new:") {
+		t.Errorf("expected the email to use the new key after rotation, got %s", raw)
+	}
+	frozen, _ := backend.GetFrozen("alice")
+	if frozen == nil || !strings.HasPrefix(frozen.Variables["name"], "enc:new:") {
+		t.Errorf("expected the frozen snapshot to use the new key after rotation, got %v", frozen)
+	}
+	if value, _ := rotated.Get("alice", "name"); value != "Alicia" {
+		t.Errorf("expected the rotated name to be Alicia, got %s", value)
+	}
+	if history, _ := rotated.GetHistory("alice"); history.Input(1) != "my email is alice@example.com" {
+		t.Errorf("expected the history to be kept through the rotation, got %s", history.Input(1))
+	}
+	rotated.Thaw("alice", sessions.Thaw)
+	if value, _ := rotated.Get("alice", "name"); value != "Alice" {
+		t.Errorf("expected the thawed name to be Alice, got %s", value)
+	}
+
+	// Without the key, Init gives a fresh session instead of the ciphertext.
+	lost, _ := encrypted.New(backend, encrypted.Config{
+		Keys:       map[string][]byte{"other": oldKey},
+		CurrentKey: "other",
+	})
+	if data := lost.Init("alice"); data.Variables["topic"] != "random" || data.Variables["email"] != "" {
+		t.Errorf("expected a fresh session for data that can't be decrypted, got %v", data.Variables)
+	}
+
+	// Unencrypted values pass through as they are.
+	backend.Set("bob", map[string]string{"name": "Bob"})
+	if value, _ := rotated.Get("bob", "name"); value != "Bob" {
+		t.Errorf("expected a plain text value to pass through, got %s", value)
+	}
+}
+
+func TestBadConfig(t *testing.T) {
+	configs := []encrypted.Config{
+		{Keys: map[string][]byte{"a": oldKey}, CurrentKey: "b"},
+		{Keys: map[string][]byte{"a": []byte("short")}, CurrentKey: "a"},
+		{Keys: map[string][]byte{"a:b": oldKey}, CurrentKey: "a:b"},
+	}
+	for i, config := range configs {
+		if _, err := encrypted.New(memory.New(), config); err == nil {
+			t.Errorf("config %d: expected an error", i)
+		}
+	}
+}
@@ -0,0 +1,382 @@
+/*
+Package events provides a session manager that reports changes to user data.
+
+It wraps another SessionManager and emits an Event every time a user variable
+is set or deleted, the topic changes, history is added, or the user's data is
+frozen, thawed or cleared. Usage:
+
+	import (
+		rivescript "github.com/aichaos/rivescript-go"
+		"github.com/aichaos/rivescript-go/sessions/events"
+		"github.com/aichaos/rivescript-go/sessions/memory"
+	)
+
+	func main() {
+		store := events.New(memory.New())
+		store.On(func(e events.Event) {
+			fmt.Printf("%s learned %s = %s\n", e.Username, e.Name, e.NewValue)
+		}, events.VariableSet)
+
+		bot := rivescript.New(&rivescript.Config{
+			SessionManager: store,
+		})
+	}
+
+Looking up the old values costs an extra read from the underlying store for
+each change, which is skipped while there are no subscribers.
+*/
+package events
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/aichaos/rivescript-go/sessions"
+)
+
+// EventType is the kind of change an Event describes.
+type EventType int
+
+// The types of events.
+const (
+	VariableSet     EventType = iota // A user variable got a new value.
+	VariableDeleted                  // A user variable was set to "undefined".
+	TopicChanged                     // The user's topic changed.
+	HistoryAdded                     // A message was added to the history.
+	Frozen                           // The user's variables were frozen.
+	Thawed                           // The user's variables were thawed.
+	Cleared                          // The user's data was deleted.
+)
+
+func (t EventType) String() string {
+	switch t {
+	case VariableSet:
+		return "VariableSet"
+	case VariableDeleted:
+		return "VariableDeleted"
+	case TopicChanged:
+		return "TopicChanged"
+	case HistoryAdded:
+		return "HistoryAdded"
+	case Frozen:
+		return "Frozen"
+	case Thawed:
+		return "Thawed"
+	case Cleared:
+		return "Cleared"
+	}
+	return fmt.Sprintf("EventType(%d)", int(t))
+}
+
+// Event describes one change to a user's session.
+type Event struct {
+	Type     EventType
+	Username string
+
+	// The variable name, for VariableSet and VariableDeleted events.
+	Name string
+
+	// The variable or topic value before and after the change. A variable
+	// that wasn't set before has an OldValue of "undefined".
+	OldValue string
+	NewValue string
+
+	// The new entry, for HistoryAdded events.
+	Entry sessions.HistoryEntry
+
+	// The action taken, for Thawed events.
+	ThawAction sessions.ThawAction
+
+	// The user's whole session before and after the change, for the
+	// HistoryAdded, Frozen, Thawed and Cleared events. Either may be nil
+	// if the user had no data.
+	OldData *sessions.UserData
+	NewData *sessions.UserData
+}
+
+// subscriber is a registered callback and the events it wants.
+type subscriber struct {
+	fn    func(Event)
+	types map[EventType]bool // Empty means all types
+}
+
+// EventStore is a SessionManager that emits events for changes made
+// through it.
+type EventStore struct {
+	sessions.SessionManager
+
+	lock        sync.RWMutex
+	subscribers []subscriber
+	locker      sessions.Locker
+}
+
+// New creates an EventStore that wraps another session manager.
+func New(sm sessions.SessionManager) *EventStore {
+	locker, ok := sm.(sessions.Locker)
+	if !ok {
+		locker = sessions.NewLocalLocker()
+	}
+
+	return &EventStore{
+		SessionManager: sm,
+		locker:         locker,
+	}
+}
+
+/*
+On registers a callback to be called for each event.
+
+Give it a list of event types to only hear about those; with none, the
+callback gets every event. Callbacks are run synchronously, in the order they
+were registered, after the change has been made.
+*/
+func (s *EventStore) On(fn func(Event), types ...EventType) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	filter := map[EventType]bool{}
+	for _, t := range types {
+		filter[t] = true
+	}
+
+	s.subscribers = append(s.subscribers, subscriber{
+		fn:    fn,
+		types: filter,
+	})
+}
+
+// Notify sends events to a channel, like On(). The sends block, so the
+// channel should be buffered or drained promptly.
+func (s *EventStore) Notify(ch chan<- Event, types ...EventType) {
+	s.On(func(e Event) {
+		ch <- e
+	}, types...)
+}
+
+// listening returns whether anybody is subscribed to events.
+func (s *EventStore) listening() bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return len(s.subscribers) > 0
+}
+
+// emit sends an event to the subscribers that want it.
+func (s *EventStore) emit(e Event) {
+	s.lock.RLock()
+	subscribers := s.subscribers
+	s.lock.RUnlock()
+
+	for _, sub := range subscribers {
+		if len(sub.types) == 0 || sub.types[e.Type] {
+			sub.fn(e)
+		}
+	}
+}
+
+// getData returns the user's data, or nil if they have none.
+func (s *EventStore) getData(username string) *sessions.UserData {
+	data, err := s.SessionManager.GetAny(username)
+	if err != nil {
+		return nil
+	}
+	return data
+}
+
+// Set user variables and emit events for the ones that changed.
+func (s *EventStore) Set(username string, vars map[string]string) {
+	if !s.listening() {
+		s.SessionManager.Set(username, vars)
+		return
+	}
+
+	old := s.getVars(username, vars)
+	s.SessionManager.Set(username, vars)
+	s.emitVars(username, old, vars)
+}
+
+// getVars collects the current values of the variables about to be set.
+func (s *EventStore) getVars(username string, vars map[string]string) map[string]string {
+	old := map[string]string{}
+	for name := range vars {
+		value, err := s.SessionManager.Get(username, name)
+		if err != nil {
+			value = "undefined"
+		}
+		old[name] = value
+	}
+	return old
+}
+
+// emitVars emits events for the variables that were changed.
+func (s *EventStore) emitVars(username string, old, vars map[string]string) {
+	for name, value := range vars {
+		if old[name] == value {
+			continue
+		}
+
+		e := Event{
+			Type:     VariableSet,
+			Username: username,
+			Name:     name,
+			OldValue: old[name],
+			NewValue: value,
+		}
+		if name == "topic" {
+			e.Type = TopicChanged
+		} else if value == "undefined" {
+			e.Type = VariableDeleted
+		}
+		s.emit(e)
+	}
+}
+
+// AddHistory adds to the user's history and emits a HistoryAdded event.
+func (s *EventStore) AddHistory(username, input, reply string) {
+	s.AddHistoryEntry(username, sessions.HistoryEntry{Input: input, Reply: reply}, sessions.HistorySize)
+}
+
+// AddHistoryEntry adds an entry to the user's history, with the underlying
+// session manager's HistoryAdder if it has one, and emits a HistoryAdded
+// event.
+func (s *EventStore) AddHistoryEntry(username string, entry sessions.HistoryEntry, size int) {
+	if !s.listening() {
+		sessions.AddHistoryEntry(s.SessionManager, username, entry, size)
+		return
+	}
+
+	old := s.getData(username)
+	sessions.AddHistoryEntry(s.SessionManager, username, entry, size)
+	s.emit(Event{
+		Type:     HistoryAdded,
+		Username: username,
+		Entry:    entry,
+		OldData:  old,
+		NewData:  s.getData(username),
+	})
+}
+
+/*
+Update saves a batch of changes to the user's data, using the underlying
+session manager's Updater if it has one, and emits the same events as the
+equivalent Set() and AddHistoryEntry() calls would.
+
+The OldData and NewData of the HistoryAdded events are the user's data from
+before and after the whole update.
+*/
+func (s *EventStore) Update(username string, update sessions.Update) error {
+	if !s.listening() {
+		return sessions.ApplyUpdate(s.SessionManager, username, update)
+	}
+
+	oldVars := s.getVars(username, update.Variables)
+	var old *sessions.UserData
+	if len(update.History) > 0 {
+		old = s.getData(username)
+	}
+
+	if err := sessions.ApplyUpdate(s.SessionManager, username, update); err != nil {
+		return err
+	}
+
+	s.emitVars(username, oldVars, update.Variables)
+	if len(update.History) > 0 {
+		data := s.getData(username)
+		for _, entry := range update.History {
+			s.emit(Event{
+				Type:     HistoryAdded,
+				Username: username,
+				Entry:    entry,
+				OldData:  old,
+				NewData:  data,
+			})
+		}
+	}
+	return nil
+}
+
+// Clear deletes the user's data and emits a Cleared event.
+func (s *EventStore) Clear(username string) {
+	if !s.listening() {
+		s.SessionManager.Clear(username)
+		return
+	}
+
+	old := s.getData(username)
+	s.SessionManager.Clear(username)
+	s.emit(Event{
+		Type:     Cleared,
+		Username: username,
+		OldData:  old,
+	})
+}
+
+// ClearAll deletes all users' data and emits a Cleared event for each.
+func (s *EventStore) ClearAll() {
+	if !s.listening() {
+		s.SessionManager.ClearAll()
+		return
+	}
+
+	old := s.SessionManager.GetAll()
+	s.SessionManager.ClearAll()
+	for username, data := range old {
+		s.emit(Event{
+			Type:     Cleared,
+			Username: username,
+			OldData:  data,
+		})
+	}
+}
+
+// Freeze snapshots the user's variables and emits a Frozen event.
+func (s *EventStore) Freeze(username string) error {
+	err := s.SessionManager.Freeze(username)
+	if err != nil || !s.listening() {
+		return err
+	}
+
+	data := s.getData(username)
+	s.emit(Event{
+		Type:     Frozen,
+		Username: username,
+		OldData:  data,
+		NewData:  data,
+	})
+	return nil
+}
+
+// Thaw restores the user's variables and emits a Thawed event.
+func (s *EventStore) Thaw(username string, action sessions.ThawAction) error {
+	if !s.listening() {
+		return s.SessionManager.Thaw(username, action)
+	}
+
+	old := s.getData(username)
+	if err := s.SessionManager.Thaw(username, action); err != nil {
+		return err
+	}
+
+	s.emit(Event{
+		Type:       Thawed,
+		Username:   username,
+		ThawAction: action,
+		OldData:    old,
+		NewData:    s.getData(username),
+	})
+	return nil
+}
+
+// GetFrozen returns the user's frozen snapshot, if the underlying session
+// manager supports it.
+func (s *EventStore) GetFrozen(username string) (*sessions.UserData, error) {
+	if getter, ok := s.SessionManager.(sessions.FrozenGetter); ok {
+		return getter.GetFrozen(username)
+	}
+	return nil, fmt.Errorf("the session manager can't get frozen data")
+}
+
+// Lock locks a user with the underlying session manager's Locker, or with an
+// in-process lock if it doesn't have one.
+func (s *EventStore) Lock(username string) (func(), error) {
+	return s.locker.Lock(username)
+}
@@ -0,0 +1,73 @@
+package events_test
+
+import (
+	"testing"
+
+	"github.com/aichaos/rivescript-go/sessions"
+	"github.com/aichaos/rivescript-go/sessions/events"
+	"github.com/aichaos/rivescript-go/sessions/memory"
+)
+
+func TestEvents(t *testing.T) {
+	store := events.New(memory.New())
+
+	var got []events.Event
+	store.On(func(e events.Event) {
+		got = append(got, e)
+	})
+
+	// Only variable events go to the channel.
+	ch := make(chan events.Event, 10)
+	store.Notify(ch, events.VariableSet)
+
+	store.Set("alice", map[string]string{"name": "Alice"})
+	store.Set("alice", map[string]string{"name": "Alice"}) // No change
+	store.Set("alice", map[string]string{"name": "Ally", "topic": "chat"})
+	store.Set("alice", map[string]string{"name": "undefined"})
+	store.AddHistoryEntry("alice", sessions.HistoryEntry{Input: "hi", Reply: "hello"}, 9)
+	store.Freeze("alice")
+	store.Thaw("alice", sessions.Keep)
+	store.Clear("alice")
+
+	expect := []events.EventType{
+		events.VariableSet,
+		events.VariableSet,
+		events.TopicChanged,
+		events.VariableDeleted,
+		events.HistoryAdded,
+		events.Frozen,
+		events.Thawed,
+		events.Cleared,
+	}
+
+	// The second Set changes two variables in no particular order.
+	if len(got) == len(expect) && got[1].Type == events.TopicChanged {
+		got[1], got[2] = got[2], got[1]
+	}
+
+	if len(got) != len(expect) {
+		t.Fatalf("expected %d events, got %d: %v", len(expect), len(got), got)
+	}
+	for i, e := range got {
+		if e.Type != expect[i] || e.Username != "alice" {
+			t.Errorf("event %d: expected %s for alice, got %s for %s", i, expect[i], e.Type, e.Username)
+		}
+	}
+
+	if got[1].OldValue != "Alice" || got[1].NewValue != "Ally" {
+		t.Errorf("expected name to go from Alice to Ally, got %s to %s", got[1].OldValue, got[1].NewValue)
+	}
+	if got[2].OldValue != "random" || got[2].NewValue != "chat" {
+		t.Errorf("expected topic to go from random to chat, got %s to %s", got[2].OldValue, got[2].NewValue)
+	}
+	if got[4].Entry.Input != "hi" || got[4].NewData.History.Input(1) != "hi" {
+		t.Errorf("HistoryAdded event is missing the new entry: %+v", got[4])
+	}
+	if got[7].OldData == nil || got[7].OldData.Variables["topic"] != "chat" {
+		t.Errorf("Cleared event is missing the old data: %+v", got[7])
+	}
+
+	if len(ch) != 2 {
+		t.Errorf("expected 2 events on the channel, got %d", len(ch))
+	}
+}
@@ -0,0 +1,170 @@
+package sessions
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// ExportFormat and ExportVersion identify a session export stream.
+const (
+	ExportFormat  = "rivescript-sessions"
+	ExportVersion = 1
+)
+
+// ExportHeader is the first line of a session export.
+type ExportHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// ExportRecord holds one user's data in a session export.
+type ExportRecord struct {
+	Username string    `json:"username"`
+	Data     *UserData `json:"data"`
+	Frozen   *UserData `json:"frozen,omitempty"` // From Freeze(), if any
+}
+
+/*
+FrozenGetter is an optional interface for session managers that can return
+a user's frozen variables (the snapshot made by `Freeze()`) without thawing
+them.
+
+Session managers that implement it will have their frozen snapshots included
+by `Export()`.
+*/
+type FrozenGetter interface {
+	GetFrozen(username string) (*UserData, error)
+}
+
+/*
+Export writes the data for every user in a session manager to a stream.
+
+The format is JSON Lines: the first line is an ExportHeader and every line
+after it is an ExportRecord for one user. The output can be loaded into any
+session manager with `Import()`, which makes it useful for moving users from
+one kind of store to another.
+*/
+func Export(w io.Writer, sm SessionManager) error {
+	encoder := json.NewEncoder(w)
+	err := encoder.Encode(ExportHeader{
+		Format:  ExportFormat,
+		Version: ExportVersion,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Sort the users so that exports are repeatable.
+	users := sm.GetAll()
+	usernames := []string{}
+	for username := range users {
+		usernames = append(usernames, username)
+	}
+	sort.Strings(usernames)
+
+	for _, username := range usernames {
+		record := ExportRecord{
+			Username: username,
+			Data:     users[username],
+		}
+
+		if getter, ok := sm.(FrozenGetter); ok {
+			if frozen, err := getter.GetFrozen(username); err == nil {
+				record.Frozen = frozen
+			}
+		}
+
+		if err := encoder.Encode(record); err != nil {
+			return fmt.Errorf(`can't export username "%s": %s`, username, err)
+		}
+	}
+
+	return nil
+}
+
+/*
+Import reads a stream written by `Export()` into a session manager, and
+returns the number of users imported.
+
+Users in the stream replace any existing data the session manager had for
+them, including their frozen snapshots. Frozen snapshots are restored by
+storing them as the user's data and calling `Freeze()`, so this works with
+any SessionManager whose `Clear()` leaves the frozen copy alone, which is the
+case for all the stores in this repository.
+*/
+func Import(r io.Reader, sm SessionManager) (int, error) {
+	decoder := json.NewDecoder(r)
+
+	var header ExportHeader
+	if err := decoder.Decode(&header); err != nil {
+		return 0, fmt.Errorf("can't read the session export header: %s", err)
+	}
+	if header.Format != ExportFormat {
+		return 0, fmt.Errorf("not a session export (format is %q)", header.Format)
+	}
+	if header.Version > ExportVersion {
+		return 0, fmt.Errorf(
+			"unsupported session export version %d (we support up to %d)",
+			header.Version, ExportVersion,
+		)
+	}
+
+	var count int
+	for {
+		var record ExportRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return count, fmt.Errorf("can't read user #%d of the session export: %s", count+1, err)
+		}
+
+		if record.Username == "" {
+			return count, fmt.Errorf("user #%d of the session export has no username", count+1)
+		}
+
+		// Throw away the user's old data, including a frozen snapshot that
+		// the stream doesn't replace. Thaw() fails if there isn't one.
+		sm.Clear(record.Username)
+		if record.Frozen == nil {
+			sm.Thaw(record.Username, Discard)
+		} else {
+			putUser(sm, record.Username, record.Frozen)
+			if err := sm.Freeze(record.Username); err != nil {
+				return count, fmt.Errorf(
+					`can't restore frozen data for username "%s": %s`,
+					record.Username, err,
+				)
+			}
+			sm.Clear(record.Username)
+		}
+		if record.Data != nil {
+			putUser(sm, record.Username, record.Data)
+		} else {
+			sm.Init(record.Username)
+		}
+
+		count++
+	}
+
+	return count, nil
+}
+
+// putUser stores a whole UserData using the SessionManager methods.
+func putUser(sm SessionManager, username string, data *UserData) {
+	sm.Init(username)
+	if len(data.Variables) > 0 {
+		sm.Set(username, data.Variables)
+	}
+	sm.SetLastMatch(username, data.LastMatch)
+
+	// Add the history oldest first, so it ends up in the same order.
+	if data.History != nil {
+		size := len(data.History.Entries)
+		for i := size - 1; i >= 0; i-- {
+			AddHistoryEntry(sm, username, data.History.Entries[i], size)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package sessions_test
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aichaos/rivescript-go/sessions"
+	"github.com/aichaos/rivescript-go/sessions/memory"
+)
+
+func TestExportImport(t *testing.T) {
+	source := memory.New()
+	source.Set("alice", map[string]string{"name": "Alice", "age": "5"})
+	source.SetLastMatch("alice", "my name is *")
+	source.AddHistoryEntry("alice", sessions.HistoryEntry{Input: "first", Reply: "one"}, 5)
+	source.AddHistoryEntry("alice", sessions.HistoryEntry{Input: "second", Reply: "two"}, 5)
+	source.Freeze("alice")
+	source.Set("alice", map[string]string{"age": "6"})
+	source.Set("bob", map[string]string{"name": "Bob"})
+
+	var buf bytes.Buffer
+	if err := sessions.Export(&buf, source); err != nil {
+		t.Fatalf("export failed: %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Errorf("expected a header and 2 users in the export, got:\n%s", buf.String())
+	}
+
+	// Bob's old snapshot in the target isn't in the export, so it goes away.
+	target := memory.New()
+	target.Set("bob", map[string]string{"name": "Old Bob"})
+	target.Freeze("bob")
+
+	count, err := sessions.Import(&buf, target)
+	if err != nil {
+		t.Fatalf("import failed: %s", err)
+	}
+	if count != 2 {
+		t.Errorf("expected to import 2 users, got %d", count)
+	}
+
+	expectVar := func(username, name, expect string) {
+		value, _ := target.Get(username, name)
+		if value != expect {
+			t.Errorf("expected %s's %s to be %s, got %s", username, name, expect, value)
+		}
+	}
+	expectVar("alice", "name", "Alice")
+	expectVar("alice", "age", "6")
+	expectVar("bob", "name", "Bob")
+
+	history, _ := target.GetHistory("alice")
+	if history.Input(1) != "second" || history.Input(2) != "first" {
+		t.Errorf("history wasn't imported in order: %v", history.Entries)
+	}
+	if lastMatch, _ := target.GetLastMatch("alice"); lastMatch != "my name is *" {
+		t.Errorf("expected the last match to be imported, got %s", lastMatch)
+	}
+
+	// The frozen copy should come back too.
+	if err := target.Thaw("alice", sessions.Thaw); err != nil {
+		t.Errorf("expected alice to have frozen data: %s", err)
+	}
+	expectVar("alice", "age", "5")
+
+	if err := target.Thaw("bob", sessions.Thaw); err == nil {
+		t.Errorf("expected bob's old frozen data to be cleared by the import")
+	}
+	expectVar("bob", "name", "Bob")
+}
+
+func TestImportBadHeader(t *testing.T) {
+	_, err := sessions.Import(strings.NewReader(`{"format":"something-else","version":1}`), memory.New())
+	if err == nil {
+		t.Errorf("expected an error importing a stream with the wrong format")
+	}
+}
@@ -0,0 +1,119 @@
+package sessions
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+)
+
+// HistorySize is the default number of entries stored in the history.
+const HistorySize int = 9
+
+// HistoryEntry is a single message from the user and the bot's reply to it.
+type HistoryEntry struct {
+	Input   string    `json:"input"`
+	Reply   string    `json:"reply"`
+	Trigger string    `json:"trigger"` // The trigger that matched the input.
+	Topic   string    `json:"topic"`   // The topic the user was in.
+	Time    time.Time `json:"time"`
+}
+
+/*
+HistoryAdder is an optional interface for session managers that can keep a
+whole HistoryEntry, with the trigger, topic and time, and keep as many entries
+as the bot's HistorySize. Stores that don't implement it get the input and
+reply with AddHistory(), and keep their own number of entries.
+*/
+type HistoryAdder interface {
+	AddHistoryEntry(username string, entry HistoryEntry, size int)
+}
+
+// AddHistoryEntry adds an entry to a user's history, with the session
+// manager's HistoryAdder implementation if it has one, or AddHistory() if not.
+func AddHistoryEntry(sm SessionManager, username string, entry HistoryEntry, size int) {
+	if adder, ok := sm.(HistoryAdder); ok {
+		adder.AddHistoryEntry(username, entry, size)
+		return
+	}
+	sm.AddHistory(username, entry.Input, entry.Reply)
+}
+
+// History keeps track of recent input and reply history.
+//
+// The entries are ordered from the most recent to the oldest.
+type History struct {
+	Entries []HistoryEntry `json:"entries"`
+}
+
+// NewHistory creates a new, empty History object.
+func NewHistory() *History {
+	return &History{
+		Entries: []HistoryEntry{},
+	}
+}
+
+// Add puts a new entry at the front of the history, and drops the oldest
+// entries to keep no more than `size` of them. A size of zero or less means
+// to use the default HistorySize.
+func (h *History) Add(entry HistoryEntry, size int) {
+	if size <= 0 {
+		size = HistorySize
+	}
+
+	entry.Input = strings.TrimSpace(entry.Input)
+	entry.Reply = strings.TrimSpace(entry.Reply)
+
+	h.Entries = append([]HistoryEntry{entry}, h.Entries...)
+	if len(h.Entries) > size {
+		h.Entries = h.Entries[:size]
+	}
+}
+
+// Input returns the user's Nth most recent message, where 1 is the latest
+// (the same numbering as the `<inputN>` tags). Returns "undefined" if the
+// history doesn't go back that far.
+func (h *History) Input(n int) string {
+	if h == nil || n < 1 || n > len(h.Entries) {
+		return "undefined"
+	}
+	return h.Entries[n-1].Input
+}
+
+// Reply returns the bot's Nth most recent reply, numbered like Input().
+func (h *History) Reply(n int) string {
+	if h == nil || n < 1 || n > len(h.Entries) {
+		return "undefined"
+	}
+	return h.Entries[n-1].Reply
+}
+
+// UnmarshalJSON decodes a History, including the older format where input
+// and reply were separate arrays padded out with "undefined".
+func (h *History) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Entries []HistoryEntry `json:"entries"`
+		Input   []string       `json:"input"`
+		Reply   []string       `json:"reply"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	h.Entries = raw.Entries
+	if h.Entries == nil {
+		h.Entries = []HistoryEntry{}
+		for i, input := range raw.Input {
+			if input == "undefined" {
+				break
+			}
+
+			entry := HistoryEntry{Input: input}
+			if i < len(raw.Reply) {
+				entry.Reply = raw.Reply[i]
+			}
+			h.Entries = append(h.Entries, entry)
+		}
+	}
+
+	return nil
+}
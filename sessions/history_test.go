@@ -0,0 +1,60 @@
+package sessions
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHistoryAdd(t *testing.T) {
+	h := NewHistory()
+	for _, input := range []string{"one", "two", "three", "four"} {
+		h.Add(HistoryEntry{Input: input, Reply: "re: " + input}, 3)
+	}
+
+	if len(h.Entries) != 3 {
+		t.Errorf("expected 3 history entries, got %d", len(h.Entries))
+	}
+
+	expect := map[int]string{
+		1: "four",
+		2: "three",
+		3: "two",
+		4: "undefined",
+		0: "undefined",
+	}
+	for n, input := range expect {
+		if h.Input(n) != input {
+			t.Errorf("expected Input(%d) to be %s, got %s", n, input, h.Input(n))
+		}
+	}
+	if h.Reply(1) != "re: four" {
+		t.Errorf("expected Reply(1) to be 're: four', got %s", h.Reply(1))
+	}
+}
+
+func TestHistoryLegacyJSON(t *testing.T) {
+	// The old format kept parallel arrays padded with "undefined".
+	legacy := `{
+		"vars": {"topic": "random"},
+		"lastMatch": "hello bot",
+		"history": {
+			"input": ["hello bot", "hi", "undefined", "undefined"],
+			"reply": ["hello human", "hey", "undefined", "undefined"]
+		}
+	}`
+
+	var data *UserData
+	if err := json.Unmarshal([]byte(legacy), &data); err != nil {
+		t.Fatalf("couldn't decode legacy user data: %s", err)
+	}
+
+	if len(data.History.Entries) != 2 {
+		t.Errorf("expected 2 history entries, got %d", len(data.History.Entries))
+	}
+	if data.History.Input(2) != "hi" || data.History.Reply(2) != "hey" {
+		t.Errorf("got unexpected legacy history: %v", data.History.Entries)
+	}
+	if data.LastMatch != "hello bot" {
+		t.Errorf("expected LastMatch to survive decoding, got %s", data.LastMatch)
+	}
+}
@@ -59,35 +59,11 @@ type SessionManager interface {
 	Thaw(username string, ThawAction ThawAction) error
 }
 
-// HistorySize is the number of entries stored in the history.
-const HistorySize int = 9
-
 // UserData is a container for user variables.
 type UserData struct {
 	Variables map[string]string `json:"vars"`
 	LastMatch string            `json:"lastMatch"`
-	*History  `json:"history"`
-}
-
-// History keeps track of recent input and reply history.
-type History struct {
-	Input []string `json:"input"`
-	Reply []string `json:"reply"`
-}
-
-// NewHistory creates a new History object with the history arrays filled out.
-func NewHistory() *History {
-	h := &History{
-		Input: []string{},
-		Reply: []string{},
-	}
-
-	for i := 0; i < HistorySize; i++ {
-		h.Input = append(h.Input, "undefined")
-		h.Reply = append(h.Reply, "undefined")
-	}
-
-	return h
+	History   *History          `json:"history"`
 }
 
 // Type ThawAction describes the action for the `Thaw()` method.
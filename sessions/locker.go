@@ -0,0 +1,67 @@
+package sessions
+
+import "sync"
+
+/*
+Locker is an optional interface for session managers that can lock a user's
+data, so that one reply at a time reads and writes it.
+
+RiveScript uses it when `Config.LockUsers` is enabled. A store that's shared
+between several processes (like Redis) should implement it with a lock that
+all of those processes can see. Stores that don't implement it are locked
+with a LocalLocker, which only works within one program.
+
+Lock blocks until the user's lock is acquired and returns the function that
+releases it, or returns an error if the lock couldn't be acquired.
+*/
+type Locker interface {
+	Lock(username string) (unlock func(), err error)
+}
+
+// LocalLocker is an in-process Locker that keeps one mutex per user.
+type LocalLocker struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+// userLock is a user's mutex, with a count of the goroutines using it so it
+// can be cleaned up once nobody is.
+type userLock struct {
+	sync.Mutex
+	refs int
+}
+
+// NewLocalLocker creates a new in-process user locker.
+func NewLocalLocker() *LocalLocker {
+	return &LocalLocker{
+		locks: map[string]*userLock{},
+	}
+}
+
+// Lock acquires the lock for a user. It never returns an error.
+func (l *LocalLocker) Lock(username string) (func(), error) {
+	l.mu.Lock()
+	lock, ok := l.locks[username]
+	if !ok {
+		lock = &userLock{}
+		l.locks[username] = lock
+	}
+	lock.refs++
+	l.mu.Unlock()
+
+	lock.Lock()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			lock.Unlock()
+
+			l.mu.Lock()
+			lock.refs--
+			if lock.refs == 0 {
+				delete(l.locks, username)
+			}
+			l.mu.Unlock()
+		})
+	}, nil
+}
@@ -0,0 +1,46 @@
+package sessions
+
+import (
+	"runtime"
+	"sync"
+	"testing"
+)
+
+func TestLocalLocker(t *testing.T) {
+	locker := NewLocalLocker()
+
+	// Many goroutines doing a read-modify-write on the same user.
+	var (
+		wg      sync.WaitGroup
+		counter int
+	)
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			unlock, _ := locker.Lock("alice")
+			defer unlock()
+
+			value := counter
+			runtime.Gosched()
+			counter = value + 1
+		}()
+	}
+	wg.Wait()
+
+	if counter != 50 {
+		t.Errorf("expected the counter to be 50, got %d", counter)
+	}
+
+	// Different users don't block each other.
+	unlockAlice, _ := locker.Lock("alice")
+	unlockBob, _ := locker.Lock("bob")
+	unlockBob()
+	unlockAlice()
+
+	// Unlocking twice is harmless, and unused locks are cleaned up.
+	unlockAlice()
+	if len(locker.locks) != 0 {
+		t.Errorf("expected no locks to be left over, got %d", len(locker.locks))
+	}
+}
@@ -3,7 +3,6 @@ package memory
 
 import (
 	"fmt"
-	"strings"
 	"sync"
 
 	"github.com/aichaos/rivescript-go/sessions"
@@ -49,14 +48,16 @@ func (s *MemoryStore) Set(username string, vars map[string]string) {
 
 // AddHistory adds history items.
 func (s *MemoryStore) AddHistory(username, input, reply string) {
+	s.AddHistoryEntry(username, sessions.HistoryEntry{Input: input, Reply: reply}, sessions.HistorySize)
+}
+
+// AddHistoryEntry adds an entry to the history, keeping `size` entries.
+func (s *MemoryStore) AddHistoryEntry(username string, entry sessions.HistoryEntry, size int) {
 	data := s.Init(username)
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	data.History.Input = data.History.Input[:len(data.History.Input)-1]                    // Pop
-	data.History.Input = append([]string{strings.TrimSpace(input)}, data.History.Input...) // Unshift
-	data.History.Reply = data.History.Reply[:len(data.History.Reply)-1]                    // Pop
-	data.History.Reply = append([]string{strings.TrimSpace(reply)}, data.History.Reply...) // Unshift
+	data.History.Add(entry, size)
 }
 
 // SetLastMatch sets the user's last matched trigger.
@@ -67,6 +68,24 @@ func (s *MemoryStore) SetLastMatch(username, trigger string) {
 	data.LastMatch = trigger
 }
 
+// Update saves a batch of changes to a user's data at once.
+func (s *MemoryStore) Update(username string, update sessions.Update) error {
+	data := s.Init(username)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for k, v := range update.Variables {
+		data.Variables[k] = v
+	}
+	if update.HasLastMatch {
+		data.LastMatch = update.LastMatch
+	}
+	for _, entry := range update.History {
+		data.History.Add(entry, update.HistorySize)
+	}
+	return nil
+}
+
 // Get a user variable.
 func (s *MemoryStore) Get(username, name string) (string, error) {
 	s.lock.Lock()
@@ -101,7 +120,7 @@ func (s *MemoryStore) GetAll() map[string]*sessions.UserData {
 	defer s.lock.Unlock()
 
 	// Make safe copies of all our structures.
-	var result map[string]*sessions.UserData
+	result := map[string]*sessions.UserData{}
 	for k, v := range s.users {
 		result[k] = cloneUser(v)
 	}
@@ -163,6 +182,18 @@ func (s *MemoryStore) Freeze(username string) error {
 	return nil
 }
 
+// GetFrozen returns a copy of the user's frozen snapshot.
+func (s *MemoryStore) GetFrozen(username string) (*sessions.UserData, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	frozen, ok := s.frozen[username]
+	if !ok {
+		return nil, fmt.Errorf(`no frozen data for username "%s"`, username)
+	}
+	return cloneUser(frozen), nil
+}
+
 // Thaw restores from a snapshot.
 func (s *MemoryStore) Thaw(username string, action sessions.ThawAction) error {
 	s.lock.Lock()
@@ -194,11 +225,9 @@ func cloneUser(data *sessions.UserData) *sessions.UserData {
 		new.Variables[k] = v
 	}
 
-	// Copy history.
-	for i := 0; i < sessions.HistorySize; i++ {
-		new.History.Input[i] = data.History.Input[i]
-		new.History.Reply[i] = data.History.Reply[i]
-	}
+	// Copy the last match and history.
+	new.LastMatch = data.LastMatch
+	new.History.Entries = append(new.History.Entries, data.History.Entries...)
 
 	return new
 }
@@ -22,6 +22,8 @@ func (s *NullStore) Set(username string, vars map[string]string) {}
 
 func (s *NullStore) AddHistory(username, input, reply string) {}
 
+func (s *NullStore) AddHistoryEntry(username string, entry sessions.HistoryEntry, size int) {}
+
 func (s *NullStore) SetLastMatch(username, trigger string) {}
 
 func (s *NullStore) Get(username string, name string) (string, error) {
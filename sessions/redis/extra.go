@@ -3,13 +3,66 @@ package redis
 // NOTE: This file contains added functions above and beyond the SessionManager
 // implementation.
 
+/*
+How the data is laid out in Redis:
+
+Each user's variables and last matched trigger are fields of a hash stored at
+`<prefix><username>`, so that setting one variable doesn't need to read and
+rewrite the others. Variables are stored in fields named `var:<name>` and the
+last match in a field named `lastMatch`.
+
+The user's history is a list at `<history prefix><username>`, newest first,
+with one JSON encoded sessions.HistoryEntry per item.
+
+Frozen copies of user data (from `Freeze()`) are stored as a JSON encoded
+sessions.UserData at `<frozen prefix><username>`.
+
+Older versions stored the whole sessions.UserData as JSON at the user's key.
+Users in that format are converted the first time they're accessed.
+*/
+
 import (
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/aichaos/rivescript-go/sessions"
+	redis "gopkg.in/redis.v5"
 )
 
+// Names of the fields in the users' hashes.
+const (
+	varField       = "var:"
+	lastMatchField = "lastMatch"
+)
+
+// lockPoll is how often Lock() retries while another reply holds the lock.
+const lockPoll = 10 * time.Millisecond
+
+// unlockScript deletes a lock only if it still holds our token, so we can't
+// release a lock that expired and was taken by somebody else.
+const unlockScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("del", KEYS[1])
+end
+return 0
+`
+
+// renewScript resets a lock's expiry only if it still holds our token.
+const renewScript = `
+if redis.call("get", KEYS[1]) == ARGV[1] then
+	return redis.call("pexpire", KEYS[1], ARGV[2])
+end
+return 0
+`
+
+// scanCount is the number of keys to ask for with each SCAN command.
+const scanCount = 100
+
 // key generates a key name to use in Redis.
 func (s *Session) key(username string) string {
 	return s.prefix + username
@@ -20,24 +73,205 @@ func (s *Session) frozenKey(username string) string {
 	return s.frozenPrefix + username
 }
 
-// getRedis gets a UserData out of the Redis cache.
-func (s *Session) getRedis(username string) (*sessions.UserData, error) {
-	data, err := s.getRedisFrozen(username, false)
-	return data, err
+// historyKey generates the key name for a user's history list.
+func (s *Session) historyKey(username string) string {
+	return s.historyPrefix + username
+}
+
+// lockKey generates the key name for a user's lock.
+func (s *Session) lockKey(username string) string {
+	return s.lockPrefix + username
+}
+
+/*
+Lock acquires a lock on a user's data that's shared by every program using
+the same Redis server, so that one reply at a time reads and writes it. This
+implements the sessions.Locker interface.
+
+The lock expires after the LockTimeout in case it's never released. While
+it's held, its expiry is renewed every third of the LockTimeout, so a reply
+that runs longer than that keeps the lock. If it can't be acquired within the
+LockWait, an error is returned.
+*/
+func (s *Session) Lock(username string) (func(), error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, err
+	}
+	value := hex.EncodeToString(token)
+	key := s.lockKey(username)
+
+	deadline := time.Now().Add(s.lockWait)
+	for {
+		ok, err := s.client.SetNX(key, value, s.lockTimeout).Result()
+		if err != nil {
+			return nil, fmt.Errorf(`can't lock username "%s": %s`, username, err)
+		}
+		if ok {
+			break
+		}
+
+		if time.Now().After(deadline) {
+			return nil, fmt.Errorf(`timed out waiting for the lock on username "%s"`, username)
+		}
+		time.Sleep(lockPoll)
+	}
+
+	stop := make(chan struct{})
+	go s.renewLock(key, value, stop)
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			close(stop)
+			s.client.Eval(unlockScript, []string{key}, value)
+		})
+	}, nil
+}
+
+// renewLock keeps extending a lock that's held with the token value until
+// the stop channel is closed, or the lock is found to belong to someone else.
+func (s *Session) renewLock(key, value string, stop chan struct{}) {
+	ticker := time.NewTicker(s.lockTimeout / 3)
+	defer ticker.Stop()
+
+	ttl := int64(s.lockTimeout / time.Millisecond)
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			result, err := s.client.Eval(renewScript, []string{key}, value, ttl).Result()
+			if renewed, ok := result.(int64); err == nil && ok && renewed == 0 {
+				// The lock expired and was lost; there's nothing to renew.
+				return
+			}
+		}
+	}
 }
 
-// getRedisFrozen is the implementation behind getRedis and allows for the
-// key to be overridden with the 'frozen' version.
-func (s *Session) getRedisFrozen(username string, frozen bool) (*sessions.UserData, error) {
-	var key string
-	if frozen {
-		key = s.frozenKey(username)
-	} else {
-		key = s.key(username)
+// exec runs a pipeline of commands for a user. If the user's data was in the
+// older JSON format it's converted first and the pipeline is run again.
+func (s *Session) exec(username string, fn func(pipe *redis.Pipeline)) ([]redis.Cmder, error) {
+	run := func() ([]redis.Cmder, error) {
+		pipe := s.client.Pipeline()
+		defer pipe.Close()
+		fn(pipe)
+		return pipe.Exec()
+	}
+
+	cmds, err := run()
+	if isWrongType(err) {
+		if err = s.upgradeUser(username); err == nil {
+			cmds, err = run()
+		}
+	}
+	return cmds, err
+}
+
+// initUser adds the commands to a pipeline that create a user's default
+// session, if they don't already have one.
+func (s *Session) initUser(pipe *redis.Pipeline, username string) {
+	pipe.HSetNX(s.key(username), varField+"topic", "random")
+}
+
+// getUser gets a UserData out of Redis.
+func (s *Session) getUser(username string) (*sessions.UserData, error) {
+	var (
+		hash    *redis.StringStringMapCmd
+		history *redis.StringSliceCmd
+	)
+	_, err := s.exec(username, func(pipe *redis.Pipeline) {
+		hash = pipe.HGetAll(s.key(username))
+		history = pipe.LRange(s.historyKey(username), 0, -1)
+	})
+	if err != nil {
+		return nil, fmt.Errorf(`no data for username "%s": %s`, username, err)
+	}
+
+	fields := hash.Val()
+	if len(fields) == 0 {
+		return nil, fmt.Errorf(`no data for username "%s"`, username)
+	}
+
+	user := &sessions.UserData{
+		Variables: map[string]string{},
+		LastMatch: fields[lastMatchField],
+		History:   sessions.NewHistory(),
+	}
+	for field, value := range fields {
+		if strings.HasPrefix(field, varField) {
+			user.Variables[strings.TrimPrefix(field, varField)] = value
+		}
+	}
+
+	for _, item := range history.Val() {
+		var entry sessions.HistoryEntry
+		if err := json.Unmarshal([]byte(item), &entry); err != nil {
+			return nil, fmt.Errorf(
+				`JSON unmarshal error in history for username "%s": %s`,
+				username, err,
+			)
+		}
+		user.History.Entries = append(user.History.Entries, entry)
 	}
 
+	return user, nil
+}
+
+// putUser replaces all of a user's data in Redis.
+func (s *Session) putUser(username string, data *sessions.UserData) error {
+	pipe := s.client.Pipeline()
+	defer pipe.Close()
+
+	pipe.Del(s.key(username))
+	pipe.Del(s.historyKey(username))
+
+	s.initUser(pipe, username)
+	for key, value := range data.Variables {
+		pipe.HSet(s.key(username), varField+key, value)
+	}
+	pipe.HSet(s.key(username), lastMatchField, data.LastMatch)
+
+	if data.History != nil && len(data.History.Entries) > 0 {
+		items := []interface{}{}
+		for _, entry := range data.History.Entries {
+			encoded, err := encodeEntry(entry)
+			if err != nil {
+				return err
+			}
+			items = append(items, encoded)
+		}
+		pipe.RPush(s.historyKey(username), items...)
+	}
+
+	_, err := pipe.Exec()
+	return err
+}
+
+// upgradeUser converts a user from the older format, where their whole
+// UserData was stored as JSON at their key.
+func (s *Session) upgradeUser(username string) error {
+	value, err := s.client.Get(s.key(username)).Result()
+	if err != nil {
+		return err
+	}
+
+	var user *sessions.UserData
+	if err := json.Unmarshal([]byte(value), &user); err != nil {
+		return fmt.Errorf(
+			`JSON unmarshal error for username "%s": %s`,
+			username, err,
+		)
+	}
+
+	return s.putUser(username, user)
+}
+
+// getFrozen gets a user's frozen UserData out of the Redis cache.
+func (s *Session) getFrozen(username string) (*sessions.UserData, error) {
 	// Check Redis for the key.
-	value, err := s.client.Get(key).Result()
+	value, err := s.client.Get(s.frozenKey(username)).Result()
 	if err != nil {
 		return nil, fmt.Errorf(
 			`no data for username "%s": %s`,
@@ -58,33 +292,80 @@ func (s *Session) getRedisFrozen(username string, frozen bool) (*sessions.UserDa
 	return user, nil
 }
 
-// putRedis puts a UserData into the Redis cache.
-func (s *Session) putRedis(username string, data *sessions.UserData) {
-	s.putRedisFrozen(username, data, false)
-}
-
-// putRedisFrozen is the implementation behind putRedis and allows for the
-// key to be overridden with the 'frozen' version.
-func (s *Session) putRedisFrozen(username string, data *sessions.UserData, frozen bool) error {
-	// Which key to use?
-	var key string
-	if frozen {
-		key = s.frozenKey(username)
-	} else {
-		key = s.key(username)
-	}
-
+// putFrozen puts a user's frozen UserData into the Redis cache.
+func (s *Session) putFrozen(username string, data *sessions.UserData) error {
 	encoded, err := json.MarshalIndent(data, "", "\t")
 	if err != nil {
 		return err
 	}
 
-	err = s.client.Set(key, string(encoded), 0).Err()
-	if err != nil {
-		return err
+	return s.client.Set(s.frozenKey(username), string(encoded), 0).Err()
+}
+
+// scan iterates over the keys with a prefix using SCAN, calling fn with each
+// batch of keys. On a cluster or ring, every node is scanned.
+func (s *Session) scan(prefix string, fn func(keys []string) error) error {
+	match := escapePattern(prefix) + "*"
+
+	scanClient := func(client Client) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.Scan(cursor, match, scanCount).Result()
+			if err != nil {
+				return err
+			}
+
+			if len(keys) > 0 {
+				if err := fn(keys); err != nil {
+					return err
+				}
+			}
+
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	}
+
+	switch client := s.client.(type) {
+	case interface {
+		ForEachMaster(func(*redis.Client) error) error
+	}:
+		return client.ForEachMaster(func(node *redis.Client) error {
+			return scanClient(node)
+		})
+	case interface {
+		ForEachShard(func(*redis.Client) error) error
+	}:
+		return client.ForEachShard(func(node *redis.Client) error {
+			return scanClient(node)
+		})
 	}
+	return scanClient(s.client)
+}
+
+// escapePattern escapes the glob characters in a string for use with SCAN.
+func escapePattern(text string) string {
+	return strings.NewReplacer(
+		`\`, `\\`,
+		`*`, `\*`,
+		`?`, `\?`,
+		`[`, `\[`,
+		`]`, `\]`,
+	).Replace(text)
+}
+
+// isWrongType tells whether an error is Redis complaining about the type of
+// a key, which happens when a user's data is still in the older format.
+func isWrongType(err error) bool {
+	return err != nil && strings.HasPrefix(err.Error(), "WRONGTYPE")
+}
 
-	return nil
+// encodeEntry encodes a history entry to JSON.
+func encodeEntry(entry sessions.HistoryEntry) (string, error) {
+	encoded, err := json.Marshal(entry)
+	return string(encoded), err
 }
 
 // defaultSession initializes the default session variables for a user.
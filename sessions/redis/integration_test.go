@@ -6,15 +6,26 @@ import (
 	rivescript "github.com/aichaos/rivescript-go"
 	"github.com/aichaos/rivescript-go/sessions"
 	"github.com/aichaos/rivescript-go/sessions/redis"
+	"github.com/alicebob/miniredis"
+	goRedis "gopkg.in/redis.v5"
 )
 
 // This script tests the 'integration' of the RiveScript public API with the
 // RiveScript-Redis public API.
 
 func TestIntegration(t *testing.T) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("couldn't start the Redis server: %s", err)
+	}
+	defer m.Close()
+
 	bot := rivescript.New(&rivescript.Config{
 		SessionManager: redis.New(&redis.Config{
 			Prefix: "rivescript:integration/",
+			Redis: &goRedis.Options{
+				Addr: m.Addr(),
+			},
 		}),
 	})
 	bot.Stream(`
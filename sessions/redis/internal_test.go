@@ -1,35 +1,41 @@
 package redis
 
 // This tests the internal interface of just the Redis specific bits,
-// independent of RiveScript. At time of writing, this test file gets
-// us to 93.4% coverage!
+// independent of RiveScript. The tests run against miniredis, an in-process
+// stand-in for a Redis server.
 
 import (
+	"encoding/json"
 	"fmt"
-	"os"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/aichaos/rivescript-go/sessions"
+	"github.com/alicebob/miniredis"
+	redis "gopkg.in/redis.v5"
 )
 
-// newTest creates a new test environment with a new Redis prefix.
-// The generated prefix takes the form: `redis_test:<PID>:<name>`
-func newTest(name string) *Session {
+// newTest creates a new test environment with its own Redis server.
+// The generated prefix takes the form: `rivescript:<name>/`
+func newTest(t *testing.T, name string) (*Session, *miniredis.Miniredis) {
+	m, err := miniredis.Run()
+	if err != nil {
+		t.Fatalf("couldn't start the Redis server: %s", err)
+	}
+
 	s := New(&Config{
-		Prefix: fmt.Sprintf("rivescript:%d:%s/", os.Getpid(), name),
+		Prefix: fmt.Sprintf("rivescript:%s/", name),
+		Redis: &redis.Options{
+			Addr: m.Addr(),
+		},
 	})
-	s.ClearAll()
-	return s
-}
-
-// tearDown deletes a Redis prefix after the test is done.
-func tearDown(s *Session) {
-	s.ClearAll()
+	return s, m
 }
 
 func TestRedis(t *testing.T) {
-	s := newTest("main")
-	defer tearDown(s)
+	s, m := newTest(t, "main")
+	defer m.Close()
 
 	// There should be no user data yet.
 	s.expectCount(t, 0)
@@ -61,36 +67,58 @@ func TestRedis(t *testing.T) {
 
 		// She should have an empty history.
 		history, _ := s.GetHistory(username)
-		for i := 0; i < sessions.HistorySize; i++ {
-			if history.Input[i] != "undefined" {
+		for i := 1; i <= sessions.HistorySize; i++ {
+			if history.Input(i) != "undefined" {
 				t.Errorf(
-					"expected to have a blank history, but input[%d] = %s",
+					"expected to have a blank history, but input%d = %s",
 					i,
-					history.Input[i],
+					history.Input(i),
 				)
 			}
-			if history.Reply[i] != "undefined" {
+			if history.Reply(i) != "undefined" {
 				t.Errorf(
-					"expected to have a blank history, but reply[%d] = %s",
+					"expected to have a blank history, but reply%d = %s",
 					i,
-					history.Reply[i],
+					history.Reply(i),
 				)
 			}
 		}
 
 		// Add some history.
-		s.AddHistory(username, "hello bot", "hello human")
+		s.AddHistoryEntry(username, sessions.HistoryEntry{
+			Input:   "hello bot",
+			Reply:   "hello human",
+			Trigger: "hello bot",
+			Topic:   "random",
+		}, 2)
 		history, _ = s.GetHistory(username)
-		if history.Input[0] != "hello bot" {
+		if history.Input(1) != "hello bot" {
 			t.Errorf(
 				"got unexpected input history: expected 'hello bot', got %s",
-				history.Input[0],
+				history.Input(1),
 			)
 		}
-		if history.Reply[0] != "hello human" {
+		if history.Reply(1) != "hello human" {
 			t.Errorf(
 				"got unexpected reply history: expected 'hello human', got %s",
-				history.Reply[0],
+				history.Reply(1),
+			)
+		}
+		if history.Entries[0].Trigger != "hello bot" {
+			t.Errorf(
+				"got unexpected trigger in history: expected 'hello bot', got %s",
+				history.Entries[0].Trigger,
+			)
+		}
+
+		// The history should be capped to the size given.
+		s.AddHistoryEntry(username, sessions.HistoryEntry{Input: "two"}, 2)
+		s.AddHistoryEntry(username, sessions.HistoryEntry{Input: "three"}, 2)
+		history, _ = s.GetHistory(username)
+		if len(history.Entries) != 2 || history.Input(2) != "two" {
+			t.Errorf(
+				"expected the history to be capped at 2 entries, but got: %v",
+				history.Entries,
 			)
 		}
 
@@ -219,6 +247,174 @@ func TestRedis(t *testing.T) {
 	}
 }
 
+func TestRedisUpgrade(t *testing.T) {
+	s, m := newTest(t, "upgrade")
+	defer m.Close()
+
+	// Store a user in the older format, with the whole UserData as JSON.
+	history := sessions.NewHistory()
+	history.Add(sessions.HistoryEntry{Input: "hello", Reply: "hi"}, 0)
+	legacy, _ := json.Marshal(&sessions.UserData{
+		Variables: map[string]string{
+			"topic": "random",
+			"name":  "Alice",
+		},
+		LastMatch: "hello",
+		History:   history,
+	})
+	m.Set(s.key("alice"), string(legacy))
+
+	// Reading them converts them to a hash.
+	s.checkVariable(t, "alice", "name", "Alice", false)
+	if !m.Exists(s.key("alice")) || m.Type(s.key("alice")) != "hash" {
+		t.Errorf("expected the user's key to be converted to a hash")
+	}
+
+	if lastMatch, _ := s.GetLastMatch("alice"); lastMatch != "hello" {
+		t.Errorf("expected last match 'hello', got: %s", lastMatch)
+	}
+	if history, _ := s.GetHistory("alice"); history.Input(1) != "hello" {
+		t.Errorf("expected history input 'hello', got: %s", history.Input(1))
+	}
+
+	// Writing to a user in the older format converts them too.
+	m.Set(s.key("bob"), string(legacy))
+	s.Set("bob", map[string]string{"age": "5"})
+	s.checkVariable(t, "bob", "name", "Alice", false)
+	s.checkVariable(t, "bob", "age", "5", false)
+}
+
+func TestRedisGetVariable(t *testing.T) {
+	s, m := newTest(t, "get")
+	defer m.Close()
+
+	s.Set("alice", map[string]string{"name": "Alice"})
+
+	// Reading one variable only looks at its field, not the user's history.
+	m.Push(s.historyKey("alice"), "not json")
+	s.checkVariable(t, "alice", "name", "Alice", false)
+	s.checkVariable(t, "alice", "age", "", true)
+	s.checkVariable(t, "bob", "name", "", true)
+}
+
+func TestRedisConcurrentSet(t *testing.T) {
+	s, m := newTest(t, "concurrent")
+	defer m.Close()
+
+	// Setting different variables at the same time mustn't lose any of them.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			s.Set("alice", map[string]string{
+				fmt.Sprintf("var%d", i): "true",
+			})
+		}(i)
+	}
+	wg.Wait()
+
+	for i := 0; i < 20; i++ {
+		s.checkVariable(t, "alice", fmt.Sprintf("var%d", i), "true", false)
+	}
+}
+
+func TestRedisScan(t *testing.T) {
+	s, m := newTest(t, "scan")
+	defer m.Close()
+
+	// More users than one SCAN call returns, plus keys that only look like
+	// they match the prefix.
+	for i := 0; i < scanCount*2+5; i++ {
+		s.Set(fmt.Sprintf("user%d", i), map[string]string{"name": "x"})
+	}
+	m.Set("rivescript:scanner/bob", "not a user")
+	s.expectCount(t, scanCount*2+5)
+
+	s.ClearAll()
+	s.expectCount(t, 0)
+	if !m.Exists("rivescript:scanner/bob") {
+		t.Errorf("ClearAll deleted a key outside its prefix")
+	}
+}
+
+func TestRedisLock(t *testing.T) {
+	s, m := newTest(t, "lock")
+	defer m.Close()
+	s.lockWait = 50 * time.Millisecond
+
+	unlock, err := s.Lock("alice")
+	if err != nil {
+		t.Fatalf("couldn't lock alice: %s", err)
+	}
+
+	// A second lock on the same user times out, but other users are fine.
+	if _, err := s.Lock("alice"); err == nil {
+		t.Errorf("expected the second lock on alice to time out")
+	}
+	unlockBob, err := s.Lock("bob")
+	if err != nil {
+		t.Errorf("couldn't lock bob: %s", err)
+	} else {
+		unlockBob()
+	}
+
+	// Once released, it can be locked again.
+	unlock()
+	unlock, err = s.Lock("alice")
+	if err != nil {
+		t.Errorf("couldn't lock alice after unlocking: %s", err)
+	}
+
+	// An expired lock that somebody else took isn't released by its old owner.
+	m.FastForward(s.lockTimeout + time.Second)
+	other, err := s.Lock("alice")
+	if err != nil {
+		t.Fatalf("couldn't lock alice after the lock expired: %s", err)
+	}
+	unlock()
+	if !m.Exists(s.lockKey("alice")) {
+		t.Errorf("an expired lock's owner released somebody else's lock")
+	}
+	other()
+	if m.Exists(s.lockKey("alice")) {
+		t.Errorf("the lock wasn't released")
+	}
+}
+
+func TestRedisLockRenewal(t *testing.T) {
+	s, m := newTest(t, "renew")
+	defer m.Close()
+	s.lockTimeout = 60 * time.Millisecond
+
+	unlock, err := s.Lock("alice")
+	if err != nil {
+		t.Fatalf("couldn't lock alice: %s", err)
+	}
+
+	// The lock's expiry is reset while it's held.
+	m.FastForward(40 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	if ttl := m.TTL(s.lockKey("alice")); ttl <= 20*time.Millisecond {
+		t.Errorf("expected the lock to be renewed, but its TTL is %s", ttl)
+	}
+
+	// It's still held long after the LockTimeout would've expired it.
+	for i := 0; i < 5; i++ {
+		time.Sleep(30 * time.Millisecond)
+		m.FastForward(40 * time.Millisecond)
+	}
+	s.lockWait = 30 * time.Millisecond
+	if _, err := s.Lock("alice"); err == nil {
+		t.Errorf("expected a second lock on alice to time out while the lock is renewed")
+	}
+
+	unlock()
+	if m.Exists(s.lockKey("alice")) {
+		t.Errorf("the lock wasn't released")
+	}
+}
+
 // checkVariable handles tests on user variables.
 func (s *Session) checkVariable(t *testing.T, username, name, expected string, expectError bool) {
 	value, err := s.Get(username, name)
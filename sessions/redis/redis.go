@@ -6,6 +6,7 @@ package redis
 import (
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/aichaos/rivescript-go/sessions"
 	redis "gopkg.in/redis.v5"
@@ -23,15 +24,58 @@ type Config struct {
 	// `Freeze()`). The default is `frozen:<prefix>`
 	FrozenPrefix string
 
+	// The key used to prefix the users' history lists. The default is
+	// `history:<prefix>`
+	HistoryPrefix string
+
+	// The key used to prefix the users' locks (see `Lock()`). The default is
+	// `lock:<prefix>`
+	LockPrefix string
+
+	// LockTimeout is how long a user's lock is held before Redis expires it,
+	// in case the program holding it crashes. It's renewed while the lock is
+	// held. Default 10 seconds.
+	LockTimeout time.Duration
+
+	// LockWait is how long `Lock()` waits for another reply to release the
+	// lock before giving up. The default is the LockTimeout.
+	LockWait time.Duration
+
 	// Settings for the Redis client.
 	Redis *redis.Options
+
+	// Client is an existing Redis client to use instead of creating a new one
+	// from the Redis options. This can be a *redis.ClusterClient, a
+	// *redis.Ring, or a client from redis.NewFailoverClient() for Sentinel.
+	Client Client
+}
+
+/*
+Client is the subset of the Redis client API that the session store uses.
+
+It's satisfied by *redis.Client, *redis.ClusterClient and *redis.Ring. When
+the client also has a `ForEachMaster()` or `ForEachShard()` method (like the
+cluster and ring clients do), `GetAll()` and `ClearAll()` scan every node.
+*/
+type Client interface {
+	Del(keys ...string) *redis.IntCmd
+	Get(key string) *redis.StringCmd
+	Set(key string, value interface{}, expiration time.Duration) *redis.StatusCmd
+	SetNX(key string, value interface{}, expiration time.Duration) *redis.BoolCmd
+	Eval(script string, keys []string, args ...interface{}) *redis.Cmd
+	Scan(cursor uint64, match string, count int64) *redis.ScanCmd
+	Pipeline() *redis.Pipeline
 }
 
 // Session wraps a Redis client connection.
 type Session struct {
-	prefix       string
-	frozenPrefix string
-	client       *redis.Client
+	prefix        string
+	frozenPrefix  string
+	historyPrefix string
+	lockPrefix    string
+	lockTimeout   time.Duration
+	lockWait      time.Duration
+	client        Client
 }
 
 // New creates a new Redis session instance.
@@ -48,19 +92,38 @@ func New(options *Config) *Session {
 	if options.FrozenPrefix == "" {
 		options.FrozenPrefix = "frozen:" + options.Prefix
 	}
+	if options.HistoryPrefix == "" {
+		options.HistoryPrefix = "history:" + options.Prefix
+	}
+	if options.LockPrefix == "" {
+		options.LockPrefix = "lock:" + options.Prefix
+	}
+	if options.LockTimeout <= 0 {
+		options.LockTimeout = 10 * time.Second
+	}
+	if options.LockWait <= 0 {
+		options.LockWait = options.LockTimeout
+	}
 
 	// Default options for Redis if none provided.
-	if options.Redis == nil {
-		options.Redis = &redis.Options{
-			Addr: "localhost:6379",
-			DB:   0,
+	if options.Client == nil {
+		if options.Redis == nil {
+			options.Redis = &redis.Options{
+				Addr: "localhost:6379",
+				DB:   0,
+			}
 		}
+		options.Client = redis.NewClient(options.Redis)
 	}
 
 	return &Session{
-		prefix:       options.Prefix,
-		frozenPrefix: options.FrozenPrefix,
-		client:       redis.NewClient(options.Redis),
+		prefix:        options.Prefix,
+		frozenPrefix:  options.FrozenPrefix,
+		historyPrefix: options.HistoryPrefix,
+		lockPrefix:    options.LockPrefix,
+		lockTimeout:   options.LockTimeout,
+		lockWait:      options.LockWait,
+		client:        options.Client,
 	}
 }
 
@@ -68,95 +131,135 @@ func New(options *Config) *Session {
 // returns the pointer to it in any event.
 func (s *Session) Init(username string) *sessions.UserData {
 	// See if they have any data in Redis, and return it if so.
-	user, err := s.getRedis(username)
+	user, err := s.getUser(username)
 	if err == nil {
 		return user
 	}
 
 	// Create the default session.
-	user = defaultSession()
-
-	// Put them in Redis.
-	s.putRedis(username, user)
-	return user
+	s.exec(username, func(pipe *redis.Pipeline) {
+		s.initUser(pipe, username)
+	})
+	return defaultSession()
 }
 
-// Set puts a user variable into Redis.
+// Set puts user variables into Redis.
 func (s *Session) Set(username string, vars map[string]string) {
-	data := s.Init(username)
-
-	for key, value := range vars {
-		data.Variables[key] = value
-	}
-
-	s.putRedis(username, data)
+	s.exec(username, func(pipe *redis.Pipeline) {
+		s.initUser(pipe, username)
+		for key, value := range vars {
+			pipe.HSet(s.key(username), varField+key, value)
+		}
+	})
 }
 
 // AddHistory adds to a user's history data.
 func (s *Session) AddHistory(username, input, reply string) {
-	data := s.Init(username)
+	s.AddHistoryEntry(username, sessions.HistoryEntry{Input: input, Reply: reply}, sessions.HistorySize)
+}
 
-	// Pop, unshift, pop, unshift.
-	data.History.Input = data.History.Input[:len(data.History.Input)-1]
-	data.History.Input = append([]string{strings.TrimSpace(input)}, data.History.Input...)
-	data.History.Reply = data.History.Reply[:len(data.History.Reply)-1]
-	data.History.Reply = append([]string{strings.TrimSpace(reply)}, data.History.Reply...)
+// AddHistoryEntry adds an entry to a user's history, keeping `size` entries.
+func (s *Session) AddHistoryEntry(username string, entry sessions.HistoryEntry, size int) {
+	if size <= 0 {
+		size = sessions.HistorySize
+	}
+	entry.Input = strings.TrimSpace(entry.Input)
+	entry.Reply = strings.TrimSpace(entry.Reply)
 
-	s.putRedis(username, data)
+	encoded, err := encodeEntry(entry)
+	if err != nil {
+		return
+	}
+
+	s.exec(username, func(pipe *redis.Pipeline) {
+		s.initUser(pipe, username)
+		pipe.LPush(s.historyKey(username), encoded)
+		pipe.LTrim(s.historyKey(username), 0, int64(size-1))
+	})
 }
 
 // SetLastMatch sets the user's last matched trigger.
 func (s *Session) SetLastMatch(username, trigger string) {
-	data := s.Init(username)
-	data.LastMatch = trigger
-	s.putRedis(username, data)
+	s.exec(username, func(pipe *redis.Pipeline) {
+		s.initUser(pipe, username)
+		pipe.HSet(s.key(username), lastMatchField, trigger)
+	})
 }
 
-// Get a user variable out of Redis.
-func (s *Session) Get(username, name string) (string, error) {
-	data, err := s.getRedis(username)
-	if err != nil {
-		return "", err
+// Update saves a batch of changes to a user's data in one pipeline.
+func (s *Session) Update(username string, update sessions.Update) error {
+	size := update.HistorySize
+	if size <= 0 {
+		size = sessions.HistorySize
 	}
 
-	value, ok := data.Variables[name]
-	if !ok {
+	history := []interface{}{}
+	for _, entry := range update.History {
+		entry.Input = strings.TrimSpace(entry.Input)
+		entry.Reply = strings.TrimSpace(entry.Reply)
+		encoded, err := encodeEntry(entry)
+		if err != nil {
+			return err
+		}
+		history = append(history, encoded)
+	}
+
+	_, err := s.exec(username, func(pipe *redis.Pipeline) {
+		s.initUser(pipe, username)
+		for key, value := range update.Variables {
+			pipe.HSet(s.key(username), varField+key, value)
+		}
+		if update.HasLastMatch {
+			pipe.HSet(s.key(username), lastMatchField, update.LastMatch)
+		}
+		if len(history) > 0 {
+			pipe.LPush(s.historyKey(username), history...)
+			pipe.LTrim(s.historyKey(username), 0, int64(size-1))
+		}
+	})
+	return err
+}
+
+// Get a user variable out of Redis.
+func (s *Session) Get(username, name string) (string, error) {
+	var value *redis.StringCmd
+	_, err := s.exec(username, func(pipe *redis.Pipeline) {
+		value = pipe.HGet(s.key(username), varField+name)
+	})
+	if err == redis.Nil {
 		return "", fmt.Errorf(`variable "%s" for user "%s" not set`, name, username)
+	} else if err != nil {
+		return "", fmt.Errorf(`no data for username "%s": %s`, username, err)
 	}
-	return value, nil
+
+	return value.Val(), nil
 }
 
 // GetAny returns all variables about a user.
 func (s *Session) GetAny(username string) (*sessions.UserData, error) {
-	// Check redis.
-	data, err := s.getRedis(username)
-	if err != nil {
-		return nil, err
-	}
-	return data, nil
+	return s.getUser(username)
 }
 
 // GetAll gets all data for all users.
 func (s *Session) GetAll() map[string]*sessions.UserData {
 	result := map[string]*sessions.UserData{}
 
-	keys, err := s.client.Keys(s.prefix + "*").Result()
-	if err != nil {
-		return result
-	}
-
-	for _, key := range keys {
-		username := strings.Replace(key, s.prefix, "", 1)
-		data, _ := s.GetAny(username)
-		result[username] = data
-	}
+	s.scan(s.prefix, func(keys []string) error {
+		for _, key := range keys {
+			username := strings.TrimPrefix(key, s.prefix)
+			if data, err := s.getUser(username); err == nil {
+				result[username] = data
+			}
+		}
+		return nil
+	})
 
 	return result
 }
 
 // GetLastMatch retrieves the user's last matched trigger.
 func (s *Session) GetLastMatch(username string) (string, error) {
-	data, err := s.getRedis(username)
+	data, err := s.getUser(username)
 	if err != nil {
 		return "", err
 	}
@@ -166,7 +269,7 @@ func (s *Session) GetLastMatch(username string) (string, error) {
 
 // GetHistory gets the user's history.
 func (s *Session) GetHistory(username string) (*sessions.History, error) {
-	data, err := s.getRedis(username)
+	data, err := s.getUser(username)
 	if err != nil {
 		return nil, err
 	}
@@ -176,35 +279,51 @@ func (s *Session) GetHistory(username string) (*sessions.History, error) {
 
 // Clear deletes all variables about a user.
 func (s *Session) Clear(username string) {
-	s.client.Del(s.prefix + username)
+	s.client.Del(s.key(username))
+	s.client.Del(s.historyKey(username))
 }
 
 // ClearAll resets all user data for all users.
 func (s *Session) ClearAll() {
-	// List all the users.
-	keys, err := s.client.Keys(s.prefix + "*").Result()
-	if err != nil {
-		return
+	// Keys are deleted one at a time, because a Redis cluster can't delete
+	// multiple keys from different hash slots in one command.
+	deleteKeys := func(keys []string) error {
+		pipe := s.client.Pipeline()
+		defer pipe.Close()
+
+		for _, key := range keys {
+			pipe.Del(key)
+			if strings.HasPrefix(key, s.prefix) {
+				pipe.Del(s.historyKey(strings.TrimPrefix(key, s.prefix)))
+			}
+		}
+		_, err := pipe.Exec()
+		return err
 	}
 
-	// Delete them all.
-	s.client.Del(keys...)
+	s.scan(s.prefix, deleteKeys)
+	s.scan(s.frozenPrefix, deleteKeys)
 }
 
 // Freeze makes a snapshot of user variables.
 func (s *Session) Freeze(username string) error {
-	data, err := s.getRedis(username)
+	data, err := s.getUser(username)
 	if err != nil {
 		return err
 	}
 
 	// Duplicate it into the frozen Redis key.
-	return s.putRedisFrozen(username, data, true)
+	return s.putFrozen(username, data)
+}
+
+// GetFrozen returns the user's frozen snapshot without thawing it.
+func (s *Session) GetFrozen(username string) (*sessions.UserData, error) {
+	return s.getFrozen(username)
 }
 
 // Thaw restores user variables from a snapshot.
 func (s *Session) Thaw(username string, action sessions.ThawAction) error {
-	frozen, err := s.getRedisFrozen(username, true)
+	frozen, err := s.getFrozen(username)
 	if err != nil {
 		return fmt.Errorf(`no frozen data for username "%s": %s`, username, err)
 	}
@@ -213,16 +332,16 @@ func (s *Session) Thaw(username string, action sessions.ThawAction) error {
 	switch action {
 	case sessions.Thaw:
 		// Thaw means to restore the frozen copy and then delete the copy.
-		s.Clear(username)
-		s.putRedis(username, frozen)
+		if err := s.putUser(username, frozen); err != nil {
+			return err
+		}
 		s.client.Del(s.frozenKey(username))
 	case sessions.Discard:
 		// Discard means to just delete the frozen copy, do not restore it.
 		s.client.Del(s.frozenKey(username))
 	case sessions.Keep:
 		// Keep restores from the frozen copy, but keeps the frozen copy.
-		s.Clear(username)
-		s.putRedis(username, frozen)
+		return s.putUser(username, frozen)
 	default:
 		return fmt.Errorf(`can't thaw data for username "%s": invalid thaw action`, username)
 	}
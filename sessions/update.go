@@ -0,0 +1,59 @@
+package sessions
+
+/*
+Update is a batch of changes to one user's data, which RiveScript collects
+during a reply and saves all at once when the reply is finished.
+*/
+type Update struct {
+	// User variables to set.
+	Variables map[string]string
+
+	// The user's last matched trigger, if HasLastMatch is true.
+	LastMatch    string
+	HasLastMatch bool
+
+	// History entries to add, oldest first, and the most entries to keep.
+	History     []HistoryEntry
+	HistorySize int
+}
+
+/*
+Updater is an optional interface for session managers that can save an Update
+in one go, for example with a single network round trip. Stores that don't
+implement it are updated one method call at a time.
+*/
+type Updater interface {
+	Update(username string, update Update) error
+}
+
+// Empty tells whether the update has no changes in it.
+func (u Update) Empty() bool {
+	return len(u.Variables) == 0 && !u.HasLastMatch && len(u.History) == 0
+}
+
+/*
+ApplyUpdate saves an update to a session manager.
+
+It uses the session manager's Updater implementation if it has one, and
+otherwise calls Set(), SetLastMatch() and AddHistoryEntry() as needed.
+*/
+func ApplyUpdate(sm SessionManager, username string, update Update) error {
+	if update.Empty() {
+		return nil
+	}
+
+	if updater, ok := sm.(Updater); ok {
+		return updater.Update(username, update)
+	}
+
+	if len(update.Variables) > 0 {
+		sm.Set(username, update.Variables)
+	}
+	if update.HasLastMatch {
+		sm.SetLastMatch(username, update.LastMatch)
+	}
+	for _, entry := range update.History {
+		AddHistoryEntry(sm, username, entry, update.HistorySize)
+	}
+	return nil
+}
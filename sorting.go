@@ -27,6 +27,8 @@ type sortedTriggerEntry struct {
 type sortTrack struct {
 	atomic map[int][]sortedTriggerEntry // Sort by number of whole words
 	option map[int][]sortedTriggerEntry // Sort optionals by number of words
+	regexp []sortedTriggerEntry         // Raw regular expressions, by length
+	entity map[int][]sortedTriggerEntry // Sort entity wildcards by no. of words
 	alpha  map[int][]sortedTriggerEntry // Sort alpha wildcards by no. of words
 	number map[int][]sortedTriggerEntry // Sort numeric wildcards by no. of words
 	wild   map[int][]sortedTriggerEntry // Sort wildcards by no. of words
@@ -178,8 +180,24 @@ func (rs *RiveScript) sortTriggerSet(triggers []sortedTriggerEntry, excludePrevi
 				track[inherits] = initSortTrack()
 			}
 
+			// Star names don't count as words.
+			pattern = reStarName.ReplaceAllString(pattern, "$1")
+			pattern = reEntity.ReplaceAllString(pattern, "<$1>")
+
 			// Start inspecting the trigger's contents.
-			if strings.Index(pattern, "_") > -1 {
+			if trig.pointer.regexp != nil {
+				// A raw regular expression.
+				rs.say("Is a regular expression")
+				track[inherits].regexp = append(track[inherits].regexp, trig)
+			} else if len(rs.triggerExtractors(pattern)) > 0 {
+				// Entity wildcards included.
+				cnt := wordCount(pattern, false)
+				rs.say("Has an entity wildcard with %d words", cnt)
+				if _, ok := track[inherits].entity[cnt]; !ok {
+					track[inherits].entity[cnt] = []sortedTriggerEntry{}
+				}
+				track[inherits].entity[cnt] = append(track[inherits].entity[cnt], trig)
+			} else if strings.Index(pattern, "_") > -1 {
 				// Alphabetic wildcard included.
 				cnt := wordCount(pattern, false)
 				rs.say("Has a _ wildcard with %d words", cnt)
@@ -252,6 +270,8 @@ func (rs *RiveScript) sortTriggerSet(triggers []sortedTriggerEntry, excludePrevi
 			// Sort each of the main kinds of triggers by their word counts.
 			running = sortByWords(running, track[ip].atomic)
 			running = sortByWords(running, track[ip].option)
+			running = sortByLength(running, track[ip].regexp)
+			running = sortByWords(running, track[ip].entity)
 			running = sortByWords(running, track[ip].alpha)
 			running = sortByWords(running, track[ip].number)
 			running = sortByWords(running, track[ip].wild)
@@ -384,6 +404,8 @@ func initSortTrack() *sortTrack {
 	return &sortTrack{
 		atomic: map[int][]sortedTriggerEntry{},
 		option: map[int][]sortedTriggerEntry{},
+		regexp: []sortedTriggerEntry{},
+		entity: map[int][]sortedTriggerEntry{},
 		alpha:  map[int][]sortedTriggerEntry{},
 		number: map[int][]sortedTriggerEntry{},
 		wild:   map[int][]sortedTriggerEntry{},
@@ -0,0 +1,217 @@
+package rivescript
+
+// Go object macros.
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"unicode"
+)
+
+// Subroutine is a function prototype for defining custom object macros in Go.
+type Subroutine func(*RiveScript, []string) string
+
+/*
+SubroutineV2 is a function prototype for Go object macros that want to know
+more about how they were called, and report errors or change the user's data
+through their result.
+
+If it returns an error, the error is logged and the `<call>` tag is replaced
+with the bot's object error message, like for the other object macros.
+*/
+type SubroutineV2 func(*RiveScript, *CallContext) (*CallResult, error)
+
+/*
+CallContext describes a `<call>` tag for a SubroutineV2.
+
+The arguments are split on whitespace, except inside double quotes, which are
+removed; use `\"` for a literal quote. Arguments of the form `key=value` go in
+Named instead of Args, so for this tag:
+
+	<call>weather "new york" units=metric</call>
+
+Args is `["new york"]` and Named is `{"units": "metric"}`.
+*/
+type CallContext struct {
+	Username string            // The user the bot is replying to
+	Topic    string            // The user's topic
+	Stars    []string          // The trigger's matched stars, from <star1>
+	BotStars []string          // The %Previous's matched stars, from <botstar1>
+	Raw      string            // The text of the tag after the object's name
+	Args     []string          // The positional arguments
+	Named    map[string]string // The key=value arguments
+
+	buf *sessionBuffer
+}
+
+/*
+Context returns the context of the reply, for the API calls that take one,
+like `ReplyContext()` and `GetUservarContext()`. They see the reply's changes
+to the user's data, and their own changes are saved along with the reply's.
+*/
+func (call *CallContext) Context() context.Context {
+	return replyContext(call.buf)
+}
+
+/*
+CallResult is what a SubroutineV2 returns.
+
+Reply is the text that replaces the `<call>` tag. The other fields are
+changes to make to the user's data, as if the reply had `<set>`, `{topic}` and
+`{@}` tags where the `<call>` tag is.
+*/
+type CallResult struct {
+	Reply string
+
+	// Set sets the user variables.
+	Set map[string]string
+
+	// Topic puts the user into a topic, if not empty.
+	Topic string
+
+	// Redirect, if not empty, gets the reply to this message and adds it to
+	// the end of Reply.
+	Redirect string
+}
+
+/*
+SetSubroutineV2 defines a Go object macro from your program, with the richer
+SubroutineV2 prototype.
+
+Parameters
+
+	name: The name of your subroutine for the `<call>` tag in RiveScript.
+	fn: A function with a prototype
+	    `func(*RiveScript, *CallContext) (*CallResult, error)`
+*/
+func (rs *RiveScript) SetSubroutineV2(name string, fn SubroutineV2) {
+	rs.cLock.Lock()
+	defer rs.cLock.Unlock()
+
+	rs.subroutines[name] = fn
+}
+
+// upgradeSubroutine adapts a Subroutine to SubroutineV2. It gets the
+// arguments split on each space, like it always has.
+func upgradeSubroutine(fn Subroutine) SubroutineV2 {
+	return func(rs *RiveScript, call *CallContext) (*CallResult, error) {
+		args := []string{}
+		if call.Raw != "" {
+			args = strings.Split(call.Raw, " ")
+		}
+		return &CallResult{Reply: fn(rs, args)}, nil
+	}
+}
+
+// newCallContext prepares the context for calling a Go object macro.
+func (rs *RiveScript) newCallContext(buf *sessionBuffer, raw string, stars, botstars []string) *CallContext {
+	topic, err := buf.get("topic")
+	if err != nil {
+		topic = "random"
+	}
+
+	call := &CallContext{
+		Username: buf.username,
+		Topic:    topic,
+		Stars:    stars,
+		BotStars: botstars,
+		Raw:      raw,
+		Args:     []string{},
+		Named:    map[string]string{},
+		buf:      buf,
+	}
+	for _, arg := range splitArgs(raw) {
+		if arg.named {
+			call.Named[arg.key] = arg.value
+		} else {
+			call.Args = append(call.Args, arg.value)
+		}
+	}
+	return call
+}
+
+// callSubroutine runs a Go object macro and carries out its result.
+func (rs *RiveScript) callSubroutine(name string, fn SubroutineV2, call *CallContext, step uint) string {
+	result, err := fn(rs, call)
+	if err != nil {
+		rs.warn("Error calling object macro %s (go): %s", name, err)
+		return rs.objectError
+	}
+	if result == nil {
+		return ""
+	}
+
+	if len(result.Set) > 0 {
+		call.buf.set(result.Set)
+	}
+	if result.Topic != "" {
+		call.buf.set(map[string]string{"topic": result.Topic})
+	}
+
+	reply := result.Reply
+	if result.Redirect != "" {
+		rs.say("Object macro %s redirects to: %s", name, result.Redirect)
+		target := strings.TrimSpace(result.Redirect)
+		subreply, _, err := rs.getReply(call.buf, target, target, false, step+1)
+		if err != nil {
+			subreply = err.Error()
+		}
+		reply += subreply
+	}
+	return reply
+}
+
+// callArg is one argument of a `<call>` tag.
+type callArg struct {
+	named bool
+	key   string
+	value string
+}
+
+// splitArgs splits the arguments of a `<call>` tag, keeping quoted text
+// together.
+func splitArgs(raw string) []callArg {
+	var (
+		args    []callArg
+		current bytes.Buffer
+		quoted  bool // Inside double quotes
+		started bool // Have part of an argument, maybe an empty ""
+		key     string
+		named   bool
+	)
+
+	finish := func() {
+		if started {
+			args = append(args, callArg{named: named, key: key, value: current.String()})
+		}
+		current.Reset()
+		started, named, key = false, false, ""
+	}
+
+	runes := []rune(raw)
+	for i := 0; i < len(runes); i++ {
+		char := runes[i]
+		switch {
+		case char == '\\' && i+1 < len(runes) && runes[i+1] == '"':
+			current.WriteRune('"')
+			started = true
+			i++
+		case char == '"':
+			quoted = !quoted
+			started = true
+		case unicode.IsSpace(char) && !quoted:
+			finish()
+		case char == '=' && !quoted && !named && current.Len() > 0:
+			named = true
+			key = current.String()
+			current.Reset()
+		default:
+			current.WriteRune(char)
+			started = true
+		}
+	}
+	finish()
+
+	return args
+}
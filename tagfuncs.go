@@ -0,0 +1,332 @@
+package rivescript
+
+// The registry of `<tag>`s that are run inside-out in replies.
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+/*
+TagFunc is a function prototype for a tag like `<get name>` in a reply.
+
+It returns the text to replace the tag with. The tag's arguments have already
+had any tags inside them replaced, so `<mytag <get name>>` gets the user's
+name as its Args.
+*/
+type TagFunc func(*RiveScript, *TagContext) string
+
+// TagContext describes a tag for a TagFunc.
+type TagContext struct {
+	Name     string   // The tag's name, in lowercase
+	Args     string   // The text after the tag's name, e.g. "name" for <get name>
+	Username string   // The user the bot is replying to
+	Message  string   // The user's message
+	Stars    []string // The trigger's matched stars, from <star1>
+	BotStars []string // The %Previous's matched stars, from <botstar1>
+
+	buf *sessionBuffer
+}
+
+/*
+Context returns the context of the reply, for the API calls that take one,
+like `GetUservarContext()`. They see the reply's changes to the user's data,
+and their own changes are saved along with the reply's.
+*/
+func (tag *TagContext) Context() context.Context {
+	return replyContext(tag.buf)
+}
+
+/*
+RegisterTag adds a tag for use in replies, or replaces one of the same name.
+
+Tags are replaced from the inside out, so they can be nested in each other and
+in the built-in tags, e.g. `<set greeting=<mytag <get name>>>`. The built-in
+`<bot>`, `<env>`, `<set>`, `<get>` and math tags are registered the same way
+and can be replaced. Tags that are handled
+before these, like `<star>`, `<input>` and `<id>`, and the `<call>` tag can't
+be.
+
+Parameters
+
+	name: The name of the tag, e.g. "mytag" for `<mytag args>`.
+	fn: A function with a prototype `func(*RiveScript, *TagContext) string`
+*/
+func (rs *RiveScript) RegisterTag(name string, fn TagFunc) {
+	rs.cLock.Lock()
+	defer rs.cLock.Unlock()
+
+	rs.tags[strings.ToLower(name)] = fn
+}
+
+/*
+DeleteTag removes a tag. The tag is left as it is in replies afterward.
+
+Parameters
+
+	name: The name of the tag to be deleted.
+*/
+func (rs *RiveScript) DeleteTag(name string) {
+	rs.cLock.Lock()
+	defer rs.cLock.Unlock()
+
+	delete(rs.tags, strings.ToLower(name))
+}
+
+// builtinTags returns the tags every bot starts with.
+func builtinTags() map[string]TagFunc {
+	return map[string]TagFunc{
+		"bot":   tagBotVariable,
+		"env":   tagBotVariable,
+		"set":   tagSet,
+		"get":   tagGet,
+		"add":   tagMath,
+		"sub":   tagMath,
+		"mult":  tagMath,
+		"div":   tagMath,
+		"mod":   tagMath,
+		"min":   tagMath,
+		"max":   tagMath,
+		"round": tagRound,
+
+		"setlocal": tagSetLocal,
+		"getlocal": tagGetLocal,
+
+		"push":   tagPush,
+		"pop":    tagPop,
+		"remove": tagRemove,
+		"has":    tagHas,
+		"count":  tagCount,
+		"join":   tagJoin,
+		"pick":   tagPick,
+
+		"mapset":    tagMapSet,
+		"mapget":    tagMapGet,
+		"mapdelete": tagMapDelete,
+		"maphas":    tagMapHas,
+		"mapcount":  tagMapCount,
+		"mapkeys":   tagMapKeys,
+
+		"date":      tagDateTime,
+		"time":      tagDateTime,
+		"timeofday": tagTimeOfDay,
+		"daysuntil": tagDaysUntil,
+		"dayssince": tagDaysUntil,
+	}
+}
+
+// tagBotVariable handles <bot> and <env>, which get or set bot variables and
+// globals.
+func tagBotVariable(rs *RiveScript, tag *TagContext) string {
+	var target map[string]string
+	if tag.Name == "bot" {
+		target = rs.vars
+	} else {
+		target = rs.global
+	}
+
+	if strings.Index(tag.Args, "=") > -1 {
+		// Assigning the value.
+		parts := strings.Split(tag.Args, "=")
+		rs.say("Assign %s variable %s = %s", tag.Name, parts[0], parts[1])
+		target[parts[0]] = parts[1]
+		return ""
+	}
+
+	// Getting a bot/env variable.
+	if value, ok := target[tag.Args]; ok {
+		return value
+	}
+	return UNDEFINED
+}
+
+// tagSet handles <set>, which sets user variables.
+func tagSet(rs *RiveScript, tag *TagContext) string {
+	parts := strings.Split(tag.Args, "=")
+	if len(parts) > 1 {
+		rs.say("Set uservar %s = %s", parts[0], parts[1])
+		tag.buf.set(map[string]string{parts[0]: parts[1]})
+	} else {
+		rs.warn("Malformed <set> tag: %s %s", tag.Name, tag.Args)
+	}
+	return ""
+}
+
+// tagGet handles <get>, which gets user variables.
+func tagGet(rs *RiveScript, tag *TagContext) string {
+	value, err := tag.buf.get(tag.Args)
+	if err != nil {
+		return UNDEFINED
+	}
+	return value
+}
+
+/*
+tagSetLocal handles <setlocal>, which sets a variable that only lasts until
+the end of the reply, including its redirects, and is never saved in the
+user's session.
+*/
+func tagSetLocal(rs *RiveScript, tag *TagContext) string {
+	name, value, ok := splitTagArgs(tag.Args)
+	if !ok {
+		rs.warn("Malformed <setlocal> tag: %s %s", tag.Name, tag.Args)
+		return ""
+	}
+	rs.say("Set local variable %s = %s", name, value)
+	if !tag.buf.setLocal(name, value) {
+		rs.warn("Can't set local variable %s outside of a reply", name)
+	}
+	return ""
+}
+
+// tagGetLocal handles <getlocal>, which gets a variable set by <setlocal>
+// earlier in the reply.
+func tagGetLocal(rs *RiveScript, tag *TagContext) string {
+	if value, ok := tag.buf.getLocal(strings.TrimSpace(tag.Args)); ok {
+		return value
+	}
+	return UNDEFINED
+}
+
+// tagMath handles <add>, <sub>, <mult>, <div>, <mod>, <min> and <max>, which
+// do math on user variables.
+func tagMath(rs *RiveScript, tag *TagContext) string {
+	parts := strings.Split(tag.Args, "=")
+	name := parts[0]
+	strValue := ""
+	if len(parts) > 1 {
+		strValue = parts[1]
+	}
+
+	// Initialize the variable?
+	origStr, err := tag.buf.get(name)
+	if err != nil {
+		tag.buf.set(map[string]string{name: "0"})
+		origStr = "0"
+	}
+	if !rs.mathDecimal {
+		return integerMath(tag, name, origStr, strValue)
+	}
+
+	// Sanity check.
+	orig, ok := parseNumber(origStr)
+	if !ok {
+		return fmt.Sprintf("[ERR: Math can't %s non-numeric user variable %s]", tag.Name, name)
+	}
+	value, ok := parseNumber(strValue)
+	if !ok {
+		return fmt.Sprintf("[ERR: Math can't %s non-numeric value %s]", tag.Name, strValue)
+	}
+
+	result := new(big.Rat)
+	switch tag.Name {
+	case "add":
+		result.Add(orig, value)
+	case "sub":
+		result.Sub(orig, value)
+	case "mult":
+		result.Mul(orig, value)
+	case "div", "mod":
+		if value.Sign() == 0 {
+			return "[ERR: Can't Divide By Zero]"
+		}
+		result.Quo(orig, value)
+		if tag.Name == "mod" {
+			// The remainder has the sign of the variable, like Go's %.
+			whole := new(big.Int).Quo(result.Num(), result.Denom())
+			result.Sub(orig, new(big.Rat).Mul(value, new(big.Rat).SetInt(whole)))
+		}
+	case "min":
+		result.Set(orig)
+		if value.Cmp(orig) < 0 {
+			result.Set(value)
+		}
+	case "max":
+		result.Set(orig)
+		if value.Cmp(orig) > 0 {
+			result.Set(value)
+		}
+	}
+
+	// Save it to their account.
+	tag.buf.set(map[string]string{name: rs.formatNumber(result)})
+	return ""
+}
+
+// integerMath does the math of tagMath without Config.MathDecimal: the integer
+// math the tags always did, where a value that isn't a whole number is an
+// error.
+func integerMath(tag *TagContext, name, origStr, strValue string) string {
+	orig, err := strconv.Atoi(origStr)
+	if err != nil {
+		return fmt.Sprintf("[ERR: Math can't %s non-numeric user variable %s]", tag.Name, name)
+	}
+	value, err := strconv.Atoi(strValue)
+	if err != nil {
+		return fmt.Sprintf("[ERR: Math can't %s non-numeric value %s]", tag.Name, strValue)
+	}
+
+	result := orig
+	switch tag.Name {
+	case "add":
+		result += value
+	case "sub":
+		result -= value
+	case "mult":
+		result *= value
+	case "div", "mod":
+		if value == 0 {
+			return "[ERR: Can't Divide By Zero]"
+		}
+		if tag.Name == "div" {
+			result /= value
+		} else {
+			result %= value
+		}
+	case "min":
+		if value < orig {
+			result = value
+		}
+	case "max":
+		if value > orig {
+			result = value
+		}
+	}
+
+	// Save it to their account.
+	tag.buf.set(map[string]string{name: strconv.Itoa(result)})
+	return ""
+}
+
+// tagRound handles <round name> and <round name=places>, which round a user
+// variable to a whole number or to some decimal places.
+func tagRound(rs *RiveScript, tag *TagContext) string {
+	parts := strings.Split(tag.Args, "=")
+	name := parts[0]
+	places := 0
+	if len(parts) > 1 {
+		var err error
+		places, err = strconv.Atoi(strings.TrimSpace(parts[1]))
+		if err != nil || places < 0 {
+			return fmt.Sprintf("[ERR: Can't round to %s decimal places]", parts[1])
+		}
+	}
+
+	origStr, err := tag.buf.get(name)
+	if err != nil {
+		origStr = "0"
+	}
+	orig, ok := parseNumber(origStr)
+	if !ok {
+		return fmt.Sprintf("[ERR: Math can't %s non-numeric user variable %s]", tag.Name, name)
+	}
+
+	result := roundNumber(orig, places, rs.mathRounding)
+	tag.buf.set(map[string]string{
+		name: trimNumber(result.FloatString(places)),
+	})
+	return ""
+}
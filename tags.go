@@ -11,38 +11,68 @@ import (
 	"github.com/aichaos/rivescript-go/sessions"
 )
 
+/*
+lowerMessage prepares a user's message for the triggers that see it before
+it's stripped, like raw regular expressions.
+
+It's lowercased and the substitutions are run, but only the metacharacters and
+HTML brackets are removed, so tags can't be slipped into the stars.
+*/
+func (rs *RiveScript) lowerMessage(msg string) string {
+	msg = strings.ToLower(msg)
+	msg = rs.substitute(msg, rs.sub, rs.sorted.sub)
+	return reMeta.ReplaceAllString(msg, "")
+}
+
 // formatMessage formats a user's message for safe processing.
 func (rs *RiveScript) formatMessage(msg string, botReply bool) string {
-	// Lowercase it.
-	msg = strings.ToLower(msg)
+	// Lowercase it, run substitutions and sanitize what's left.
+	return rs.stripMessage(rs.lowerMessage(msg), botReply)
+}
 
-	// Run substitutions and sanitize what's left.
-	msg = rs.substitute(msg, rs.sub, rs.sorted.sub)
+// stripMessage strips the punctuation from a message that's already been
+// through lowerMessage.
+func (rs *RiveScript) stripMessage(msg string, botReply bool) string {
+	// Outside of UTF-8 mode, strip all non-alphanumerics.
+	if !rs.UTF8 {
+		return stripNasties(msg)
+	}
 
 	// In UTF-8 mode, only strip metacharacters and HTML brackets (to protect
-	// against obvious XSS attacks).
-	if rs.UTF8 {
-		msg = reMeta.ReplaceAllString(msg, "")
-		msg = rs.UnicodePunctuation.ReplaceAllString(msg, "")
+	// against obvious XSS attacks), which is done already, and punctuation.
+	msg = rs.UnicodePunctuation.ReplaceAllString(msg, "")
 
-		// For the bot's reply, also strip common punctuation.
-		if botReply {
-			msg = reSymbols.ReplaceAllString(msg, "")
-		}
-	} else {
-		// For everything else, strip all non-alphanumerics.
-		msg = stripNasties(msg)
+	// For the bot's reply, also strip common punctuation.
+	if botReply {
+		msg = reSymbols.ReplaceAllString(msg, "")
 	}
-
 	return msg
 }
 
 // triggerRegexp prepares a trigger pattern for the regular expression engine.
-func (rs *RiveScript) triggerRegexp(username string, pattern string) string {
+func (rs *RiveScript) triggerRegexp(buf *sessionBuffer, pattern string) string {
 	// If the trigger is simply '*' then the * needs to become (.*?)
 	// to match the blank string too.
 	pattern = reZerowidthstar.ReplaceAllString(pattern, "<zerowidthstar>")
 
+	// Set aside the named wildcards, like *{name}, until the end so their
+	// names don't get mistaken for wildcards or tags.
+	names := reStarName.FindAllStringSubmatch(pattern, -1)
+	for i := range names {
+		pattern = strings.Replace(pattern, names[i][0], fmt.Sprintf("\x02%d\x03", i), 1)
+	}
+
+	// And the entity wildcards, like <date>, so their patterns are left alone.
+	var entities [][]string
+	var extractors []*extractor
+	for _, match := range reEntity.FindAllStringSubmatch(pattern, -1) {
+		if ext, ok := rs.getExtractor(match[1]); ok {
+			pattern = strings.Replace(pattern, match[0], fmt.Sprintf("\x04%d\x05", len(entities)), 1)
+			entities = append(entities, match)
+			extractors = append(extractors, ext)
+		}
+	}
+
 	// Simple replacements.
 	pattern = strings.Replace(pattern, "*", `(.+?)`, -1)
 	pattern = strings.Replace(pattern, "#", `(\d+?)`, -1)
@@ -142,7 +172,7 @@ func (rs *RiveScript) triggerRegexp(username string, pattern string) string {
 		if len(match) > 0 {
 			name := match[1]
 
-			value, err := rs.sessions.Get(username, name)
+			value, err := buf.get(name)
 			if err != nil {
 				value = UNDEFINED
 			}
@@ -152,27 +182,9 @@ func (rs *RiveScript) triggerRegexp(username string, pattern string) string {
 	}
 
 	// Filter in <input> and <reply> tags.
-	giveup = 0
-	pattern = strings.Replace(pattern, "<input>", "<input1>", -1)
-	pattern = strings.Replace(pattern, "<reply>", "<reply1>", -1)
-	for strings.Index(pattern, "<input") > -1 || strings.Index(pattern, "<reply") > -1 {
-		giveup++
-		if giveup > 50 {
-			break
-		}
-
-		for i := 1; i <= sessions.HistorySize; i++ {
-			inputPattern := fmt.Sprintf("<input%d>", i)
-			replyPattern := fmt.Sprintf("<reply%d>", i)
-			history, err := rs.sessions.GetHistory(username)
-			if err == nil {
-				pattern = strings.Replace(pattern, inputPattern, history.Input[i-1], -1)
-				pattern = strings.Replace(pattern, replyPattern, history.Reply[i-1], -1)
-			} else {
-				pattern = strings.Replace(pattern, inputPattern, UNDEFINED, -1)
-				pattern = strings.Replace(pattern, replyPattern, UNDEFINED, -1)
-			}
-		}
+	if strings.Index(pattern, "<input") > -1 || strings.Index(pattern, "<reply") > -1 {
+		history, _ := buf.history()
+		pattern = historyTags(pattern, history)
 	}
 
 	// Recover escaped Unicode symbols.
@@ -181,6 +193,24 @@ func (rs *RiveScript) triggerRegexp(username string, pattern string) string {
 		pattern = strings.Replace(pattern, `\u0040`, "@", -1)
 	}
 
+	// Named wildcards become named groups.
+	wildcards := map[string]string{"*": `.+?`, "#": `\d+?`, "_": `[^\s\d]+?`}
+	for i, name := range names {
+		pattern = strings.Replace(pattern, fmt.Sprintf("\x02%d\x03", i),
+			fmt.Sprintf("(?P<%s>%s)", name[2], wildcards[name[1]]), 1)
+	}
+
+	// Entity wildcards become groups named for their extractors (see
+	// entityGroup), with the extractor's pattern.
+	for i, match := range entities {
+		group := fmt.Sprintf("_%s_%d", match[1], i)
+		if match[2] != "" {
+			group = fmt.Sprintf("_%s_%s", match[1], match[2])
+		}
+		pattern = strings.Replace(pattern, fmt.Sprintf("\x04%d\x05", i),
+			fmt.Sprintf("(?P<%s>%s)", group, extractors[i].pattern), 1)
+	}
+
 	return pattern
 }
 
@@ -189,14 +219,15 @@ processTags processes tags in a reply element.
 
 Params:
 
-	username: The name of the user.
+	buf: The session buffer of the user.
 	message: The user's message.
 	reply: The reply element to process tags on.
 	st: Array of matched stars in the trigger.
 	bst: Array of matched bot stars in a %Previous.
+	named: Map of the trigger's stars that have names.
 	step: Recursion depth counter.
 */
-func (rs *RiveScript) processTags(username string, message string, reply string, st []string, bst []string, step uint) string {
+func (rs *RiveScript) processTags(buf *sessionBuffer, message string, reply string, st []string, bst []string, named map[string]string, step uint) string {
 	// Prepare the stars and botstars.
 	stars := []string{""}
 	stars = append(stars, st...)
@@ -253,20 +284,21 @@ func (rs *RiveScript) processTags(username string, message string, reply string,
 	for i := 1; i < len(botstars); i++ {
 		reply = strings.Replace(reply, fmt.Sprintf("<botstar%d>", i), botstars[i], -1)
 	}
+	reply = reNamedStar.ReplaceAllStringFunc(reply, func(tag string) string {
+		if value, ok := named[reNamedStar.FindStringSubmatch(tag)[1]]; ok {
+			return value
+		}
+		return UNDEFINED
+	})
 
 	// <input> and <reply>
-	reply = strings.Replace(reply, "<input>", "<input1>", -1)
-	reply = strings.Replace(reply, "<reply>", "<reply1>", -1)
-	history, err := rs.sessions.GetHistory(username)
+	history, err := buf.history()
 	if err == nil {
-		for i := 1; i <= sessions.HistorySize; i++ {
-			reply = strings.Replace(reply, fmt.Sprintf("<input%d>", i), history.Input[i-1], -1)
-			reply = strings.Replace(reply, fmt.Sprintf("<reply%d>", i), history.Reply[i-1], -1)
-		}
+		reply = historyTags(reply, history)
 	}
 
 	// <id> and escape codes.
-	reply = strings.Replace(reply, "<id>", username, -1)
+	reply = strings.Replace(reply, "<id>", buf.username, -1)
 	reply = strings.Replace(reply, `\s`, " ", -1)
 	reply = strings.Replace(reply, `\n`, "\n", -1)
 	reply = strings.Replace(reply, `\#`, "#", -1)
@@ -345,94 +377,17 @@ func (rs *RiveScript) processTags(username string, message string, reply string,
 		}
 		insert := ""
 
-		// Handle the various types of tags.
-		if tag == "bot" || tag == "env" {
-			// <bot> and <env> work similarly
-			var target map[string]string
-			if tag == "bot" {
-				target = rs.vars
-			} else {
-				target = rs.global
-			}
-
-			if strings.Index(data, "=") > -1 {
-				// Assigning the value.
-				parts := strings.Split(data, "=")
-				rs.say("Assign %s variable %s = %s", tag, parts[0], parts[1])
-				target[parts[0]] = parts[1]
-			} else {
-				// Getting a bot/env variable.
-				if _, ok := target[data]; ok {
-					insert = target[data]
-				} else {
-					insert = UNDEFINED
-				}
-			}
-		} else if tag == "set" {
-			// <set> user vars
-			parts := strings.Split(data, "=")
-			if len(parts) > 1 {
-				rs.say("Set uservar %s = %s", parts[0], parts[1])
-				rs.sessions.Set(username, map[string]string{parts[0]: parts[1]})
-			} else {
-				rs.warn("Malformed <set> tag: %s", match)
-			}
-		} else if tag == "add" || tag == "sub" || tag == "mult" || tag == "div" {
-			// Math operator tags.
-			parts := strings.Split(data, "=")
-			name := parts[0]
-			strValue := parts[1]
-
-			// Initialize the variable?
-			var origStr string
-			origStr, err = rs.sessions.Get(username, name)
-			if err != nil {
-				rs.sessions.Set(username, map[string]string{name: "0"})
-				origStr = "0"
-			}
-
-			// Sanity check.
-			var value int
-			value, err = strconv.Atoi(strValue)
-			abort := false
-			if err != nil {
-				insert = fmt.Sprintf("[ERR: Math can't %s non-numeric value %s]", tag, strValue)
-				abort = true
-			}
-			var orig int
-			orig, err = strconv.Atoi(origStr)
-			if err != nil {
-				insert = fmt.Sprintf("[ERR: Math can't %s non-numeric user variable %s]", tag, name)
-				abort = true
-			}
-
-			if !abort {
-				result := orig
-				if tag == "add" {
-					result += value
-				} else if tag == "sub" {
-					result -= value
-				} else if tag == "mult" {
-					result *= value
-				} else if tag == "div" {
-					if value == 0 {
-						insert = "[ERR: Can't Divide By Zero]"
-					} else {
-						result /= value
-					}
-				}
-
-				if len(insert) == 0 {
-					// Save it to their account.
-					rs.sessions.Set(username, map[string]string{name: strconv.Itoa(result)})
-				}
-			}
-		} else if tag == "get" {
-			// <get> user vars
-			insert, err = rs.sessions.Get(username, data)
-			if err != nil {
-				insert = UNDEFINED
-			}
+		// Run the tag's function, if it has one.
+		if fn, ok := rs.tags[tag]; ok {
+			insert = fn(rs, &TagContext{
+				Name:     tag,
+				Args:     data,
+				Username: buf.username,
+				Message:  message,
+				Stars:    st,
+				BotStars: bst,
+				buf:      buf,
+			})
 		} else {
 			// Unrecognized tag; preserve it.
 			insert = fmt.Sprintf("\x00%s\x01", match)
@@ -456,7 +411,7 @@ func (rs *RiveScript) processTags(username string, message string, reply string,
 		}
 
 		name := match[1]
-		rs.sessions.Set(username, map[string]string{"topic": name})
+		buf.set(map[string]string{"topic": name})
 		reply = strings.Replace(reply, fmt.Sprintf("{topic=%s}", name), "", -1)
 		match = reTopic.FindStringSubmatch(reply)
 	}
@@ -473,7 +428,8 @@ func (rs *RiveScript) processTags(username string, message string, reply string,
 
 		target := match[1]
 		rs.say("Inline redirection to: %s", target)
-		subreply, err := rs.getReply(username, strings.TrimSpace(target), false, step+1)
+		redirect := strings.TrimSpace(target)
+		subreply, _, err := rs.getReply(buf, redirect, redirect, false, step+1)
 		if err != nil {
 			subreply = err.Error()
 		}
@@ -503,12 +459,18 @@ func (rs *RiveScript) processTags(username string, message string, reply string,
 
 		// Do we know this object?
 		var output string
-		if _, ok := rs.subroutines[obj]; ok {
+		if fn, ok := rs.subroutines[obj]; ok {
 			// It exists as a native Go macro.
-			output = rs.subroutines[obj](rs, args)
+			call := rs.newCallContext(buf, strings.Join(args, " "), st, bst)
+			output = rs.callSubroutine(obj, fn, call, step)
 		} else if _, ok := rs.objlangs[obj]; ok {
 			lang := rs.objlangs[obj]
-			output = rs.handlers[lang].Call(obj, args)
+			var err error
+			output, err = rs.handlers[lang].Call(buf.ctx, obj, args)
+			if err != nil {
+				rs.warn("Error calling object macro %s (%s): %s", obj, lang, err)
+				output = rs.objectError
+			}
 		} else {
 			output = "[ERR: Object Not Found]"
 		}
@@ -520,6 +482,33 @@ func (rs *RiveScript) processTags(username string, message string, reply string,
 	return reply
 }
 
+/*
+historyTags replaces the `<input>` and `<reply>` tags with the user's history.
+
+The tags may be numbered as far back as the history goes, e.g. `<input12>`,
+and a tag without a number is the same as `<input1>`. Tags that go further
+back than the history are replaced with "undefined".
+*/
+func historyTags(text string, history *sessions.History) string {
+	text = reInput.ReplaceAllStringFunc(text, func(tag string) string {
+		return history.Input(historyIndex(reInput, tag))
+	})
+	text = reReply.ReplaceAllStringFunc(text, func(tag string) string {
+		return history.Reply(historyIndex(reReply, tag))
+	})
+	return text
+}
+
+// historyIndex gets the number from an `<inputN>` or `<replyN>` tag.
+func historyIndex(tagRegexp *regexp.Regexp, tag string) int {
+	match := tagRegexp.FindStringSubmatch(tag)
+	if len(match) < 2 || match[1] == "" {
+		return 1
+	}
+	index, _ := strconv.Atoi(match[1])
+	return index
+}
+
 // substitute applies a substitution to an input message.
 func (rs *RiveScript) substitute(message string, subs map[string]string, sorted []string) string {
 	// Safety checking.
@@ -0,0 +1,131 @@
+package rivescript
+
+// Matching messages to triggers.
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// isRegexpTrigger tells whether a trigger is a raw regular expression, like
+// `/^order (\d+)$/`, ignoring its {weight} and {inherits} tags.
+func isRegexpTrigger(pattern string) bool {
+	pattern = strings.TrimSpace(reInherits.ReplaceAllString(reWeight.ReplaceAllString(pattern, ""), ""))
+	return len(pattern) >= 2 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/")
+}
+
+// checkStarNames makes sure a trigger doesn't use a star name twice, like
+// `*{name} and <date>{name}`.
+func checkStarNames(pattern string) error {
+	var names []string
+	for _, match := range reStarName.FindAllStringSubmatch(pattern, -1) {
+		names = append(names, match[2])
+	}
+	for _, match := range reEntity.FindAllStringSubmatch(pattern, -1) {
+		if match[2] != "" {
+			names = append(names, match[2])
+		}
+	}
+
+	seen := map[string]bool{}
+	for _, name := range names {
+		if seen[name] {
+			return fmt.Errorf("the star name %s is used more than once", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+/*
+compileRegexpTrigger compiles a raw regular expression trigger.
+
+The expression is matched against the user's message before it's stripped:
+it's in lowercase and the substitutions have been run, but it keeps its
+punctuation, except for `<`, `>` and `\`, even outside of UTF-8 mode. It isn't
+anchored for you; use `^` and `$` to match the whole message.
+*/
+func compileRegexpTrigger(pattern string) (*regexp.Regexp, error) {
+	pattern = strings.TrimSpace(reWeight.ReplaceAllString(pattern, ""))
+	return regexp.Compile(pattern[1 : len(pattern)-1])
+}
+
+/*
+matchTrigger tries to match a message to a trigger.
+
+It returns whether it matched, the stars in the order they appear in the
+trigger, and the stars that have names. The pattern is the trigger's text with
+any {inherits} tag it was sorted with. Raw regular expressions are matched
+against the raw message, which isn't stripped, and triggers with entity
+wildcards against the raw message stripped around their entities.
+*/
+func (rs *RiveScript) matchTrigger(buf *sessionBuffer, message, raw string, trig *astTrigger, pattern string) (bool, []string, map[string]string) {
+	stars := []string{}
+	named := map[string]string{}
+
+	// Raw regular expressions are already compiled.
+	if trig.regexp != nil {
+		rs.say("Try to match \"%s\" against regexp %s", raw, trig.regexp)
+		match := trig.regexp.FindStringSubmatch(raw)
+		if match == nil {
+			return false, stars, named
+		}
+		for i, name := range trig.regexp.SubexpNames() {
+			if i == 0 {
+				continue
+			}
+			stars = append(stars, match[i])
+			if name != "" {
+				named[name] = match[i]
+			}
+		}
+		return true, stars, named
+	}
+
+	// Entity wildcards see their entities' punctuation.
+	if strings.Contains(pattern, "<") {
+		if names := rs.triggerExtractors(pattern); len(names) > 0 {
+			message = rs.stripAroundEntities(raw, names)
+		}
+	}
+
+	expr := rs.triggerRegexp(buf, pattern)
+	rs.say("Try to match \"%s\" against %s (%s)", message, pattern, expr)
+
+	// If the trigger is atomic, we don't need to bother with the regexp engine.
+	if isAtomic(pattern) && message == expr {
+		return true, stars, named
+	}
+
+	// Non-atomic triggers always need the regexp.
+	matcher := regexp.MustCompile(fmt.Sprintf("^%s$", expr))
+	match := matcher.FindStringSubmatch(message)
+	if len(match) == 0 {
+		return false, stars, named
+	}
+
+	// Collect the stars. Entity wildcards need their extractors to accept
+	// them, too.
+	for i, name := range matcher.SubexpNames() {
+		if i == 0 {
+			continue
+		}
+
+		value := match[i]
+		if extractor, starName, ok := entityGroup(name); ok {
+			name = starName
+			if value != "" {
+				if value, ok = rs.extract(buf, extractor, value); !ok {
+					return false, []string{}, map[string]string{}
+				}
+			}
+		}
+
+		stars = append(stars, value)
+		if name != "" {
+			named[name] = value
+		}
+	}
+	return true, stars, named
+}
@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"regexp"
 	"strings"
+	"time"
 )
 
 // randomInt gets a random number using RiveScript's internal RNG.
@@ -15,6 +16,30 @@ func (rs *RiveScript) randomInt(max int) int {
 	return rs.rng.Intn(max)
 }
 
+/*
+RandomInt returns a random number from 0 up to (but not including) max, using
+the bot's random number generator, so it follows the bot's Seed.
+
+This is for object macros that should be as repeatable as the bot's own
+random replies.
+*/
+func (rs *RiveScript) RandomInt(max int) int {
+	if max <= 0 {
+		return 0
+	}
+	return rs.randomInt(max)
+}
+
+/*
+Now returns the current time from the bot's clock, Config.Clock.
+
+This is for object macros and extensions that should use the same time as the
+bot's own date and time tags, including a fixed time in tests.
+*/
+func (rs *RiveScript) Now() time.Time {
+	return rs.clock()
+}
+
 // wordCount counts the number of real words in a string.
 func wordCount(pattern string, all bool) int {
 	var words []string